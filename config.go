@@ -0,0 +1,476 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta-cusd/services"
+	"github.com/coinbase/rosetta-sdk-go/fetcher"
+)
+
+// Every setting is a flag. Each can also be set with an environment
+// variable named after the flag (ROSETTA_CUSD_ followed by the flag name
+// upper-cased, with "." and "-" replaced by "_", e.g. ROSETTA_CUSD_CORE_URL)
+// or in a JSON config file given with --config, keyed by flag name.
+// Flags take precedence over the environment, which takes precedence over
+// the config file.
+
+const envPrefix = "ROSETTA_CUSD_"
+
+// Flags whose values are not shown by --print-config
+var secretFlags = map[string]bool{
+	"webhook.secret":      true,
+	"webhook.admin.token": true,
+}
+
+type config struct {
+	configFile  string
+	printConfig bool
+
+	// Core rosetta client
+	coreURL          string
+	corePort         uint
+	coreTimeout      time.Duration
+	coreRetries      int
+	coreRetryBackoff time.Duration
+	coreMaxBackoff   time.Duration
+	coreTimeouts     string
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	coreTLSCA        string
+	coreTLSCert      string
+	coreTLSKey       string
+	coreTLSInsecure  bool
+	coreBalance      string
+	coreMaxBlockLag  int64
+	coreHealthEvery  time.Duration
+
+	// Celo node behind core rosetta
+	nodeURL string
+
+	// Server
+	listenAddr string
+	listenPort uint
+	tlsCert    string
+	tlsKey     string
+	maxSyncLag time.Duration
+
+	// Observability
+	logLevel      string
+	logFormat     string
+	traceExporter string
+	traceEndpoint string
+
+	// Caches
+	inflationCacheSize int
+
+	// StableToken
+	tokenAddress         string
+	tokenActivationIndex int64
+	initialHolders       string
+	exchangeAddress      string
+	reserveAddress       string
+	goldTokenAddress     string
+
+	// Optional services
+	webhookConfig        string
+	webhookAdmin         bool
+	webhookAdminToken    string
+	webhookSecret        string
+	webhookConfirmations int64
+	webhookCursor        string
+	verifySupply         bool
+	streamEnabled        bool
+	nonceManager         bool
+	nonceTTL             time.Duration
+	trackSubmissions     bool
+	submissionInterval   time.Duration
+	submissionRetention  time.Duration
+	submissionConfirms   uint64
+}
+
+func newFlagSet(cfg *config) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.StringVar(&cfg.configFile, "config", "", "Path to a JSON config file, keyed by flag name")
+	fs.BoolVar(&cfg.printConfig, "print-config", false, "Print the effective configuration as JSON and exit")
+
+	fs.StringVar(&cfg.coreURL, "core.url", "http://localhost:8080", "URL of the core Rosetta RPC server, including scheme and any path prefix, or a comma separated list of URLs of several servers")
+	fs.UintVar(&cfg.corePort, "core.port", 0, "Port of the core Rosetta RPC servers, overriding any port in --core.url (URLs without a port default to 8080)")
+	fs.StringVar(&cfg.coreBalance, "core.balance", services.BalanceRoundRobin, "How reads are spread between core Rosetta RPC servers: round-robin or lowest-lag")
+	fs.Int64Var(&cfg.coreMaxBlockLag, "core.max-block-lag", services.DefaultCoreMaxBlockLag, "Blocks a core Rosetta RPC server may lag behind the most advanced one before it stops receiving requests")
+	fs.DurationVar(&cfg.coreHealthEvery, "core.health-interval", services.DefaultCoreHealthInterval, "Interval between health checks of each core Rosetta RPC server")
+	fs.DurationVar(&cfg.coreTimeout, "core.timeout", fetcher.DefaultHTTPTimeout, "Timeout of each attempt of a request to core rosetta")
+	fs.StringVar(&cfg.coreTimeouts, "core.timeouts", "", "Per-endpoint overrides of --core.timeout, e.g. \"/block=30s,/call=5s\"")
+	fs.IntVar(&cfg.coreRetries, "core.retries", 2, "Number of retries of requests to core rosetta that fail to connect, time out, or fail with a gateway or retriable error (submissions are never retried)")
+	fs.DurationVar(&cfg.coreRetryBackoff, "core.retry-backoff", 200*time.Millisecond, "Bound of the random delay before the first retry of a request to core rosetta, doubled on each retry")
+	fs.DurationVar(&cfg.coreMaxBackoff, "core.retry-max-backoff", 5*time.Second, "Upper bound of the delay between retries of a request to core rosetta")
+	fs.IntVar(&cfg.breakerThreshold, "core.breaker.threshold", 5, "Consecutive failures of a core Rosetta RPC server after which it is taken out of rotation (0 disables the circuit breakers)")
+	fs.DurationVar(&cfg.breakerCooldown, "core.breaker.cooldown", 30*time.Second, "How long a core Rosetta RPC server stays out of rotation once its circuit breaker opens, before it is probed again")
+	fs.StringVar(&cfg.coreTLSCA, "core.tls.ca", "", "PEM file of the certificate authorities trusted for core rosetta, instead of the system ones")
+	fs.StringVar(&cfg.coreTLSCert, "core.tls.cert", "", "PEM client certificate presented to core rosetta")
+	fs.StringVar(&cfg.coreTLSKey, "core.tls.key", "", "PEM key of --core.tls.cert")
+	fs.BoolVar(&cfg.coreTLSInsecure, "core.tls.insecure-skip-verify", false, "Do not verify the certificate of core rosetta")
+
+	fs.StringVar(&cfg.nodeURL, "node.url", "", "JSON-RPC URL of the Celo node behind core rosetta, for transaction metadata in /block responses")
+
+	fs.StringVar(&cfg.listenAddr, "cusd.addr", "", "Listening address for cUSD http server")
+	fs.UintVar(&cfg.listenPort, "cusd.port", 8081, "Listening port for cUSD http server")
+	fs.StringVar(&cfg.tlsCert, "tls.cert", "", "PEM certificate to serve HTTPS with, instead of HTTP")
+	fs.StringVar(&cfg.tlsKey, "tls.key", "", "PEM key of --tls.cert")
+	fs.DurationVar(&cfg.maxSyncLag, "sync.max-lag", services.DefaultMaxSyncLag, "Largest delay between the chain tip and wall-clock for /sync to report synced")
+
+	fs.StringVar(&cfg.logLevel, "log.level", "info", "Minimum level of the messages logged: debug, info, warn or error")
+	fs.StringVar(&cfg.logFormat, "log.format", services.LogFormatText, "Format of the log lines: text or json")
+	fs.StringVar(&cfg.traceExporter, "trace.exporter", "none", "Where to export tracing spans: none, stdout or otlp")
+	fs.StringVar(&cfg.traceEndpoint, "trace.endpoint", services.DefaultOTLPEndpoint, "OTLP/HTTP traces endpoint of the collector, for --trace.exporter=otlp")
+
+	fs.IntVar(&cfg.inflationCacheSize, "cache.inflation-size", services.DefaultInflationCacheSize, "Number of blocks whose StableToken inflation parameters are cached")
+
+	fs.StringVar(&cfg.tokenAddress, "cusd.address", "", "StableToken contract address, overriding the one known for the network")
+	fs.Int64Var(&cfg.tokenActivationIndex, "cusd.activation-index", -1, "Block at which the StableToken is registered, overriding the one known for the network")
+	fs.StringVar(&cfg.initialHolders, "cusd.initial-holders", "", "Comma separated accounts credited by StableToken.initialize() without a Transfer log")
+	fs.StringVar(&cfg.exchangeAddress, "cusd.exchange-address", "", "Exchange contract address, overriding the one known for the network")
+	fs.StringVar(&cfg.reserveAddress, "cusd.reserve-address", "", "Reserve contract address, overriding the one known for the network")
+	fs.StringVar(&cfg.goldTokenAddress, "cusd.gold-token-address", "", "GoldToken (CELO) contract address, overriding the one known for the network")
+
+	fs.StringVar(&cfg.webhookConfig, "webhook.config", "", "Path to a JSON file of webhook subscriptions to load at startup")
+	fs.BoolVar(&cfg.webhookAdmin, "webhook.admin", false, "Serve the /admin/webhooks/* API for managing webhook subscriptions")
+	fs.StringVar(&cfg.webhookAdminToken, "webhook.admin.token", "", "Bearer token required by the webhook admin API (required with --webhook.admin)")
+	fs.StringVar(&cfg.webhookSecret, "webhook.secret", "", "Secret used to sign webhook payloads")
+	fs.Int64Var(&cfg.webhookConfirmations, "webhook.confirmations", 0, "Number of blocks on top of a block before its webhooks are sent")
+	fs.StringVar(&cfg.webhookCursor, "webhook.cursor-file", "", "File keeping the last block whose webhooks were delivered, so that blocks produced while stopped are notified after a restart")
+	fs.BoolVar(&cfg.verifySupply, "verify.supply", false, "Check that every new block's mints and burns match its change in total supply")
+	fs.BoolVar(&cfg.streamEnabled, "stream", false, "Serve new cUSD transactions as Server-Sent Events on /stream/transactions")
+	fs.BoolVar(&cfg.nonceManager, "nonce.manager", false, "Reserve nonces per sender across concurrent construction flows, instead of using the pending nonce read by core")
+	fs.DurationVar(&cfg.nonceTTL, "nonce.reservation-ttl", services.DefaultNonceReservationTTL, "How long a nonce stays reserved for a construction flow, and for its transaction after submission")
+	fs.BoolVar(&cfg.trackSubmissions, "submission.track", false, "Follow submitted transactions until mined, rebroadcasting dropped ones, and serve their status on /construction/status (requires --node.url)")
+	fs.DurationVar(&cfg.submissionInterval, "submission.poll-interval", services.DefaultWatcherInterval, "Interval between checks of the submitted transactions")
+	fs.DurationVar(&cfg.submissionRetention, "submission.retention", services.DefaultSubmissionRetention, "How long submitted transactions are followed and their status kept")
+	fs.Uint64Var(&cfg.submissionConfirms, "submission.confirmations", services.DefaultSubmissionConfirmations, "Confirmations after which mined submitted transactions are no longer checked for reorgs")
+	return fs
+}
+
+// Name of the environment variable setting flagName.
+func envName(flagName string) string {
+	return envPrefix + strings.NewReplacer(".", "_", "-", "_").Replace(strings.ToUpper(flagName))
+}
+
+// Parses args, then fills in every flag not given on the command line
+// from the environment or, failing that, from the config file.
+func loadConfig(args []string) (*config, *flag.FlagSet, error) {
+	cfg := &config{}
+	fs := newFlagSet(cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// --config itself may come from the environment
+	if !explicit["config"] {
+		if value, ok := os.LookupEnv(envName("config")); ok {
+			cfg.configFile = value
+		}
+	}
+	fileValues := make(map[string]string)
+	if cfg.configFile != "" {
+		var err error
+		fileValues, err = readConfigFile(cfg.configFile, fs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var setErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), err)
+			}
+			return
+		}
+		if value, ok := fileValues[f.Name]; ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value %q for %s in %s: %w", value, f.Name, cfg.configFile, err)
+			}
+		}
+	})
+	if setErr != nil {
+		return nil, nil, setErr
+	}
+	return cfg, fs, cfg.validate()
+}
+
+// Reads a JSON object of flag names to values (strings, numbers, booleans,
+// or lists of strings for comma separated flags).
+func readConfigFile(path string, fs *flag.FlagSet) (map[string]string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	var entries map[string]interface{}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(entries))
+	for name, entry := range entries {
+		if fs.Lookup(name) == nil || name == "config" || name == "print-config" {
+			return nil, fmt.Errorf("unknown setting %q in config file %s", name, path)
+		}
+		switch v := entry.(type) {
+		case nil:
+			continue
+		case string:
+			values[name] = v
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		case float64:
+			values[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("unsupported value for %q in config file %s", name, path)
+		}
+	}
+	return values, nil
+}
+
+func (cfg *config) validate() error {
+	if _, err := cfg.coreBaseURLs(); err != nil {
+		return err
+	}
+	if cfg.nodeURL != "" {
+		if u, err := url.Parse(cfg.nodeURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid --node.url %q, expected an absolute URL such as http://localhost:8545", cfg.nodeURL)
+		}
+	}
+	if cfg.coreBalance != services.BalanceRoundRobin && cfg.coreBalance != services.BalanceLowestLag {
+		return fmt.Errorf("invalid --core.balance %q, expected round-robin or lowest-lag", cfg.coreBalance)
+	}
+	if cfg.coreMaxBlockLag < 0 {
+		return errors.New("--core.max-block-lag must not be negative")
+	}
+	if cfg.coreHealthEvery <= 0 {
+		return errors.New("--core.health-interval must be positive")
+	}
+	if (cfg.coreTLSCert == "") != (cfg.coreTLSKey == "") {
+		return errors.New("--core.tls.cert and --core.tls.key must be given together")
+	}
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		return errors.New("--tls.cert and --tls.key must be given together")
+	}
+	if cfg.coreTimeout <= 0 {
+		return errors.New("--core.timeout must be positive")
+	}
+	if cfg.coreRetries < 0 {
+		return errors.New("--core.retries must not be negative")
+	}
+	if cfg.breakerThreshold < 0 {
+		return errors.New("--core.breaker.threshold must not be negative")
+	}
+	if _, err := cfg.coreEndpointTimeouts(); err != nil {
+		return err
+	}
+	if cfg.webhookAdmin && cfg.webhookAdminToken == "" {
+		return errors.New("--webhook.admin requires --webhook.admin.token")
+	}
+	if cfg.nonceTTL <= 0 {
+		return errors.New("--nonce.reservation-ttl must be positive")
+	}
+	if cfg.trackSubmissions && cfg.nodeURL == "" {
+		return errors.New("--submission.track requires --node.url")
+	}
+	if cfg.submissionInterval <= 0 {
+		return errors.New("--submission.poll-interval must be positive")
+	}
+	if cfg.submissionRetention <= 0 {
+		return errors.New("--submission.retention must be positive")
+	}
+	if cfg.submissionConfirms == 0 {
+		return errors.New("--submission.confirmations must be positive")
+	}
+	if cfg.inflationCacheSize <= 0 {
+		return errors.New("--cache.inflation-size must be positive")
+	}
+	if cfg.tokenAddress != "" && !common.IsHexAddress(cfg.tokenAddress) {
+		return fmt.Errorf("invalid --cusd.address %q", cfg.tokenAddress)
+	}
+	if cfg.exchangeAddress != "" && !common.IsHexAddress(cfg.exchangeAddress) {
+		return fmt.Errorf("invalid --cusd.exchange-address %q", cfg.exchangeAddress)
+	}
+	if cfg.reserveAddress != "" && !common.IsHexAddress(cfg.reserveAddress) {
+		return fmt.Errorf("invalid --cusd.reserve-address %q", cfg.reserveAddress)
+	}
+	if cfg.goldTokenAddress != "" && !common.IsHexAddress(cfg.goldTokenAddress) {
+		return fmt.Errorf("invalid --cusd.gold-token-address %q", cfg.goldTokenAddress)
+	}
+	for _, holder := range cfg.initialHolderAddresses() {
+		if !common.IsHexAddress(holder) {
+			return fmt.Errorf("invalid initial holder address %q", holder)
+		}
+	}
+	return nil
+}
+
+// Port of core rosetta URLs without one, --core.port used to default to it
+const defaultCorePort = 8080
+
+// Base paths of the core rosetta APIs, e.g. "https://core.example.com:8080/rosetta".
+func (cfg *config) coreBaseURLs() ([]string, error) {
+	var urls []string
+	for _, rawURL := range strings.Split(cfg.coreURL, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid --core.url %q, expected an absolute URL such as http://localhost:8080", rawURL)
+		}
+		switch {
+		case cfg.corePort != 0:
+			u.Host = net.JoinHostPort(u.Hostname(), strconv.FormatUint(uint64(cfg.corePort), 10))
+		case u.Port() == "":
+			u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(defaultCorePort))
+		}
+		urls = append(urls, strings.TrimSuffix(u.String(), "/"))
+	}
+	return urls, nil
+}
+
+// Parses --core.timeouts, a comma separated list of path=duration.
+func (cfg *config) coreEndpointTimeouts() (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	if cfg.coreTimeouts == "" {
+		return timeouts, nil
+	}
+	for _, entry := range strings.Split(cfg.coreTimeouts, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("invalid --core.timeouts entry %q, expected /path=duration", entry)
+		}
+		timeout, err := time.ParseDuration(parts[1])
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid --core.timeouts duration %q", parts[1])
+		}
+		timeouts[parts[0]] = timeout
+	}
+	return timeouts, nil
+}
+
+// How requests to core rosetta are timed out, retried and cut off.
+func (cfg *config) upstreamPolicy() services.UpstreamPolicy {
+	timeouts, _ := cfg.coreEndpointTimeouts()
+	return services.UpstreamPolicy{
+		Timeout:          cfg.coreTimeout,
+		Timeouts:         timeouts,
+		Retries:          cfg.coreRetries,
+		Backoff:          cfg.coreRetryBackoff,
+		MaxBackoff:       cfg.coreMaxBackoff,
+		BreakerThreshold: cfg.breakerThreshold,
+		BreakerCooldown:  cfg.breakerCooldown,
+	}
+}
+
+func (cfg *config) initialHolderAddresses() []string {
+	if cfg.initialHolders == "" {
+		return nil
+	}
+	return strings.Split(cfg.initialHolders, ",")
+}
+
+func (cfg *config) listenAddress() string {
+	return net.JoinHostPort(cfg.listenAddr, strconv.FormatUint(uint64(cfg.listenPort), 10))
+}
+
+// Transport for requests to core rosetta, with the configured TLS settings.
+func (cfg *config) coreTransport() (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.coreTLSCA == "" && cfg.coreTLSCert == "" && !cfg.coreTLSInsecure {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.coreTLSInsecure, // #nosec G402 -- explicitly requested
+	}
+	if cfg.coreTLSCA != "" {
+		pem, err := ioutil.ReadFile(cfg.coreTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read --core.tls.ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.coreTLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.coreTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.coreTLSCert, cfg.coreTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load core rosetta client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// Writes every setting as a JSON config file, with secrets redacted.
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	values := make(map[string]interface{})
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		value := f.Value.(flag.Getter).Get()
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if secretFlags[f.Name] && v != "" {
+				value = "<redacted>"
+			}
+		}
+		values[f.Name] = value
+	})
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(values)
+}
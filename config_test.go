@@ -0,0 +1,211 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes content to a config file removed at the end of the test.
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "rosetta-cusd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Sets the environment variables in env for the duration of the test.
+func setEnv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	fileContent := `{
+		"core.url": "http://file:8080",
+		"core.retries": 4,
+		"stream": true,
+		"cusd.initial-holders": ["0x000000000000000000000000000000000000dEaD", "0x0000000000000000000000000000000000000001"]
+	}`
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		file   string
+		err    string
+		verify func(t *testing.T, cfg *config)
+	}{
+		{
+			name: "defaults",
+			verify: func(t *testing.T, cfg *config) {
+				if cfg.coreURL != "http://localhost:8080" || cfg.listenPort != 8081 || cfg.coreRetries != 2 {
+					t.Errorf("unexpected defaults %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "flags",
+			args: []string{"--core.url", "http://flag:8080", "--core.timeout", "3s", "--stream"},
+			verify: func(t *testing.T, cfg *config) {
+				if cfg.coreURL != "http://flag:8080" || cfg.coreTimeout != 3*time.Second || !cfg.streamEnabled {
+					t.Errorf("flags not applied: %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "environment",
+			env:  map[string]string{"ROSETTA_CUSD_CORE_URL": "http://env:8080", "ROSETTA_CUSD_CORE_RETRY_MAX_BACKOFF": "1s"},
+			verify: func(t *testing.T, cfg *config) {
+				if cfg.coreURL != "http://env:8080" || cfg.coreMaxBackoff != time.Second {
+					t.Errorf("environment not applied: %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "config file",
+			file: fileContent,
+			verify: func(t *testing.T, cfg *config) {
+				if cfg.coreURL != "http://file:8080" || cfg.coreRetries != 4 || !cfg.streamEnabled {
+					t.Errorf("config file not applied: %+v", cfg)
+				}
+				if len(cfg.initialHolderAddresses()) != 2 {
+					t.Errorf("initial holders %q, expected 2", cfg.initialHolders)
+				}
+			},
+		},
+		{
+			name: "flags override environment and file",
+			args: []string{"--core.url", "http://flag:8080"},
+			env:  map[string]string{"ROSETTA_CUSD_CORE_URL": "http://env:8080", "ROSETTA_CUSD_CORE_RETRIES": "6"},
+			file: fileContent,
+			verify: func(t *testing.T, cfg *config) {
+				if cfg.coreURL != "http://flag:8080" {
+					t.Errorf("core.url %s, expected the flag", cfg.coreURL)
+				}
+				if cfg.coreRetries != 6 {
+					t.Errorf("core.retries %d, expected the environment", cfg.coreRetries)
+				}
+				if !cfg.streamEnabled {
+					t.Error("stream not set from the config file")
+				}
+			},
+		},
+		{
+			name: "config file from the environment",
+			env:  map[string]string{"ROSETTA_CUSD_CONFIG": "FILE"},
+			file: fileContent,
+			verify: func(t *testing.T, cfg *config) {
+				if cfg.coreURL != "http://file:8080" {
+					t.Errorf("config file not applied: %+v", cfg)
+				}
+			},
+		},
+		{name: "unknown flag", args: []string{"--core.unknown", "1"}, err: "flag provided but not defined"},
+		{name: "unknown setting in file", file: `{"core.unknown": 1}`, err: "unknown setting"},
+		{name: "invalid file", file: `{`, err: "could not parse config file"},
+		{name: "invalid environment value", env: map[string]string{"ROSETTA_CUSD_CORE_RETRIES": "many"}, err: "ROSETTA_CUSD_CORE_RETRIES"},
+		{name: "invalid duration", args: []string{"--core.timeout", "0s"}, err: "--core.timeout must be positive"},
+		{name: "invalid balance", args: []string{"--core.balance", "random"}, err: "invalid --core.balance"},
+		{name: "invalid node url", args: []string{"--node.url", "localhost"}, err: "invalid --node.url"},
+		{name: "admin without token", args: []string{"--webhook.admin"}, err: "requires --webhook.admin.token"},
+		{name: "submission tracking without node", args: []string{"--submission.track"}, err: "requires --node.url"},
+		{name: "no submission confirmations", args: []string{"--submission.confirmations", "0"}, err: "--submission.confirmations must be positive"},
+		{name: "invalid initial holder", args: []string{"--cusd.initial-holders", "0x1234"}, err: "invalid initial holder"},
+		{name: "unpaired tls key", args: []string{"--tls.cert", "cert.pem"}, err: "must be given together"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+			if test.file != "" {
+				path := writeConfigFile(t, test.file)
+				if test.env["ROSETTA_CUSD_CONFIG"] == "FILE" {
+					test.env["ROSETTA_CUSD_CONFIG"] = path
+				} else {
+					args = append([]string{"--config", path}, args...)
+				}
+			}
+			setEnv(t, test.env)
+
+			cfg, _, err := loadConfig(args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.verify(t, cfg)
+		})
+	}
+}
+
+func TestCoreBaseURLs(t *testing.T) {
+	tests := []struct {
+		name     string
+		coreURL  string
+		corePort uint
+		expected []string
+		err      string
+	}{
+		{name: "port in the url", coreURL: "http://core:9000", expected: []string{"http://core:9000"}},
+		{name: "default port", coreURL: "http://core", expected: []string{"http://core:8080"}},
+		{name: "path prefix", coreURL: "https://core/rosetta/", expected: []string{"https://core:8080/rosetta"}},
+		{name: "port flag", coreURL: "http://core:9000,http://other", corePort: 7000, expected: []string{"http://core:7000", "http://other:7000"}},
+		{name: "no scheme", coreURL: "core:9000", err: "invalid --core.url"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &config{coreURL: test.coreURL, corePort: test.corePort}
+			urls, err := cfg.coreBaseURLs()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(urls, test.expected) {
+				t.Errorf("urls %v, expected %v", urls, test.expected)
+			}
+		})
+	}
+}
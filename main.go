@@ -18,9 +18,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"strings"
 
+	"github.com/celo-org/celo-blockchain/common"
 	"github.com/celo-org/rosetta-cusd/services"
 
 	"github.com/coinbase/rosetta-sdk-go/asserter"
@@ -31,55 +33,236 @@ import (
 )
 
 func main() {
-	rosettaCoreURL := flag.String("core.url", "http://localhost", "Listening URL for core Rosetta RPC server")
-	rosettaCorePort := flag.Uint("core.port", 8080, "Listening port for core Rosetta RPC server")
-	rosettaCusdAddr := flag.String("cusd.addr", "", "Listening address for cUSD http server")
-	rosettaCusdPort := flag.Uint("cusd.port", 8081, "Listening port for cUSD http server")
-	flag.Parse()
+	cfg, fs, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.printConfig {
+		if err := printConfig(os.Stdout, fs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	listenAddress := func(addr string, port uint) string {
-		return fmt.Sprintf("%s:%d", addr, port)
+	logger := services.RootLogger()
+	level, err := services.ParseLogLevel(cfg.logLevel)
+	if err != nil {
+		logger.Fatal("invalid --log.level", "error", err)
+	}
+	if err := services.SetupLogging(os.Stderr, level, cfg.logFormat); err != nil {
+		logger.Fatal("invalid --log.format", "error", err)
 	}
 
+	exporter, err := services.NewSpanExporter(cfg.traceExporter, cfg.traceEndpoint, os.Stdout)
+	if err != nil {
+		logger.Fatal("invalid --trace.exporter", "error", err)
+	}
+	if exporter != nil {
+		services.StartTracing(context.Background(), exporter)
+	}
+
+	services.InflationCacheSize = cfg.inflationCacheSize
+
+	coreURLs, err := cfg.coreBaseURLs()
+	if err != nil {
+		logger.Fatal("invalid core rosetta URL", "error", err)
+	}
+	transport, err := cfg.coreTransport()
+	if err != nil {
+		logger.Fatal("invalid core rosetta TLS settings", "error", err)
+	}
+	pool, err := services.NewCorePool(coreURLs, transport, cfg.coreBalance, cfg.coreMaxBlockLag, cfg.upstreamPolicy())
+	if err != nil {
+		logger.Fatal("invalid core rosetta backends", "error", err)
+	}
+	go pool.Start(context.Background(), cfg.coreHealthEvery)
+	// Requests are routed to one of the backends, and retried, by the pool
 	clientCfg := client.NewConfiguration(
-		listenAddress(*rosettaCoreURL, *rosettaCorePort),
+		services.CorePoolURL,
 		fetcher.DefaultUserAgent,
+		// Timeouts apply to each attempt, in the pool
 		&http.Client{
-			Timeout: fetcher.DefaultHTTPTimeout,
+			Transport: services.NewTracingTransport(services.NewMetricsTransport(pool)),
 		},
 	)
 	client := client.NewAPIClient(clientCfg)
 
-	// Make sure network options match underlying core service options
-	resp, _, err := client.NetworkAPI.NetworkList(context.Background(), &types.MetadataRequest{})
-	if err != nil {
-		log.Printf("Could not get NetworkList\n")
-		log.Fatal(err)
+	var node *services.NodeClient
+	if cfg.nodeURL != "" {
+		node, err = services.NewNodeClient(cfg.nodeURL, &http.Client{
+			Timeout:   cfg.coreTimeout,
+			Transport: services.NewTracingTransport(nil),
+		})
+		if err != nil {
+			logger.Fatal("invalid --node.url", "error", err)
+		}
 	}
 
+	// Core rosetta may not be up yet: serve a not-ready gate until it is discovered,
+	// then set up every service for the networks it serves
+	monitor := services.NewCoreMonitor(client)
+	health := services.NewHealthService(client, monitor, pool, cfg.maxSyncLag)
+	gate := services.NewCoreGate(monitor, health)
+	monitor.OnDiscovered(func(networks []*types.NetworkIdentifier) {
+		router, stableToken := setupRouter(client, node, networks, cfg)
+		health.SetStableToken(stableToken)
+		gate.SetHandler(router)
+	})
+	go monitor.Start(context.Background())
+
+	// Metrics are served regardless of core rosetta availability
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", services.MetricsHandler())
+	mux.Handle("/", services.TracingMiddleware(services.LoggingMiddleware(services.MetricsMiddleware(services.CoreAffinityMiddleware(gate)))))
+
+	address := cfg.listenAddress()
+	logger.Info("listening", "address", address, "core_urls", strings.Join(coreURLs, ","), "tls", cfg.tlsCert != "")
+	if cfg.tlsCert != "" {
+		err = http.ListenAndServeTLS(address, cfg.tlsCert, cfg.tlsKey, mux)
+	} else {
+		err = http.ListenAndServe(address, mux)
+	}
+	logger.Fatal("server stopped", "error", err)
+}
+
+// Creates the Rosetta router and starts any background services for the
+// networks served by core rosetta. Invalid configuration is fatal.
+func setupRouter(
+	client *client.APIClient,
+	node *services.NodeClient,
+	networks []*types.NetworkIdentifier,
+	cfg *config,
+) (http.Handler, *services.StableToken) {
+	// Make sure network options match underlying core service options
 	asserter, err := asserter.NewServer(
 		services.AllOperationTypes,
 		true,
-		resp.NetworkIdentifiers,
-		nil,
+		networks,
+		services.AllCallMethods,
 	)
+	logger := services.RootLogger()
 	if err != nil {
-		log.Printf("Could not initialize asserter\n")
-		log.Fatal(err)
+		logger.Fatal("could not initialize asserter", "error", err)
 	}
 
-	stableToken, err := services.NewStableToken(resp.NetworkIdentifiers[0].Network)
+	var tokenAddress *common.Address
+	if cfg.tokenAddress != "" {
+		address := common.HexToAddress(cfg.tokenAddress)
+		tokenAddress = &address
+	}
+	var activationIndex *int64
+	if cfg.tokenActivationIndex >= 0 {
+		activationIndex = &cfg.tokenActivationIndex
+	}
+	stableToken, err := services.NewStableTokenWithOverrides(networks[0].Network, tokenAddress, activationIndex)
 	if err != nil {
-		log.Printf("Could not initialize StableToken\n")
-		log.Fatal(err)
+		logger.Fatal("could not initialize StableToken", "network", networks[0].Network, "error", err)
+	}
+	// Addresses were validated with the rest of the configuration
+	for _, holder := range cfg.initialHolderAddresses() {
+		stableToken.InitialHolders = append(stableToken.InitialHolders, common.HexToAddress(holder))
+	}
+	if cfg.exchangeAddress != "" {
+		stableToken.ExchangeAddress = common.HexToAddress(cfg.exchangeAddress)
+	}
+	if cfg.reserveAddress != "" {
+		stableToken.ReserveAddress = common.HexToAddress(cfg.reserveAddress)
+	}
+	if cfg.goldTokenAddress != "" {
+		stableToken.GoldTokenAddress = common.HexToAddress(cfg.goldTokenAddress)
+	}
+
+	// Block watchers are shared between consumers with the same confirmation depth
+	network := networks[0]
+	watchers := make(map[int64]*services.BlockWatcher)
+	watcherAt := func(confirmations int64) *services.BlockWatcher {
+		if watcher, ok := watchers[confirmations]; ok {
+			return watcher
+		}
+		watcher := services.NewBlockWatcher(
+			client,
+			services.NewBlockAPIService(client, node, stableToken),
+			network,
+			confirmations,
+		)
+		watchers[confirmations] = watcher
+		return watcher
+	}
+
+	var extraRouters []server.Router
+	if cfg.webhookConfig != "" || cfg.webhookAdmin {
+		webhookService := services.NewWebhookService(network, cfg.webhookSecret)
+		if cfg.webhookConfig != "" {
+			if err := webhookService.LoadConfig(cfg.webhookConfig); err != nil {
+				logger.Fatal("could not load webhook config", "path", cfg.webhookConfig, "error", err)
+			}
+		}
+		if cfg.webhookAdmin {
+			extraRouters = append(extraRouters, services.NewWebhookAPIController(webhookService, cfg.webhookAdminToken))
+		}
+		if cfg.webhookCursor == "" {
+			watcherAt(cfg.webhookConfirmations).Subscribe(webhookService.HandleBlock)
+			webhookService.Start(context.Background())
+		} else {
+			cursor, err := webhookService.SetCursorFile(cfg.webhookCursor)
+			if err != nil {
+				logger.Fatal("could not read webhook cursor", "path", cfg.webhookCursor, "error", err)
+			}
+			// Backfilled blocks are only for webhooks, so they get their own watcher
+			watcher := services.NewBlockWatcher(
+				client,
+				services.NewBlockAPIService(client, node, stableToken),
+				network,
+				cfg.webhookConfirmations,
+			)
+			if cursor != nil {
+				watcher.ResumeAfter(cursor)
+			}
+			watcher.Subscribe(webhookService.HandleBlock)
+			webhookService.Start(context.Background())
+			go watcher.Start(context.Background())
+		}
+	}
+	if cfg.streamEnabled {
+		streamService := services.NewStreamService()
+		extraRouters = append(extraRouters, streamService)
+		watcherAt(0).Subscribe(streamService.HandleBlock)
+	}
+	if cfg.verifySupply {
+		blockService := services.NewBlockAPIService(client, node, stableToken)
+		supplyService := services.NewSupplyService(client, blockService, stableToken)
+		watcherAt(0).Subscribe(supplyService.HandleBlock(network))
+	}
+	for _, watcher := range watchers {
+		go watcher.Start(context.Background())
+	}
+
+	var nonces *services.NonceManager
+	if cfg.nonceManager {
+		nonces = services.NewNonceManager(cfg.nonceTTL)
+	}
+	var submissions *services.SubmissionTracker
+	if cfg.trackSubmissions {
+		submissions = services.NewSubmissionTracker(
+			client,
+			node,
+			services.NewBlockAPIService(client, node, stableToken),
+			cfg.submissionInterval,
+			cfg.submissionRetention,
+			cfg.submissionConfirms,
+		)
+		extraRouters = append(extraRouters, services.NewSubmissionAPIController(submissions, asserter))
+		go submissions.Start(context.Background())
 	}
 
-	router, err := services.CreateRouter(client, asserter, stableToken)
+	router, err := services.CreateRouter(client, node, asserter, stableToken, nonces, submissions, extraRouters...)
 	if err != nil {
-		log.Printf("Could not initialize Router\n")
-		log.Fatal(err)
+		logger.Fatal("could not initialize router", "error", err)
 	}
-	loggedRouter := server.LoggerMiddleware(router)
-	log.Printf("Listening on port %d\n", *rosettaCusdPort)
-	log.Fatal(http.ListenAndServe(listenAddress(*rosettaCusdAddr, *rosettaCusdPort), loggedRouter))
+	return router, stableToken
 }
@@ -18,21 +18,26 @@ import (
 	"context"
 	"math/big"
 
-	"github.com/celo-org/rosetta/airgap"
 	"github.com/celo-org/rosetta/service/rpc"
 	"github.com/coinbase/rosetta-sdk-go/client"
 	"github.com/coinbase/rosetta-sdk-go/types"
 )
 
 type AccountAPIService struct {
-	client *client.APIClient
+	client       *client.APIClient
+	blockService *BlockAPIService
+	stableToken  *StableToken
 }
 
 func NewAccountAPIService(
 	client *client.APIClient,
+	blockService *BlockAPIService,
+	stableToken *StableToken,
 ) *AccountAPIService {
 	return &AccountAPIService{
-		client: client,
+		client:       client,
+		blockService: blockService,
+		stableToken:  stableToken,
 	}
 }
 
@@ -41,59 +46,60 @@ func (s *AccountAPIService) AccountBalance(
 	ctx context.Context,
 	request *types.AccountBalanceRequest,
 ) (*types.AccountBalanceResponse, *types.Error) {
-	// Prepare request for core rosetta /call endpoint
-	balanceOfMethod, err := airgap.MethodFromString("StableToken.balanceOf")
-	if err != nil {
-		return nil, ErrInternal
-	}
-	rawParams := &airgap.CallParams{
-		TxArgs: airgap.TxArgs{
-			Method: balanceOfMethod,
-			Args:   []interface{}{request.AccountIdentifier.Address},
-		},
-	}
+	ctx, span := startSpan(ctx, "AccountAPIService.AccountBalance")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "network", networkName(request.NetworkIdentifier), "account", request.AccountIdentifier.Address)
+
 	// Set blockNumber param if applicable; if this is nil, defaults to tip.
+	var blockNumber *big.Int
 	if request.BlockIdentifier != nil {
 		if request.BlockIdentifier.Index != nil {
-			blockNumber := new(big.Int).SetInt64(*request.BlockIdentifier.Index)
-			rawParams.BlockNumber = blockNumber
+			// Prior to threshold, StableToken contract not registered on chain and balanceOf cannot be called
+			if !s.stableToken.DeployedAt(*request.BlockIdentifier.Index) {
+				return nil, ErrStableTokenNotDeployed
+			}
+			blockNumber = new(big.Int).SetInt64(*request.BlockIdentifier.Index)
 		} else {
-			logError("Block number is required when passing in a block identifier.")
+			loggerFrom(ctx).Info("block number is required when passing in a block identifier")
 			return nil, ErrValidation
 		}
 	}
 
-	paramsMap, err := airgap.MarshallToMap(rawParams)
-	if err != nil {
-		return nil, ErrValidation
-	}
-	callReq := &types.CallRequest{
-		NetworkIdentifier: request.NetworkIdentifier,
-		Method:            "celo_call",
-		Parameters:        paramsMap,
-	}
-	resp, _, err := s.client.CallAPI.Call(ctx, callReq)
-	if err != nil {
-		return nil, ErrCeloClient
-	}
-
-	var result rpc.CallResult
-	err = airgap.UnmarshallFromMap(resp.Result, &result)
-	if err != nil {
-		return nil, ErrValidation
+	balance, blockIdentifier, clientErr := callStableTokenUint(
+		ctx,
+		s.client,
+		request.NetworkIdentifier,
+		"balanceOf",
+		[]interface{}{request.AccountIdentifier.Address},
+		blockNumber,
+	)
+	if clientErr != nil {
+		return nil, clientErr
 	}
 	// Sanity check
 	if request.BlockIdentifier != nil {
-		if request.BlockIdentifier.Hash != nil && *request.BlockIdentifier.Hash != result.BlockIdentifier.Hash {
-			logError("Mismatch between requested and returned block hash.")
+		if request.BlockIdentifier.Hash != nil && *request.BlockIdentifier.Hash != blockIdentifier.Hash {
+			loggerFrom(ctx).Error(
+				"mismatch between requested and returned block hash",
+				"block_hash", *request.BlockIdentifier.Hash,
+				"returned_block_hash", blockIdentifier.Hash,
+			)
 			return nil, ErrInternal
 		}
 	}
 
+	// Only credited at activation, with the supply no initial holder accounts for
+	if isGenesisSupplyAccount(request.AccountIdentifier, s.stableToken) {
+		balance, clientErr = s.blockService.genesisSupply(ctx, request.NetworkIdentifier)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+	}
+
 	return &types.AccountBalanceResponse{
-		BlockIdentifier: result.BlockIdentifier,
+		BlockIdentifier: blockIdentifier,
 		Balances: []*types.Amount{
-			rpc.NewAmount(new(big.Int).SetBytes(result.Raw), CeloDollar),
+			rpc.NewAmount(balance, CeloDollar),
 		},
 	}, nil
 }
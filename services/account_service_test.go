@@ -0,0 +1,146 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// A core rosetta server answering each request with the result of handle
+// for its path and body. A *types.Error is answered with status 500.
+func newTestCore(t *testing.T, handle func(path string, body []byte) interface{}) *client.APIClient {
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		resp := handle(r.URL.Path, body)
+		w.Header().Set("Content-Type", "application/json")
+		if _, ok := resp.(*types.Error); ok {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(core.Close)
+	return client.NewAPIClient(client.NewConfiguration(core.URL, "test", core.Client()))
+}
+
+// The response of core rosetta to a celo_call returning value at block.
+func testCallResponse(t *testing.T, value int64, block *types.BlockIdentifier) *types.CallResponse {
+	result, err := airgap.MarshallToMap(&rpc.CallResult{
+		Raw:             big.NewInt(value).Bytes(),
+		BlockIdentifier: block,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.CallResponse{Result: result}
+}
+
+func TestAccountBalance(t *testing.T) {
+	stableToken := &StableToken{BlockThreshold: 100, Address: common.HexToAddress("0x7e")}
+	holder := &types.AccountIdentifier{Address: "0x000000000000000000000000000000000000dEaD"}
+	block := &types.BlockIdentifier{Index: 100, Hash: "0x64"}
+	index := func(i int64) *int64 { return &i }
+	hash := func(h string) *string { return &h }
+
+	tests := []struct {
+		name    string
+		account *types.AccountIdentifier
+		block   *types.PartialBlockIdentifier
+		// Whether the balance is read from core
+		called  bool
+		balance string
+		err     *types.Error
+	}{
+		{name: "tip", called: true, balance: "42"},
+		{name: "activation block", block: &types.PartialBlockIdentifier{Index: index(100)}, called: true, balance: "42"},
+		{name: "before activation", block: &types.PartialBlockIdentifier{Index: index(99)}, err: ErrStableTokenNotDeployed},
+		{name: "genesis", block: &types.PartialBlockIdentifier{Index: index(0)}, err: ErrStableTokenNotDeployed},
+		{name: "hash without index", block: &types.PartialBlockIdentifier{Hash: hash("0x64")}, err: ErrValidation},
+		{
+			name:   "other hash",
+			block:  &types.PartialBlockIdentifier{Index: index(100), Hash: hash("0x65")},
+			called: true,
+			err:    ErrInternal,
+		},
+		{
+			// No holder is known, so the whole supply is credited to it
+			name:    "genesis supply",
+			account: genesisSupplyAccount(stableToken),
+			block:   &types.PartialBlockIdentifier{Index: index(100)},
+			called:  true,
+			balance: "42",
+		},
+		{
+			name:    "genesis supply before activation",
+			account: genesisSupplyAccount(stableToken),
+			block:   &types.PartialBlockIdentifier{Index: index(99)},
+			err:     ErrStableTokenNotDeployed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			coreClient := newTestCore(t, func(path string, body []byte) interface{} {
+				if path != "/call" {
+					t.Errorf("unexpected core request %s", path)
+				}
+				called = true
+				return testCallResponse(t, 42, block)
+			})
+			s := NewAccountAPIService(coreClient, NewBlockAPIService(coreClient, nil, stableToken), stableToken)
+			account := tt.account
+			if account == nil {
+				account = holder
+			}
+			resp, clientErr := s.AccountBalance(context.Background(), &types.AccountBalanceRequest{
+				NetworkIdentifier: &types.NetworkIdentifier{Blockchain: "celo", Network: "test"},
+				AccountIdentifier: account,
+				BlockIdentifier:   tt.block,
+			})
+			if called != tt.called {
+				t.Errorf("core called: %v, expected %v", called, tt.called)
+			}
+			if tt.err != nil {
+				if clientErr == nil || clientErr.Code != tt.err.Code {
+					t.Fatalf("error %v, expected %s", clientErr, tt.err.Message)
+				}
+				return
+			}
+			if clientErr != nil {
+				t.Fatal(clientErr.Message)
+			}
+			if len(resp.Balances) != 1 || resp.Balances[0].Value != tt.balance || resp.Balances[0].Currency.Symbol != CeloDollar.Symbol {
+				t.Errorf("balances %s, expected %s cUSD", types.PrintStruct(resp.Balances), tt.balance)
+			}
+			if resp.BlockIdentifier.Index != block.Index {
+				t.Errorf("block %d, expected %d", resp.BlockIdentifier.Index, block.Index)
+			}
+		})
+	}
+}
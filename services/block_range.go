@@ -0,0 +1,206 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/coinbase/rosetta-sdk-go/asserter"
+	"github.com/coinbase/rosetta-sdk-go/server"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Largest number of blocks served by a single /blocks/range request
+	MaxBlockRange = 1000
+	// Concurrent block header requests to core rosetta per /blocks/range request
+	blockRangeConcurrency = 16
+)
+
+// Request for the blocks in [StartIndex, EndIndex], both inclusive.
+type BlockRangeRequest struct {
+	NetworkIdentifier *types.NetworkIdentifier `json:"network_identifier"`
+	StartIndex        int64                    `json:"start_index"`
+	EndIndex          int64                    `json:"end_index"`
+}
+
+type BlockRangeResponse struct {
+	Blocks []*types.Block `json:"blocks"`
+}
+
+// Returns the same blocks as successive calls to Block, but fetches the cUSD
+// logs for the whole range at once: with a single eth_getLogs when the node is
+// configured, otherwise with a celo_getLogs per event.
+func (s *BlockAPIService) BlockRange(
+	ctx context.Context,
+	request *BlockRangeRequest,
+) (*BlockRangeResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "BlockAPIService.BlockRange")
+	defer span.Finish()
+	ctx = withLogFields(
+		ctx,
+		"network", networkName(request.NetworkIdentifier),
+		"start_index", request.StartIndex,
+		"end_index", request.EndIndex,
+	)
+
+	if request.NetworkIdentifier == nil ||
+		request.StartIndex < 0 ||
+		request.EndIndex < request.StartIndex ||
+		request.EndIndex-request.StartIndex >= MaxBlockRange {
+		loggerFrom(ctx).Info("invalid block range", "max_blocks", MaxBlockRange)
+		return nil, ErrValidation
+	}
+
+	// Prior to threshold, StableToken contract not registered on chain and cannot be accessed via /call
+	logsByBlock := make(map[int64][]gethTypes.Log)
+	inflationLogsByBlock := make(map[int64][]gethTypes.Log)
+	if s.stableToken.DeployedAt(request.EndIndex) {
+		fromBlock := request.StartIndex
+		if !s.stableToken.DeployedAt(fromBlock) {
+			fromBlock = s.stableToken.BlockThreshold
+		}
+		logs, inflationLogs, clientErr := s.stableTokenRangeLogs(ctx, fromBlock, request.EndIndex, request.NetworkIdentifier)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		for _, transferLog := range logs {
+			index := int64(transferLog.BlockNumber)
+			logsByBlock[index] = append(logsByBlock[index], transferLog)
+		}
+		for _, inflationLog := range inflationLogs {
+			index := int64(inflationLog.BlockNumber)
+			inflationLogsByBlock[index] = append(inflationLogsByBlock[index], inflationLog)
+		}
+	}
+
+	blocks := make([]*types.Block, request.EndIndex-request.StartIndex+1)
+	// Cancelled on the first error, so that no more blocks are fetched
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr *types.Error
+	fail := func(clientErr *types.Error) {
+		errOnce.Do(func() {
+			firstErr = clientErr
+			cancel()
+		})
+	}
+	sem := make(chan struct{}, blockRangeConcurrency)
+	for i := range blocks {
+		index := request.StartIndex + int64(i)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			// A block failed, or the request was cancelled
+			break
+		}
+		wg.Add(1)
+		go func(i int, index int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			blockResp, clientErr, err := s.client.BlockAPI.Block(ctx, &types.BlockRequest{
+				NetworkIdentifier: request.NetworkIdentifier,
+				BlockIdentifier:   &types.PartialBlockIdentifier{Index: &index},
+			})
+			if err != nil {
+				fail(upstreamError(ctx, "/block", clientErr, err))
+				return
+			}
+			block := blockResp.Block
+			if !s.stableToken.DeployedAt(index) {
+				markPreActivation(block)
+			} else {
+				// The caller retries the range if the chain changed since the logs were read
+				tokenLogs := make([]gethTypes.Log, 0, len(logsByBlock[index])+len(inflationLogsByBlock[index]))
+				tokenLogs = append(append(tokenLogs, logsByBlock[index]...), inflationLogsByBlock[index]...)
+				clientErr = checkLogsBlock(ctx, block.BlockIdentifier, tokenLogs)
+				if clientErr == nil {
+					clientErr = s.checkMissingLogs(ctx, block.BlockIdentifier, tokenLogs)
+				}
+				if clientErr != nil {
+					fail(clientErr)
+					return
+				}
+				clientErr = s.populateBlock(ctx, request.NetworkIdentifier, block, logsByBlock[index], inflationLogsByBlock[index])
+				if clientErr != nil {
+					fail(clientErr)
+					return
+				}
+			}
+			blocks[i] = block
+		}(i, index)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		// The request was cancelled before any block failed
+		return nil, upstreamError(ctx, "/block", nil, err)
+	}
+
+	return &BlockRangeResponse{Blocks: blocks}, nil
+}
+
+// Serves the non-standard /blocks/range endpoint for backfills.
+// Implements the server.Router interface.
+type BlockRangeAPIController struct {
+	service  *BlockAPIService
+	asserter *asserter.Asserter
+}
+
+func NewBlockRangeAPIController(service *BlockAPIService, asserter *asserter.Asserter) *BlockRangeAPIController {
+	return &BlockRangeAPIController{
+		service:  service,
+		asserter: asserter,
+	}
+}
+
+func (c *BlockRangeAPIController) Routes() server.Routes {
+	return server.Routes{
+		{
+			Name:        "BlockRange",
+			Method:      http.MethodPost,
+			Pattern:     "/blocks/range",
+			HandlerFunc: c.BlockRange,
+		},
+	}
+}
+
+// endpoint: /blocks/range
+func (c *BlockRangeAPIController) BlockRange(w http.ResponseWriter, r *http.Request) {
+	var request BlockRangeRequest
+	if err := decodeJSONRequest(r, &request); err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+	if err := c.asserter.ValidSupportedNetwork(request.NetworkIdentifier); err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+	resp, clientErr := c.service.BlockRange(r.Context(), &request)
+	if clientErr != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, clientErr, nil)
+		return
+	}
+	encodeJSONResponse(w, http.StatusOK, resp)
+}
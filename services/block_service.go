@@ -17,6 +17,9 @@ package services
 import (
 	"context"
 	"math/big"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/celo-org/rosetta/airgap"
 	"github.com/celo-org/rosetta/service/rpc"
@@ -24,26 +27,45 @@ import (
 	"github.com/coinbase/rosetta-sdk-go/types"
 	"github.com/celo-org/celo-blockchain/common"
 	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/celo-org/celo-blockchain/crypto"
 )
 
+// Attempts at reading a block and its logs from the same chain view
+const blockReadAttempts = 3
+
+// Topic of the StableToken Transfer logs
+var transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
 // Implements the server.BlockAPIServicer interface.
 type BlockAPIService struct {
 	client      *client.APIClient
+	node        *NodeClient
 	stableToken *StableToken
+	inflation   *InflationTracker
+
+	genesisMu sync.Mutex
+	// Balance of the genesis supply sub-account, once read
+	genesisBalance *big.Int
 }
 
+// node may be nil, in which case transactions carry no metadata.
 func NewBlockAPIService(
 	client *client.APIClient,
+	node *NodeClient,
 	stableToken *StableToken,
 ) *BlockAPIService {
-	return &BlockAPIService{
+	s := &BlockAPIService{
 		client:      client,
+		node:        node,
 		stableToken: stableToken,
 	}
+	s.inflation = NewInflationTracker(client, stableToken, s.transferLogs)
+	return s
 }
 
 // Extract operations from transferLog
 // and update opIndex, operations, prevRelatedOps in place accordingly.
+// Operations carry the index of their log in the block as NetworkIndex.
 func opsFromLog(
 	transferLog gethTypes.Log,
 	opIndex *int64,
@@ -81,8 +103,10 @@ func opsFromLog(
 		opType = OpTransfer
 		inGroup = true
 	}
+	logIndex := int64(transferLog.Index)
 	processOp := func(address common.Address, opValue *big.Int, inGroup bool) {
 		op := newAtomicOp(address, *opIndex, opValue, &status, opType, *relatedOps)
+		op.OperationIdentifier.NetworkIndex = &logIndex
 		*operations = append(*operations, op)
 		*opIndex++
 		// Do not include standalone ops in a related group
@@ -101,19 +125,21 @@ func opsFromLog(
 	return
 }
 
-func callParamsFromBlock(
-	block *big.Int,
+func callParamsFromBlockRange(
+	event string,
+	fromBlock *big.Int,
+	toBlock *big.Int,
 	networkId *types.NetworkIdentifier,
 ) (*types.CallRequest, error) {
 	// Prepare filter query for core rosetta /call endpoint
-	transferEvent, err := airgap.EventFromString("StableToken.Transfer")
+	celoEvent, err := airgap.EventFromString(event)
 	if err != nil {
 		return nil, err
 	}
 	rawParams := &airgap.FilterQueryParams{
-		Event:     transferEvent,
-		FromBlock: block,
-		ToBlock:   block,
+		Event:     celoEvent,
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
 	}
 	paramsMap, err := airgap.MarshallToMap(rawParams)
 	if err != nil {
@@ -126,78 +152,403 @@ func callParamsFromBlock(
 	}, nil
 }
 
-// endpoint: /block
-func (s *BlockAPIService) Block(
+// Fetch the StableToken transfer logs emitted in blocks [fromBlock, toBlock],
+// from the node when it is configured.
+func (s *BlockAPIService) transferLogs(
 	ctx context.Context,
-	request *types.BlockRequest,
-) (*types.BlockResponse, *types.Error) {
+	fromBlock int64,
+	toBlock int64,
+	networkId *types.NetworkIdentifier,
+) ([]gethTypes.Log, *types.Error) {
+	if s.node != nil {
+		logs, err := s.node.rangeLogs(ctx, fromBlock, toBlock, s.stableToken.Address, []common.Hash{transferTopic})
+		if err != nil {
+			return nil, nodeError(ctx, "eth_getLogs", err)
+		}
+		return logs, nil
+	}
+	return s.eventLogs(ctx, "StableToken.Transfer", fromBlock, toBlock, networkId)
+}
 
-	blockResp, clientErr, _ := s.client.BlockAPI.Block(ctx, request)
-	if clientErr != nil {
-		return nil, clientErr
+// Fetch the StableToken logs changing the inflation parameters emitted in
+// blocks [fromBlock, toBlock]
+func (s *BlockAPIService) inflationLogs(
+	ctx context.Context,
+	fromBlock int64,
+	toBlock int64,
+	networkId *types.NetworkIdentifier,
+) ([]gethTypes.Log, *types.Error) {
+	var logs []gethTypes.Log
+	for _, event := range inflationEvents {
+		eventLogs, clientErr := s.eventLogs(ctx, "StableToken."+event, fromBlock, toBlock, networkId)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		logs = append(logs, eventLogs...)
 	}
+	return logs, nil
+}
 
-	// Prior to threshold, StableToken contract not registered on chain and cannot be accessed via /call
-	if blockResp.Block.BlockIdentifier.Index < s.stableToken.BlockThreshold {
-		// TODO think about other_transactions
-		blockResp.Block.Transactions = nil
-		return blockResp, nil
+// First topics of the StableToken logs a block is built from: Transfer and
+// the inflation events.
+func stableTokenTopics() []common.Hash {
+	topics := []common.Hash{transferTopic}
+	for _, event := range inflationEvents {
+		topics = append(topics, inflationEventTopic(event))
+	}
+	return topics
+}
+
+// Splits StableToken logs into Transfer logs and inflation event logs.
+func splitStableTokenLogs(logs []gethTypes.Log) ([]gethTypes.Log, []gethTypes.Log) {
+	var transfers, inflation []gethTypes.Log
+	for _, tokenLog := range logs {
+		if len(tokenLog.Topics) > 0 && tokenLog.Topics[0] == transferTopic {
+			transfers = append(transfers, tokenLog)
+		} else {
+			inflation = append(inflation, tokenLog)
+		}
 	}
+	return transfers, inflation
+}
 
-	// Get the filtered logs for transfer events in the requested block
-	callReq, err := callParamsFromBlock(
-		new(big.Int).SetInt64(blockResp.Block.BlockIdentifier.Index),
-		request.NetworkIdentifier,
+// Fetch the Transfer and inflation logs of a block. With the node, they are
+// read with a single eth_getLogs by block hash, which only returns logs of
+// that very block, and all of them. Otherwise, core rosetta is asked for the
+// logs of each event by block number.
+func (s *BlockAPIService) stableTokenLogs(
+	ctx context.Context,
+	block *types.BlockIdentifier,
+	networkId *types.NetworkIdentifier,
+) ([]gethTypes.Log, []gethTypes.Log, *types.Error) {
+	if s.node == nil {
+		return s.stableTokenRangeLogs(ctx, block.Index, block.Index, networkId)
+	}
+	logs, err := s.node.blockLogs(ctx, common.HexToHash(block.Hash), s.stableToken.Address, stableTokenTopics())
+	if err != nil {
+		return nil, nil, nodeError(ctx, "eth_getLogs", err)
+	}
+	transfers, inflation := splitStableTokenLogs(logs)
+	return transfers, inflation, nil
+}
+
+// Fetch the Transfer and inflation logs emitted in blocks [fromBlock, toBlock],
+// with a single eth_getLogs when the node is configured.
+func (s *BlockAPIService) stableTokenRangeLogs(
+	ctx context.Context,
+	fromBlock int64,
+	toBlock int64,
+	networkId *types.NetworkIdentifier,
+) ([]gethTypes.Log, []gethTypes.Log, *types.Error) {
+	if s.node != nil {
+		logs, err := s.node.rangeLogs(ctx, fromBlock, toBlock, s.stableToken.Address, stableTokenTopics())
+		if err != nil {
+			return nil, nil, nodeError(ctx, "eth_getLogs", err)
+		}
+		transfers, inflation := splitStableTokenLogs(logs)
+		return transfers, inflation, nil
+	}
+	transfers, clientErr := s.transferLogs(ctx, fromBlock, toBlock, networkId)
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	inflation, clientErr := s.inflationLogs(ctx, fromBlock, toBlock, networkId)
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	return transfers, inflation, nil
+}
+
+// Fetch the logs of event, given as "<contract>.<event>", emitted in
+// blocks [fromBlock, toBlock]
+func (s *BlockAPIService) eventLogs(
+	ctx context.Context,
+	event string,
+	fromBlock int64,
+	toBlock int64,
+	networkId *types.NetworkIdentifier,
+) ([]gethTypes.Log, *types.Error) {
+	callReq, err := callParamsFromBlockRange(
+		event,
+		new(big.Int).SetInt64(fromBlock),
+		new(big.Int).SetInt64(toBlock),
+		networkId,
 	)
 	if err != nil {
+		loggerFrom(ctx).Error("could not build celo_getLogs request", "error", err)
 		return nil, ErrValidation
 	}
-	resp, _, err := s.client.CallAPI.Call(ctx, callReq)
+	resp, clientErr, err := s.client.CallAPI.Call(ctx, callReq)
 	if err != nil {
-		return nil, ErrCeloClient
+		loggerFrom(ctx).Debug("celo_getLogs failed", "event", event, "from_block", fromBlock, "to_block", toBlock)
+		return nil, upstreamError(ctx, "/call:celo_getLogs", clientErr, err)
 	}
 	var result rpc.CallLogsResult
 	err = airgap.UnmarshallFromMap(resp.Result, &result)
 	if err != nil {
+		loggerFrom(ctx).Error("could not parse celo_getLogs result", "error", err)
 		return nil, ErrValidation
 	}
+	return result.Logs, nil
+}
 
-	transactions := []*types.Transaction{}
-	var opIndex *int64 = new(int64)
-	var currTxHash common.Hash
-	var operations *[]*types.Operation
-	var relatedOps *[]*types.OperationIdentifier
-
-	for i, transferLog := range result.Logs {
-		if transferLog.TxHash != currTxHash {
-			// Append fully parsed currTxHash + operations to list of transactions
-			if i != 0 {
-				transaction := &types.Transaction{
-					TransactionIdentifier: &types.TransactionIdentifier{Hash: currTxHash.String()},
-					Operations:            *operations,
-				}
-				transactions = append(transactions, transaction)
+// Logs are fetched by block number, separately from the block: a reorg in
+// between, or backends on different forks, would attach the logs of another
+// block with the same number. Returns ErrBlockChanged if any log is not from
+// the given block.
+func checkLogsBlock(ctx context.Context, block *types.BlockIdentifier, logs []gethTypes.Log) *types.Error {
+	for _, transferLog := range logs {
+		if strings.EqualFold(transferLog.BlockHash.Hex(), block.Hash) {
+			continue
+		}
+		blockMismatches.inc()
+		loggerFrom(ctx).Warn(
+			"transfer log is not from the block read",
+			"block_index", block.Index,
+			"block_hash", block.Hash,
+			"log_block_hash", transferLog.BlockHash.Hex(),
+			"tx_hash", transferLog.TxHash.Hex(),
+		)
+		changed := *ErrBlockChanged
+		changed.Details = map[string]interface{}{
+			"block_index":    block.Index,
+			"block_hash":     block.Hash,
+			"log_block_hash": transferLog.BlockHash.Hex(),
+		}
+		return &changed
+	}
+	return nil
+}
+
+// An empty log set passes checkLogsBlock, yet a backend lagging behind or on
+// another fork may have returned no logs at all for the block. When the node
+// is configured and no log was returned, the StableToken events are looked up
+// in the logsBloom of the block, and those the bloom reports are confirmed
+// with the logs of the block read from the node by hash, the bloom having
+// false positives. Returns ErrBlockChanged if the node knows logs that are
+// missing, or does not know the block.
+//
+// Logs of the block, once checked by checkLogsBlock, show that the backend
+// has indexed it. Most blocks have no inflation logs, so the bloom is not
+// read for the events without any.
+func (s *BlockAPIService) checkMissingLogs(ctx context.Context, block *types.BlockIdentifier, logs []gethTypes.Log) *types.Error {
+	if s.node == nil || len(logs) > 0 {
+		return nil
+	}
+	missing := stableTokenTopics()
+
+	hash := common.HexToHash(block.Hash)
+	bloom, err := s.node.logsBloom(ctx, hash)
+	if err != nil {
+		return nodeError(ctx, "eth_getBlockByHash", err)
+	}
+	changed := *ErrBlockChanged
+	changed.Details = map[string]interface{}{
+		"block_index": block.Index,
+		"block_hash":  block.Hash,
+	}
+	if bloom == nil {
+		blockMismatches.inc()
+		loggerFrom(ctx).Warn("block unknown to the node", "block_index", block.Index, "block_hash", block.Hash)
+		return &changed
+	}
+	if !gethTypes.BloomLookup(*bloom, s.stableToken.Address) {
+		return nil
+	}
+	var reported []common.Hash
+	for _, topic := range missing {
+		if gethTypes.BloomLookup(*bloom, topic) {
+			reported = append(reported, topic)
+		}
+	}
+	if len(reported) == 0 {
+		return nil
+	}
+	nodeLogs, err := s.node.blockLogs(ctx, hash, s.stableToken.Address, reported)
+	if err != nil {
+		return nodeError(ctx, "eth_getLogs", err)
+	}
+	if len(nodeLogs) == 0 {
+		return nil
+	}
+	blockMismatches.inc()
+	loggerFrom(ctx).Warn(
+		"logs missing from the block read",
+		"block_index", block.Index,
+		"block_hash", block.Hash,
+		"node_logs", len(nodeLogs),
+	)
+	changed.Details["missing_logs"] = len(nodeLogs)
+	return &changed
+}
+
+// Operations of a transaction being built from its logs
+type txOps struct {
+	hash       common.Hash
+	opIndex    int64
+	operations []*types.Operation
+	relatedOps []*types.OperationIdentifier
+}
+
+// Group the transfer logs of a single block into transactions, ordered by
+// transaction index, with operations in log index order. The result does
+// not depend on the order in which the logs are given, and the logs of a
+// transaction need not be contiguous.
+func transactionsFromLogs(logs []gethTypes.Log) []*types.Transaction {
+	sorted := make([]gethTypes.Log, len(logs))
+	copy(sorted, logs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].TxIndex != sorted[j].TxIndex {
+			return sorted[i].TxIndex < sorted[j].TxIndex
+		}
+		return sorted[i].Index < sorted[j].Index
+	})
+
+	var ordered []*txOps
+	byHash := make(map[common.Hash]*txOps)
+	for _, transferLog := range sorted {
+		tx, ok := byHash[transferLog.TxHash]
+		if !ok {
+			tx = &txOps{
+				hash:       transferLog.TxHash,
+				operations: []*types.Operation{},
+				relatedOps: []*types.OperationIdentifier{},
 			}
-			// Set currTxHash (to current hash) and initialize start of transaction
-			currTxHash = transferLog.TxHash
-			operations = &[]*types.Operation{}
-			relatedOps = &[]*types.OperationIdentifier{}
-			*opIndex = 0
+			byHash[transferLog.TxHash] = tx
+			ordered = append(ordered, tx)
 		}
 		// Update the index, operations, relatedOps in place
-		opsFromLog(transferLog, opIndex, operations, relatedOps)
+		opsFromLog(transferLog, &tx.opIndex, &tx.operations, &tx.relatedOps)
+	}
 
-		// Ensure last seen log is included in transaction list
-		if i == len(result.Logs)-1 {
-			transaction := &types.Transaction{
-				TransactionIdentifier: &types.TransactionIdentifier{Hash: currTxHash.String()},
-				Operations:            *operations,
-			}
-			transactions = append(transactions, transaction)
+	transactions := []*types.Transaction{}
+	for _, tx := range ordered {
+		transactions = append(transactions, &types.Transaction{
+			TransactionIdentifier: &types.TransactionIdentifier{Hash: tx.hash.String()},
+			Operations:            tx.operations,
+		})
+	}
+	return transactions
+}
+
+// Set the cUSD transactions of a block from its transfer logs, along with
+// any synthetic genesis or inflation adjustment transactions, the latter
+// from its inflation logs.
+func (s *BlockAPIService) populateBlock(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	block *types.Block,
+	logs []gethTypes.Log,
+	inflationLogs []gethTypes.Log,
+) *types.Error {
+	ctx, span := startSpan(ctx, "BlockAPIService.populateBlock")
+	defer span.Finish()
+	span.SetAttribute("block.index", block.BlockIdentifier.Index)
+	span.SetAttribute("block.logs", len(logs))
+	blockLogs.observe(float64(len(logs)))
+
+	var transactions []*types.Transaction
+	if block.BlockIdentifier.Index == s.stableToken.BlockThreshold {
+		var clientErr *types.Error
+		transactions, clientErr = s.activationTransactions(ctx, networkId, block.BlockIdentifier, logs)
+		if clientErr != nil {
+			return clientErr
+		}
+	} else {
+		transactions = transactionsFromLogs(logs)
+	}
+	if clientErr := s.addTransactionMetadata(ctx, block.BlockIdentifier, transactions); clientErr != nil {
+		return clientErr
+	}
+
+	adjustment, metadata, clientErr := s.inflation.Adjustments(ctx, networkId, block.BlockIdentifier, transactions, inflationLogs)
+	if clientErr != nil {
+		return clientErr
+	}
+	if adjustment != nil {
+		transactions = append(transactions, adjustment)
+	}
+	if metadata != nil {
+		if block.Metadata == nil {
+			block.Metadata = make(map[string]interface{})
 		}
+		for k, v := range metadata {
+			block.Metadata[k] = v
+		}
+	}
+	block.Transactions = transactions
+	return nil
+}
+
+// Blocks prior to StableToken activation have no cUSD transactions.
+// Flag them explicitly so that clients can tell them apart from empty blocks.
+func markPreActivation(block *types.Block) {
+	block.Transactions = []*types.Transaction{}
+	if block.Metadata == nil {
+		block.Metadata = make(map[string]interface{})
 	}
+	block.Metadata[MetadataStableTokenDeployed] = false
+}
 
-	blockResp.Block.Transactions = transactions
+// endpoint: /block
+func (s *BlockAPIService) Block(
+	ctx context.Context,
+	request *types.BlockRequest,
+) (*types.BlockResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "BlockAPIService.Block")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "network", networkName(request.NetworkIdentifier))
+
+	// Read the block, its logs and receipts again if they turn out to be from different forks
+	var blockResp *types.BlockResponse
+	var logs, inflationLogs []gethTypes.Log
+	var clientErr *types.Error
+	for attempt := 0; attempt < blockReadAttempts; attempt++ {
+		var err error
+		blockResp, clientErr, err = s.client.BlockAPI.Block(ctx, request)
+		if err != nil {
+			return nil, upstreamError(ctx, "/block", clientErr, err)
+		}
+
+		// Prior to threshold, StableToken contract not registered on chain and cannot be accessed via /call
+		if !s.stableToken.DeployedAt(blockResp.Block.BlockIdentifier.Index) {
+			markPreActivation(blockResp.Block)
+			blockResp.OtherTransactions = nil
+			return blockResp, nil
+		}
+
+		// Get the StableToken logs of the requested block
+		blockIndex := blockResp.Block.BlockIdentifier.Index
+		logs, inflationLogs, clientErr = s.stableTokenLogs(
+			withLogFields(ctx, "block_index", blockIndex),
+			blockResp.Block.BlockIdentifier,
+			request.NetworkIdentifier,
+		)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		// Logs read from the node by hash are complete and from this block,
+		// those read from core rosetta by number may be from another block
+		tokenLogs := make([]gethTypes.Log, 0, len(logs)+len(inflationLogs))
+		tokenLogs = append(append(tokenLogs, logs...), inflationLogs...)
+		clientErr = checkLogsBlock(ctx, blockResp.Block.BlockIdentifier, tokenLogs)
+		if clientErr == nil {
+			// Receipts from another chain view also fail with ErrBlockChanged
+			clientErr = s.populateBlock(
+				withLogFields(ctx, "block_index", blockIndex),
+				request.NetworkIdentifier,
+				blockResp.Block,
+				logs,
+				inflationLogs,
+			)
+		}
+		if clientErr == nil || clientErr.Code != ErrBlockChanged.Code {
+			break
+		}
+	}
+	if clientErr != nil {
+		return nil, clientErr
+	}
 	blockResp.OtherTransactions = nil
 
 	return blockResp, nil
@@ -208,6 +559,10 @@ func (s *BlockAPIService) BlockTransaction(
 	ctx context.Context,
 	request *types.BlockTransactionRequest,
 ) (*types.BlockTransactionResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "BlockAPIService.BlockTransaction")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "tx_hash", request.TransactionIdentifier.Hash)
+
 	// TODO: optimize looping logic by filtering logs on transaction
 	blockResp, clientErr := s.Block(ctx, &types.BlockRequest{
 		NetworkIdentifier: request.NetworkIdentifier,
@@ -0,0 +1,337 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// A Celo node answering JSON-RPC calls, single or batched, with the result
+// of handle for their method and raw params.
+func newTestNode(t *testing.T, handle func(method string, params []json.RawMessage) interface{}) *NodeClient {
+	type call struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	answer := func(c call) map[string]interface{} {
+		return map[string]interface{}{"jsonrpc": "2.0", "id": c.ID, "result": handle(c.Method, c.Params)}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var raw json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		var batch []call
+		if json.Unmarshal(raw, &batch) == nil {
+			var answers []map[string]interface{}
+			for _, c := range batch {
+				answers = append(answers, answer(c))
+			}
+			json.NewEncoder(w).Encode(answers)
+			return
+		}
+		var single call
+		json.Unmarshal(raw, &single)
+		json.NewEncoder(w).Encode(answer(single))
+	}))
+	t.Cleanup(server.Close)
+	node, err := NewNodeClient(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestCheckMissingLogs(t *testing.T) {
+	token := common.HexToAddress("0x765DE816845861e75A25fCA122bb6898B8B1282a")
+	block := &types.BlockIdentifier{Index: 10, Hash: common.HexToHash("0x0a").Hex()}
+	bloomOf := func(entries ...[]byte) *gethTypes.Bloom {
+		var bloom gethTypes.Bloom
+		for _, entry := range entries {
+			bloom.Add(new(big.Int).SetBytes(entry))
+		}
+		return &bloom
+	}
+	transferLog := gethTypes.Log{
+		Address:   token,
+		Topics:    []common.Hash{transferTopic},
+		BlockHash: common.HexToHash(block.Hash),
+	}
+
+	tests := []struct {
+		name      string
+		noNode    bool
+		logs      []gethTypes.Log
+		bloom     *gethTypes.Bloom
+		nodeLogs  []gethTypes.Log
+		changed   bool
+		nodeCalls int
+	}{
+		{name: "no node", noNode: true},
+		{
+			name:  "no event in bloom",
+			bloom: bloomOf(token.Bytes()),
+			// Only eth_getBlockByHash
+			nodeCalls: 1,
+		},
+		{
+			name:      "token not in bloom",
+			bloom:     bloomOf(transferTopic.Bytes()),
+			nodeCalls: 1,
+		},
+		{name: "block unknown to the node", changed: true, nodeCalls: 1},
+		{
+			name:      "missing transfer logs",
+			bloom:     bloomOf(token.Bytes(), transferTopic.Bytes()),
+			nodeLogs:  []gethTypes.Log{transferLog},
+			changed:   true,
+			nodeCalls: 2,
+		},
+		{
+			name:      "bloom false positive",
+			bloom:     bloomOf(token.Bytes(), transferTopic.Bytes()),
+			nodeLogs:  []gethTypes.Log{},
+			nodeCalls: 2,
+		},
+		{
+			name:  "transfer logs present",
+			logs:  []gethTypes.Log{transferLog},
+			bloom: bloomOf(token.Bytes(), transferTopic.Bytes()),
+		},
+		{
+			// The backend indexed the block, the bloom is not read
+			name:  "inflation logs absent",
+			logs:  []gethTypes.Log{transferLog},
+			bloom: bloomOf(token.Bytes(), transferTopic.Bytes(), inflationEventTopic("InflationFactorUpdated").Bytes()),
+		},
+		{
+			name:      "missing inflation logs",
+			bloom:     bloomOf(token.Bytes(), inflationEventTopic("InflationFactorUpdated").Bytes()),
+			nodeLogs:  []gethTypes.Log{{Address: token, Topics: []common.Hash{inflationEventTopic("InflationFactorUpdated")}}},
+			changed:   true,
+			nodeCalls: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			s := &BlockAPIService{stableToken: &StableToken{Address: token}}
+			if !test.noNode {
+				s.node = newTestNode(t, func(method string, params []json.RawMessage) interface{} {
+					calls++
+					switch method {
+					case "eth_getBlockByHash":
+						if test.bloom == nil {
+							return nil
+						}
+						return map[string]interface{}{"logsBloom": test.bloom}
+					case "eth_getLogs":
+						return test.nodeLogs
+					}
+					t.Errorf("unexpected call %s", method)
+					return nil
+				})
+			}
+			clientErr := s.checkMissingLogs(context.Background(), block, test.logs)
+			if test.changed {
+				if clientErr == nil || clientErr.Code != ErrBlockChanged.Code {
+					t.Errorf("error %v, expected ErrBlockChanged", clientErr)
+				}
+			} else if clientErr != nil {
+				t.Errorf("unexpected error %v", clientErr)
+			}
+			if calls != test.nodeCalls {
+				t.Errorf("%d node calls, expected %d", calls, test.nodeCalls)
+			}
+		})
+	}
+}
+
+func testTransferLog(txIndex uint, index uint, from, to common.Address, value int64) gethTypes.Log {
+	return gethTypes.Log{
+		Topics:  []common.Hash{transferTopic, from.Hash(), to.Hash()},
+		Data:    common.BigToHash(big.NewInt(value)).Bytes(),
+		TxHash:  common.BigToHash(big.NewInt(int64(txIndex) + 1)),
+		TxIndex: txIndex,
+		Index:   index,
+	}
+}
+
+// Summarizes transactions as their hash followed by one line per operation:
+// index, type, account, amount, log index and related operations.
+func summarizeTransactions(transactions []*types.Transaction) []string {
+	summary := []string{}
+	for _, tx := range transactions {
+		summary = append(summary, tx.TransactionIdentifier.Hash)
+		for _, op := range tx.Operations {
+			var related []int64
+			for _, id := range op.RelatedOperations {
+				related = append(related, id.Index)
+			}
+			summary = append(summary, fmt.Sprintf(
+				"%d %s %s %s log %d related %v",
+				op.OperationIdentifier.Index,
+				op.Type,
+				op.Account.Address,
+				op.Amount.Value,
+				*op.OperationIdentifier.NetworkIndex,
+				related,
+			))
+		}
+	}
+	return summary
+}
+
+// The line of summarizeTransactions for an operation.
+func opSummary(index int64, opType string, account common.Address, amount string, logIndex int, related ...int64) string {
+	var relatedOps []int64
+	relatedOps = append(relatedOps, related...)
+	return fmt.Sprintf("%d %s %s %s log %d related %v", index, opType, account.Hex(), amount, logIndex, relatedOps)
+}
+
+func TestTransactionsFromLogs(t *testing.T) {
+	a := common.HexToAddress("0xaa00000000000000000000000000000000000001")
+	b := common.HexToAddress("0xbb00000000000000000000000000000000000002")
+	c := common.HexToAddress("0xcc00000000000000000000000000000000000003")
+	tx1 := common.BigToHash(big.NewInt(1)).Hex()
+	tx2 := common.BigToHash(big.NewInt(2)).Hex()
+	tx3 := common.BigToHash(big.NewInt(3)).Hex()
+	op := opSummary
+
+	tests := []struct {
+		name     string
+		logs     []gethTypes.Log
+		expected []string
+	}{
+		{name: "no logs", expected: []string{}},
+		{
+			name:     "transfer",
+			logs:     []gethTypes.Log{testTransferLog(0, 4, a, b, 10)},
+			expected: []string{tx1, op(0, OpTransfer, a, "-10", 4), op(1, OpTransfer, b, "10", 4, 0)},
+		},
+		{
+			name: "transactions ordered by index",
+			logs: []gethTypes.Log{
+				testTransferLog(2, 7, c, a, 3),
+				testTransferLog(0, 1, a, b, 1),
+				testTransferLog(1, 5, b, c, 2),
+			},
+			expected: []string{
+				tx1, op(0, OpTransfer, a, "-1", 1), op(1, OpTransfer, b, "1", 1, 0),
+				tx2, op(0, OpTransfer, b, "-2", 5), op(1, OpTransfer, c, "2", 5, 0),
+				tx3, op(0, OpTransfer, c, "-3", 7), op(1, OpTransfer, a, "3", 7, 0),
+			},
+		},
+		{
+			name: "operations ordered by log index across non contiguous logs",
+			logs: []gethTypes.Log{
+				testTransferLog(0, 3, b, c, 2),
+				testTransferLog(1, 2, c, a, 5),
+				testTransferLog(0, 0, a, b, 1),
+			},
+			expected: []string{
+				tx1,
+				op(0, OpTransfer, a, "-1", 0), op(1, OpTransfer, b, "1", 0, 0),
+				op(2, OpTransfer, b, "-2", 3, 0, 1), op(3, OpTransfer, c, "2", 3, 0, 1, 2),
+				tx2, op(0, OpTransfer, c, "-5", 2), op(1, OpTransfer, a, "5", 2, 0),
+			},
+		},
+		{
+			name: "mints and burns stand alone",
+			logs: []gethTypes.Log{
+				testTransferLog(0, 0, ZeroAddress, a, 8),
+				testTransferLog(0, 1, a, b, 3),
+				testTransferLog(0, 2, b, ZeroAddress, 1),
+			},
+			expected: []string{
+				tx1,
+				op(0, OpMint, a, "8", 0),
+				op(1, OpTransfer, a, "-3", 1), op(2, OpTransfer, b, "3", 1, 1),
+				op(3, OpBurn, b, "-1", 2),
+			},
+		},
+		{
+			name:     "transfer between zero addresses",
+			logs:     []gethTypes.Log{testTransferLog(0, 0, ZeroAddress, ZeroAddress, 1)},
+			expected: []string{tx1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			summary := summarizeTransactions(transactionsFromLogs(test.logs))
+			if !reflect.DeepEqual(summary, test.expected) {
+				t.Errorf("transactions\n%v\nexpected\n%v", summary, test.expected)
+			}
+
+			// The input order does not matter
+			reversed := make([]gethTypes.Log, len(test.logs))
+			for i, transferLog := range test.logs {
+				reversed[len(test.logs)-1-i] = transferLog
+			}
+			if again := summarizeTransactions(transactionsFromLogs(reversed)); !reflect.DeepEqual(again, summary) {
+				t.Errorf("reversed logs give\n%v\ninstead of\n%v", again, summary)
+			}
+		})
+	}
+}
+
+// Blocks before the StableToken activation are served with the marker and
+// without transactions, whatever core returns for them.
+func TestBlockBeforeActivation(t *testing.T) {
+	coreClient := newTestCore(t, func(path string, body []byte) interface{} {
+		if path != "/block" {
+			t.Errorf("unexpected core request %s", path)
+		}
+		return &types.BlockResponse{
+			Block: &types.Block{
+				BlockIdentifier:       &types.BlockIdentifier{Index: 99, Hash: "0x63"},
+				ParentBlockIdentifier: &types.BlockIdentifier{Index: 98, Hash: "0x62"},
+				Transactions: []*types.Transaction{{
+					TransactionIdentifier: &types.TransactionIdentifier{Hash: "0x01"},
+				}},
+			},
+			OtherTransactions: []*types.TransactionIdentifier{{Hash: "0x02"}},
+		}
+	})
+	s := NewBlockAPIService(coreClient, nil, &StableToken{BlockThreshold: 100})
+	index := int64(99)
+	resp, clientErr := s.Block(context.Background(), &types.BlockRequest{
+		NetworkIdentifier: &types.NetworkIdentifier{Blockchain: "celo", Network: "test"},
+		BlockIdentifier:   &types.PartialBlockIdentifier{Index: &index},
+	})
+	if clientErr != nil {
+		t.Fatal(clientErr.Message)
+	}
+	if deployed, ok := resp.Block.Metadata[MetadataStableTokenDeployed]; !ok || deployed != false {
+		t.Errorf("%s = %v, expected false", MetadataStableTokenDeployed, deployed)
+	}
+	if resp.Block.Transactions == nil || len(resp.Block.Transactions) != 0 || resp.OtherTransactions != nil {
+		t.Errorf("transactions %v and other transactions %v, expected none", resp.Block.Transactions, resp.OtherTransactions)
+	}
+}
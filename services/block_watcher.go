@@ -0,0 +1,161 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Celo produces a block every ~5 seconds
+	DefaultWatcherInterval = 5 * time.Second
+	// Delivered blocks whose hash is kept to detect reorgs deeper than the confirmation depth
+	watcherReorgDepth = 128
+)
+
+// Invoked by the BlockWatcher with every block that reaches its confirmation depth.
+type BlockHandler func(ctx context.Context, block *types.Block)
+
+// Follows the chain tip reported by core rosetta and feeds cUSD blocks
+// (as returned by the /block endpoint of this module) to registered handlers.
+type BlockWatcher struct {
+	client        *client.APIClient
+	blockService  *BlockAPIService
+	network       *types.NetworkIdentifier
+	confirmations int64
+	interval      time.Duration
+
+	mu        sync.Mutex
+	handlers  []BlockHandler
+	lastIndex int64
+	// Hashes of the last delivered blocks by index
+	delivered map[int64]string
+}
+
+func NewBlockWatcher(
+	client *client.APIClient,
+	blockService *BlockAPIService,
+	network *types.NetworkIdentifier,
+	confirmations int64,
+) *BlockWatcher {
+	return &BlockWatcher{
+		client:        client,
+		blockService:  blockService,
+		network:       network,
+		confirmations: confirmations,
+		interval:      DefaultWatcherInterval,
+		lastIndex:     -1,
+		delivered:     make(map[int64]string),
+	}
+}
+
+// Makes Start deliver the blocks after cursor, including those produced
+// while the watcher was not running, instead of starting at the tip.
+func (w *BlockWatcher) ResumeAfter(cursor *types.BlockIdentifier) {
+	w.lastIndex = cursor.Index
+	if cursor.Hash != "" {
+		w.delivered[cursor.Index] = cursor.Hash
+	}
+}
+
+func (w *BlockWatcher) Subscribe(handler BlockHandler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handlers = append(w.handlers, handler)
+}
+
+// Polls core rosetta until ctx is cancelled. Unless resumed from a cursor,
+// only blocks produced after the watcher is started are delivered.
+func (w *BlockWatcher) Start(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(ctx); err != nil {
+			rootLogger.Warn("block watcher could not poll core rosetta", "confirmations", w.confirmations, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *BlockWatcher) poll(ctx context.Context) error {
+	// The tip and the blocks up to it are read from the same backend
+	ctx = WithCoreAffinity(ctx, "")
+	status, clientErr, err := w.client.NetworkAPI.NetworkStatus(ctx, &types.NetworkRequest{
+		NetworkIdentifier: w.network,
+	})
+	if err != nil {
+		if clientErr != nil {
+			return fmt.Errorf("could not get network status: %s", clientErr.Message)
+		}
+		return fmt.Errorf("could not get network status: %w", err)
+	}
+	target := status.CurrentBlockIdentifier.Index - w.confirmations
+	if target < 0 {
+		return nil
+	}
+	if w.lastIndex < 0 {
+		w.lastIndex = target - 1
+	}
+
+	for index := w.lastIndex + 1; index <= target; index++ {
+		if ctx.Err() != nil {
+			return nil
+		}
+		blockIndex := index
+		blockResp, clientErr := w.blockService.Block(ctx, &types.BlockRequest{
+			NetworkIdentifier: w.network,
+			BlockIdentifier: &types.PartialBlockIdentifier{
+				Index: &blockIndex,
+			},
+		})
+		if clientErr != nil {
+			return fmt.Errorf("could not get block %d: %s", index, clientErr.Message)
+		}
+		block := blockResp.Block
+
+		parent, ok := w.delivered[index-1]
+		if ok && block.ParentBlockIdentifier != nil && block.ParentBlockIdentifier.Hash != parent {
+			// A reorg deeper than the confirmation depth replaced the last
+			// delivered block: step back until the chains meet, then deliver
+			// the blocks of the new chain
+			rootLogger.Warn("block watcher saw a reorg below its confirmation depth", "confirmations", w.confirmations, "block_index", index-1)
+			delete(w.delivered, index-1)
+			w.lastIndex = index - 2
+			index -= 2
+			continue
+		}
+
+		w.mu.Lock()
+		handlers := w.handlers
+		w.mu.Unlock()
+		for _, handler := range handlers {
+			handler(ctx, block)
+		}
+		w.lastIndex = index
+		w.delivered[index] = block.BlockIdentifier.Hash
+		delete(w.delivered, index-watcherReorgDepth)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// The watcher resumes after its cursor and, when a reorg replaces blocks it
+// delivered, delivers the new chain from the first block that differs.
+func TestBlockWatcherReorg(t *testing.T) {
+	var mu sync.Mutex
+	// Hashes of the canonical chain, by index
+	chain := []string{"a0", "a1", "a2", "a3", "a4", "a5"}
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/network/status":
+			json.NewEncoder(w).Encode(&types.NetworkStatusResponse{
+				CurrentBlockIdentifier: &types.BlockIdentifier{Index: int64(len(chain) - 1), Hash: chain[len(chain)-1]},
+			})
+		case "/block":
+			var request types.BlockRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Error(err)
+			}
+			index := *request.BlockIdentifier.Index
+			json.NewEncoder(w).Encode(&types.BlockResponse{Block: &types.Block{
+				BlockIdentifier:       &types.BlockIdentifier{Index: index, Hash: chain[index]},
+				ParentBlockIdentifier: &types.BlockIdentifier{Index: index - 1, Hash: chain[index-1]},
+			}})
+		default:
+			t.Errorf("unexpected core request %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer core.Close()
+
+	apiClient := client.NewAPIClient(client.NewConfiguration(core.URL, "test", core.Client()))
+	// Blocks are served as before the StableToken activation, without logs
+	stableToken := &StableToken{BlockThreshold: math.MaxInt64}
+	watcher := NewBlockWatcher(
+		apiClient,
+		NewBlockAPIService(apiClient, nil, stableToken),
+		&types.NetworkIdentifier{Blockchain: "celo", Network: "test"},
+		0,
+	)
+	watcher.ResumeAfter(&types.BlockIdentifier{Index: 2, Hash: "a2"})
+	var delivered []string
+	watcher.Subscribe(func(ctx context.Context, block *types.Block) {
+		delivered = append(delivered, block.BlockIdentifier.Hash)
+	})
+
+	ctx := context.Background()
+	if err := watcher.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	chain = []string{"a0", "a1", "a2", "a3", "b4", "b5", "b6"}
+	mu.Unlock()
+	if err := watcher.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a3", "a4", "a5", "b4", "b5", "b6"}; !reflect.DeepEqual(delivered, expected) {
+		t.Errorf("delivered %v, expected %v", delivered, expected)
+	}
+}
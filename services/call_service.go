@@ -0,0 +1,279 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/celo-org/celo-blockchain/accounts/abi"
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Call methods
+	CallBalanceOf              = "cusd_balanceOf"
+	CallAllowance              = "cusd_allowance"
+	CallTotalSupply            = "cusd_totalSupply"
+	CallDecimals               = "cusd_decimals"
+	CallGetInflationParameters = "cusd_getInflationParameters"
+	CallValueToUnits           = "cusd_valueToUnits"
+	CallUnitsToValue           = "cusd_unitsToValue"
+	CallVerifySupply           = "cusd_verifySupply"
+)
+
+var (
+	// Read-only StableToken methods exposed through /call
+	stableTokenCallMethods = map[string]string{
+		CallBalanceOf:              "balanceOf",
+		CallAllowance:              "allowance",
+		CallDecimals:               "decimals",
+		CallGetInflationParameters: "getInflationParameters",
+		CallValueToUnits:           "valueToUnits",
+		CallUnitsToValue:           "unitsToValue",
+	}
+
+	AllCallMethods = []string{
+		CallBalanceOf,
+		CallAllowance,
+		CallTotalSupply,
+		CallDecimals,
+		CallGetInflationParameters,
+		CallValueToUnits,
+		CallUnitsToValue,
+		CallVerifySupply,
+	}
+)
+
+// Implements the server.CallAPIServicer interface.
+type CallAPIService struct {
+	client        *client.APIClient
+	stableToken   *StableToken
+	supplyService *SupplyService
+}
+
+func NewCallAPIService(
+	client *client.APIClient,
+	stableToken *StableToken,
+	supplyService *SupplyService,
+) *CallAPIService {
+	return &CallAPIService{
+		client:        client,
+		stableToken:   stableToken,
+		supplyService: supplyService,
+	}
+}
+
+// endpoint: /call
+func (s *CallAPIService) Call(
+	ctx context.Context,
+	request *types.CallRequest,
+) (*types.CallResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "CallAPIService.Call")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "network", networkName(request.NetworkIdentifier), "call_method", request.Method)
+
+	blockIndex, err := blockIndexParam(request.Parameters)
+	if err != nil {
+		loggerFrom(ctx).Info("invalid block_index parameter", "error", err)
+		return nil, ErrValidation
+	}
+
+	switch request.Method {
+	case CallTotalSupply:
+		totalSupply, blockIdentifier, clientErr := s.supplyService.TotalSupply(ctx, request.NetworkIdentifier, blockIndex)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		return &types.CallResponse{
+			Result: map[string]interface{}{
+				"block_identifier": blockIdentifier,
+				"total_supply":     totalSupply.String(),
+			},
+			// Not idempotent at the tip
+			Idempotent: blockIndex != nil,
+		}, nil
+	case CallVerifySupply:
+		if blockIndex == nil {
+			loggerFrom(ctx).Info("block_index is required")
+			return nil, ErrValidation
+		}
+		check, clientErr := s.supplyService.VerifyBlockIndex(ctx, request.NetworkIdentifier, *blockIndex)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		return &types.CallResponse{
+			Result: map[string]interface{}{
+				"block_identifier": check.BlockIdentifier,
+				"previous_supply":  check.PreviousSupply,
+				"total_supply":     check.TotalSupply,
+				"minted":           check.Minted,
+				"burned":           check.Burned,
+				"adjusted":         check.Adjusted,
+				"consistent":       check.Consistent,
+			},
+			Idempotent: false,
+		}, nil
+	}
+
+	methodName, ok := stableTokenCallMethods[request.Method]
+	if !ok {
+		return nil, ErrUnimplemented
+	}
+	return s.callStableToken(ctx, request, methodName, blockIndex)
+}
+
+// Calls a read-only StableToken method with the "args" call parameter,
+// validated against the method inputs in the StableToken ABI.
+//
+// The result holds the block identifier and one entry per method output,
+// keyed by the output name (or "value" for unnamed single outputs).
+func (s *CallAPIService) callStableToken(
+	ctx context.Context,
+	request *types.CallRequest,
+	methodName string,
+	blockIndex *int64,
+) (*types.CallResponse, *types.Error) {
+	method, ok := s.stableToken.ABI.Methods[methodName]
+	if !ok {
+		loggerFrom(ctx).Error("method not found in StableToken ABI", "abi_method", methodName)
+		return nil, ErrInternal
+	}
+	args, err := validateCallArgs(method, request.Parameters["args"])
+	if err != nil {
+		loggerFrom(ctx).Info("invalid call arguments", "error", err)
+		return nil, ErrValidation
+	}
+
+	var blockNumber *big.Int
+	if blockIndex != nil {
+		if !s.stableToken.DeployedAt(*blockIndex) {
+			return nil, ErrStableTokenNotDeployed
+		}
+		blockNumber = new(big.Int).SetInt64(*blockIndex)
+	}
+	result, clientErr := celoCall(
+		ctx,
+		s.client,
+		request.NetworkIdentifier,
+		"StableToken."+method.Name,
+		args,
+		blockNumber,
+	)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+
+	outputs, err := method.Outputs.UnpackValues(result.Raw)
+	if err != nil {
+		loggerFrom(ctx).Error("could not unpack call result", "abi_method", method.Name, "error", err)
+		return nil, ErrInternal
+	}
+	resultMap := map[string]interface{}{
+		"block_identifier": result.BlockIdentifier,
+	}
+	for i, output := range outputs {
+		name := method.Outputs[i].Name
+		if name == "" {
+			name = "value"
+			if len(outputs) > 1 {
+				name = fmt.Sprintf("value%d", i)
+			}
+		}
+		resultMap[name] = formatCallOutput(output)
+	}
+	return &types.CallResponse{
+		Result: resultMap,
+		// Not idempotent at the tip
+		Idempotent: blockIndex != nil,
+	}, nil
+}
+
+// Checks the "args" call parameter against the method inputs and
+// normalizes them into the string arguments expected by celo_call.
+func validateCallArgs(method abi.Method, raw interface{}) ([]interface{}, error) {
+	var rawArgs []interface{}
+	if raw != nil {
+		var ok bool
+		rawArgs, ok = raw.([]interface{})
+		if !ok {
+			return nil, errors.New("args must be a list")
+		}
+	}
+	if len(rawArgs) != len(method.Inputs) {
+		return nil, fmt.Errorf("expected %d args, got %d", len(method.Inputs), len(rawArgs))
+	}
+
+	args := make([]interface{}, len(rawArgs))
+	for i, input := range method.Inputs {
+		arg, ok := rawArgs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("arg %d (%s) must be a string", i, input.Name)
+		}
+		switch input.Type.T {
+		case abi.AddressTy:
+			address, ok := rpc.ChecksumAddress(arg)
+			if !ok {
+				return nil, fmt.Errorf("arg %d (%s) is not an address", i, input.Name)
+			}
+			args[i] = address.Hex()
+		case abi.UintTy:
+			value, ok := new(big.Int).SetString(arg, 10)
+			if !ok || value.Sign() < 0 {
+				return nil, fmt.Errorf("arg %d (%s) is not an unsigned integer", i, input.Name)
+			}
+			args[i] = value.String()
+		default:
+			return nil, fmt.Errorf("arg %d (%s) has unsupported type %s", i, input.Name, input.Type.String())
+		}
+	}
+	return args, nil
+}
+
+// Converts unpacked ABI values into JSON friendly values; integers are
+// returned as decimal strings so that they survive JSON encoding.
+func formatCallOutput(output interface{}) interface{} {
+	switch v := output.(type) {
+	case *big.Int:
+		return v.String()
+	case common.Address:
+		return v.Hex()
+	case uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", v)
+	default:
+		return v
+	}
+}
+
+// Parses the optional "block_index" call parameter.
+func blockIndexParam(params map[string]interface{}) (*int64, error) {
+	raw, ok := params["block_index"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	// Numbers are decoded from JSON as float64
+	value, ok := raw.(float64)
+	if !ok || value < 0 || value != math.Trunc(value) {
+		return nil, fmt.Errorf("invalid block_index: %v", raw)
+	}
+	index := int64(value)
+	return &index, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateCallArgs(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Checksummed, as returned for any case given
+	account := "0x000000000000000000000000000000000000dEaD"
+
+	tests := []struct {
+		name     string
+		method   string
+		raw      interface{}
+		expected []interface{}
+		err      string
+	}{
+		{name: "no args", method: "totalSupply", raw: nil, expected: []interface{}{}},
+		{name: "empty args", method: "totalSupply", raw: []interface{}{}, expected: []interface{}{}},
+		{name: "address", method: "balanceOf", raw: []interface{}{account}, expected: []interface{}{account}},
+		{name: "lowercase address", method: "balanceOf", raw: []interface{}{strings.ToLower(account)}, expected: []interface{}{account}},
+		{
+			name:     "address and uint",
+			method:   "transfer",
+			raw:      []interface{}{account, "007"},
+			expected: []interface{}{account, "7"},
+		},
+		{name: "args not a list", method: "balanceOf", raw: account, err: "args must be a list"},
+		{name: "missing arg", method: "balanceOf", raw: []interface{}{}, err: "expected 1 args, got 0"},
+		{name: "extra arg", method: "totalSupply", raw: []interface{}{account}, err: "expected 0 args, got 1"},
+		{name: "non string arg", method: "balanceOf", raw: []interface{}{float64(1)}, err: "must be a string"},
+		{name: "invalid address", method: "balanceOf", raw: []interface{}{"0x1234"}, err: "is not an address"},
+		{name: "negative uint", method: "transfer", raw: []interface{}{account, "-1"}, err: "is not an unsigned integer"},
+		{name: "hex uint", method: "transfer", raw: []interface{}{account, "0x10"}, err: "is not an unsigned integer"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, ok := stableToken.ABI.Methods[test.method]
+			if !ok {
+				t.Fatalf("no method %s in the StableToken ABI", test.method)
+			}
+			args, err := validateCallArgs(method, test.raw)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, test.expected) {
+				t.Errorf("args %v, expected %v", args, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Calls a read-only contract method (e.g. "StableToken.balanceOf") through core rosetta's celo_call.
+// If blockNumber is nil, the call is made against the tip.
+func celoCall(
+	ctx context.Context,
+	client *client.APIClient,
+	networkId *types.NetworkIdentifier,
+	method string,
+	args []interface{},
+	blockNumber *big.Int,
+) (*rpc.CallResult, *types.Error) {
+	celoMethod, err := airgap.MethodFromString(method)
+	if err != nil {
+		loggerFrom(ctx).Error("unknown contract method", "method", method, "error", err)
+		return nil, ErrInternal
+	}
+	rawParams := &airgap.CallParams{
+		TxArgs: airgap.TxArgs{
+			Method: celoMethod,
+			Args:   args,
+		},
+		BlockNumber: blockNumber,
+	}
+	paramsMap, err := airgap.MarshallToMap(rawParams)
+	if err != nil {
+		return nil, ErrValidation
+	}
+	callReq := &types.CallRequest{
+		NetworkIdentifier: networkId,
+		Method:            "celo_call",
+		Parameters:        paramsMap,
+	}
+	resp, clientErr, err := client.CallAPI.Call(ctx, callReq)
+	if err != nil {
+		loggerFrom(ctx).Debug("celo_call failed", "method", method, "block_index", blockNumber)
+		return nil, upstreamError(ctx, "/call:celo_call", clientErr, err)
+	}
+
+	var result rpc.CallResult
+	err = airgap.UnmarshallFromMap(resp.Result, &result)
+	if err != nil {
+		loggerFrom(ctx).Error("could not parse celo_call result", "method", method, "error", err)
+		return nil, ErrValidation
+	}
+	return &result, nil
+}
+
+// Calls a StableToken method returning a single uint256.
+func callStableTokenUint(
+	ctx context.Context,
+	client *client.APIClient,
+	networkId *types.NetworkIdentifier,
+	method string,
+	args []interface{},
+	blockNumber *big.Int,
+) (*big.Int, *types.BlockIdentifier, *types.Error) {
+	result, clientErr := celoCall(ctx, client, networkId, "StableToken."+method, args, blockNumber)
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	return new(big.Int).SetBytes(result.Raw), result.BlockIdentifier, nil
+}
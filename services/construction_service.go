@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"strconv"
 
 	"github.com/celo-org/rosetta/airgap"
 	"github.com/celo-org/rosetta/service/rpc"
@@ -33,16 +34,27 @@ import (
 // Implements the server.ConstructionAPIServicer interface.
 type ConstructionAPIService struct {
 	client      *client.APIClient
+	node        *NodeClient
 	stableToken *StableToken
+	// Optional, nonces are the pending nonces read by core when nil
+	nonces *NonceManager
+	// Optional, submissions are not followed when nil
+	submissions *SubmissionTracker
 }
 
 func NewConstructionAPIService(
 	client *client.APIClient,
+	node *NodeClient,
 	stableToken *StableToken,
+	nonces *NonceManager,
+	submissions *SubmissionTracker,
 ) *ConstructionAPIService {
 	return &ConstructionAPIService{
 		client:      client,
+		node:        node,
 		stableToken: stableToken,
+		nonces:      nonces,
+		submissions: submissions,
 	}
 }
 
@@ -51,9 +63,15 @@ func (s *ConstructionAPIService) ConstructionDerive(
 	ctx context.Context,
 	request *types.ConstructionDeriveRequest,
 ) (*types.ConstructionDeriveResponse, *types.Error) {
-	resp, clientErr, _ := s.client.ConstructionAPI.ConstructionDerive(ctx, request)
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionDerive")
+	defer span.Finish()
 
-	return resp, clientErr
+	resp, clientErr, err := s.client.ConstructionAPI.ConstructionDerive(ctx, request)
+	if err != nil {
+		return nil, upstreamError(ctx, "/construction/derive", clientErr, err)
+	}
+
+	return resp, nil
 
 }
 
@@ -118,20 +136,97 @@ func (s *ConstructionAPIService) ConstructionPreprocess(
 	ctx context.Context,
 	request *types.ConstructionPreprocessRequest,
 ) (*types.ConstructionPreprocessResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionPreprocess")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "network", networkName(request.NetworkIdentifier))
 
-	transferTx, err := parseTransfer(request.Operations)
+	ops, fee, err := splitGatewayFee(request.Operations)
+	if err != nil {
+		loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
+		return nil, ErrValidation
+	}
+	nonce, pinned, err := pinnedNonce(request.Metadata)
+	if err != nil {
+		loggerFrom(ctx).Info("invalid nonce", "error", err)
+		return nil, ErrValidation
+	}
+	replacement, replacedTx, err := replacementRequest(request.Metadata)
 	if err != nil {
-		logError(fmt.Sprintf("%s", err))
+		loggerFrom(ctx).Info("invalid replacement", "error", err)
 		return nil, ErrValidation
 	}
+	if pinned && replacement != "" {
+		loggerFrom(ctx).Info("a replacement takes the nonce of the transaction it replaces")
+		return nil, ErrValidation
+	}
+
+	var options map[string]interface{}
+	switch {
+	case replacement == ReplacementCancel:
+		account, err := parseCancellation(ops)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid cancellation operations", "error", err)
+			return nil, ErrValidation
+		}
+		if err := fee.checkPayer(account); err != nil {
+			loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
+			return nil, ErrValidation
+		}
+		options = cancellationOptions(account)
+	case isSwap(ops):
+		swap, err := parseSwap(ops)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid swap operations", "error", err)
+			return nil, ErrValidation
+		}
+		if err := fee.checkPayer(swap.Account); err != nil {
+			loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
+			return nil, ErrValidation
+		}
+		mode, err := swapMode(request.Metadata)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid swap mode", "error", err)
+			return nil, ErrValidation
+		}
+		swap.Buy = mode == SwapModeBuy
+		options = swapOptions(swap)
+	case isApprove(ops):
+		approval, err := parseApproval(ops, s.stableToken.ExchangeAddress)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid approve operation", "error", err)
+			return nil, ErrValidation
+		}
+		if err := fee.checkPayer(approval.Owner); err != nil {
+			loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
+			return nil, ErrValidation
+		}
+		options = s.approvalOptions(approval)
+	default:
+		transferTx, err := parseTransfer(ops)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid transfer operations", "error", err)
+			return nil, ErrValidation
+		}
+		if err := fee.checkPayer(transferTx.From); err != nil {
+			loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
+			return nil, ErrValidation
+		}
 
-	options := make(map[string]interface{})
-	options["From"] = transferTx.From.String()
-	// This is currently necessary to properly estimate gas
-	options["Method"] = "StableToken.transfer"
-	options["Args"] = []string{
-		transferTx.To.String(),
-		transferTx.Value.String(),
+		options = make(map[string]interface{})
+		options["From"] = transferTx.From.String()
+		// This is currently necessary to properly estimate gas
+		options["Method"] = "StableToken.transfer"
+		options["Args"] = []string{
+			transferTx.To.String(),
+			transferTx.Value.String(),
+		}
+	}
+	if pinned {
+		options[optionNonce] = strconv.FormatUint(nonce, 10)
+	}
+	if replacement != "" {
+		options[optionReplacement] = replacement
+		options[optionReplaceTx] = replacedTx.Hex()
 	}
 
 	return &types.ConstructionPreprocessResponse{
@@ -144,9 +239,84 @@ func (s *ConstructionAPIService) ConstructionMetadata(
 	ctx context.Context,
 	request *types.ConstructionMetadataRequest,
 ) (*types.ConstructionMetadataResponse, *types.Error) {
-	resp, clientErr, _ := s.client.ConstructionAPI.ConstructionMetadata(ctx, request)
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionMetadata")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "network", networkName(request.NetworkIdentifier))
+
+	// Core only needs the options it estimates gas from
+	options := make(map[string]interface{}, len(request.Options))
+	for k, v := range request.Options {
+		options[k] = v
+	}
+	swap, err := takeSwapOptions(options)
+	if err != nil {
+		loggerFrom(ctx).Info("invalid swap options", "error", err)
+		return nil, ErrValidation
+	}
+	nonce, pinned, err := takeNonceOption(options)
+	if err != nil {
+		loggerFrom(ctx).Info("invalid nonce option", "error", err)
+		return nil, ErrValidation
+	}
+	replacement, replacedTx := takeReplacementOptions(options)
+	from, _ := options["From"].(string)
+	var pendingTx *nodeTransaction
+	if replacement != "" {
+		var clientErr *types.Error
+		pendingTx, clientErr = s.pendingTransaction(ctx, replacedTx, from)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+	}
+	coreRequest := *request
+	coreRequest.Options = options
+
+	resp, clientErr, err := s.client.ConstructionAPI.ConstructionMetadata(ctx, &coreRequest)
+	if err != nil {
+		return nil, upstreamError(ctx, "/construction/metadata", clientErr, err)
+	}
+	if pendingTx != nil || pinned || s.nonces != nil {
+		var tx airgap.TxMetadata
+		if err := airgap.UnmarshallFromMap(resp.Metadata, &tx); err != nil {
+			loggerFrom(ctx).Error("could not decode transaction metadata from core", "error", err)
+			return nil, ErrInternal
+		}
+		if pendingTx != nil {
+			if err := setReplacement(&tx, pendingTx); err != nil {
+				loggerFrom(ctx).Info("invalid replacement", "tx_hash", replacedTx.Hex(), "error", err)
+				return nil, ErrValidation
+			}
+		} else if clientErr := s.assignNonce(ctx, &tx, nonce, pinned); clientErr != nil {
+			return nil, clientErr
+		}
+		updated, err := airgap.MarshallToMap(&tx)
+		if err != nil {
+			loggerFrom(ctx).Error("could not encode transaction metadata", "error", err)
+			return nil, ErrInternal
+		}
+		for k, v := range updated {
+			resp.Metadata[k] = v
+		}
+		if pendingTx != nil {
+			resp.Metadata[MetadataReplacement] = replacement
+			resp.Metadata[MetadataReplacesTx] = replacedTx.Hex()
+		}
+	}
 
-	return resp, clientErr
+	if swap != nil {
+		// The swap mode also tells /construction/payloads which Exchange method to call
+		swapMetadata, clientErr := s.swapMetadata(ctx, request.NetworkIdentifier, from, swap)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		if resp.Metadata == nil {
+			resp.Metadata = make(map[string]interface{})
+		}
+		for k, v := range swapMetadata {
+			resp.Metadata[k] = v
+		}
+	}
+	return resp, nil
 }
 
 type transferArgs struct {
@@ -165,35 +335,99 @@ func (s *ConstructionAPIService) ConstructionPayloads(
 	ctx context.Context,
 	request *types.ConstructionPayloadsRequest,
 ) (*types.ConstructionPayloadsResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionPayloads")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "network", networkName(request.NetworkIdentifier))
 
 	// Construct unsigned cUSD transaction blob
 	var metadata airgap.TxMetadata
 	err := airgap.UnmarshallFromMap(request.Metadata, &metadata)
 	if err != nil {
+		loggerFrom(ctx).Info("invalid transaction metadata", "error", err)
 		return nil, ErrValidation
 	}
 
-	transferTx, err := parseTransfer(request.Operations)
+	ops, fee, err := splitGatewayFee(request.Operations)
 	if err != nil {
-		logError(fmt.Sprintf("%s", err))
+		loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
 		return nil, ErrValidation
 	}
-	metadata.Data, err = s.stableToken.ABI.Pack(
-		s.stableToken.ABI.Methods["transfer"].Name,
-		transferTx.To,
-		transferTx.Value,
-	)
-	if err != nil {
-		logError("could not pack transfer data")
+	if err := fee.checkPayer(&metadata.From); err != nil {
+		loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
 		return nil, ErrValidation
 	}
+	if err := s.setGatewayFee(&metadata, fee); err != nil {
+		loggerFrom(ctx).Info("invalid gateway fee operations", "error", err)
+		return nil, ErrValidation
+	}
+
+	switch replacement, _ := request.Metadata[MetadataReplacement].(string); {
+	case replacement == ReplacementCancel:
+		account, err := parseCancellation(ops)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid cancellation operations", "error", err)
+			return nil, ErrValidation
+		}
+		metadata.Data, err = s.stableToken.ABI.Pack("transfer", *account, big.NewInt(0))
+		if err != nil {
+			loggerFrom(ctx).Error("could not pack cancellation data", "error", err)
+			return nil, ErrValidation
+		}
+	case isSwap(ops):
+		swap, err := parseSwap(ops)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid swap operations", "error", err)
+			return nil, ErrValidation
+		}
+		mode, err := swapMode(request.Metadata)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid swap mode", "error", err)
+			return nil, ErrValidation
+		}
+		swap.Buy = mode == SwapModeBuy
+		metadata.Data, err = s.swapData(swap)
+		if err != nil {
+			loggerFrom(ctx).Error("could not pack swap data", "swap_mode", mode, "error", err)
+			return nil, ErrValidation
+		}
+	case isApprove(ops):
+		approval, err := parseApproval(ops, s.stableToken.ExchangeAddress)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid approve operation", "error", err)
+			return nil, ErrValidation
+		}
+		metadata.Data, err = s.approvalData(approval)
+		if err != nil {
+			loggerFrom(ctx).Error("could not pack approval data", "error", err)
+			return nil, ErrValidation
+		}
+	default:
+		transferTx, err := parseTransfer(ops)
+		if err != nil {
+			loggerFrom(ctx).Info("invalid transfer operations", "error", err)
+			return nil, ErrValidation
+		}
+		metadata.Data, err = s.stableToken.ABI.Pack(
+			s.stableToken.ABI.Methods["transfer"].Name,
+			transferTx.To,
+			transferTx.Value,
+		)
+		if err != nil {
+			loggerFrom(ctx).Error("could not pack transfer data", "error", err)
+			return nil, ErrValidation
+		}
+	}
 
 	tx := airgap.Transaction{
 		TxMetadata: &metadata,
 		Signature:  []byte{},
 	}
 	// TODO core: extract this into a helper function in core
-	gethTx, _ := tx.AsGethTransaction()
+	gethTx, err := tx.AsGethTransaction()
+	if err != nil {
+		loggerFrom(ctx).Info("could not build transaction from metadata", "error", err)
+		return nil, ErrValidation
+	}
 	signer := gethTypes.NewEIP155Signer(tx.ChainId)
 
 	// Construct SigningPayload
@@ -207,6 +441,7 @@ func (s *ConstructionAPIService) ConstructionPayloads(
 
 	unsignedTxJSON, err := json.Marshal(tx)
 	if err != nil {
+		loggerFrom(ctx).Error("could not encode unsigned transaction", "error", err)
 		return nil, ErrInternal
 	}
 
@@ -221,84 +456,125 @@ func (s *ConstructionAPIService) ConstructionParse(
 	ctx context.Context,
 	request *types.ConstructionParseRequest,
 ) (*types.ConstructionParseResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionParse")
+	defer span.Finish()
+	ctx = withLogFields(ctx, "network", networkName(request.NetworkIdentifier), "signed", request.Signed)
+
 	var tx airgap.Transaction
+	var hash *common.Hash
 	if !request.Signed {
 		err := json.Unmarshal([]byte(request.Transaction), &tx)
 		if err != nil {
+			loggerFrom(ctx).Info("could not decode unsigned transaction", "error", err)
 			return nil, ErrInternal
 		}
 	} else {
 		t := new(gethTypes.Transaction)
 		err := t.UnmarshalJSON([]byte(request.Transaction))
 		if err != nil {
+			loggerFrom(ctx).Info("could not decode signed transaction", "error", err)
 			return nil, ErrInternal
 		}
 
 		from, err := gethTypes.Sender(gethTypes.NewEIP155Signer(t.ChainId()), t)
 		if err != nil {
+			loggerFrom(ctx).Info("could not recover transaction sender", "tx_hash", t.Hash().Hex(), "error", err)
 			return nil, ErrInternal
 		}
 
-		txMetadata := &airgap.TxMetadata{
-			To:                  *t.To(),
-			From:                from,
-			ChainId:             t.ChainId(),
-			Gas:                 t.Gas(),
-			GasPrice:            t.GasPrice(),
-			Nonce:               t.Nonce(),
-			Data:                t.Data(),
-			Value:               t.Value(),
-			FeeCurrency:         t.FeeCurrency(),
-			GatewayFee:          t.GatewayFee(),
-			GatewayFeeRecipient: t.GatewayFeeRecipient(),
-		}
 		v, r, s := t.RawSignatureValues()
 		signature := airgap.ValuesToSignature(t.ChainId(), v, r, s)
 
 		tx = airgap.Transaction{
-			TxMetadata: txMetadata,
+			TxMetadata: signedTxMetadata(t, from),
 			Signature:  signature,
 		}
+		txHash := t.Hash()
+		hash = &txHash
+	}
+	// Swaps and their approvals are sent to the Exchange and GoldToken
+	var ops []*types.Operation
+	var metadata map[string]interface{}
+	var err error
+	switch {
+	case tx.To == s.stableToken.ExchangeAddress:
+		ops, metadata, err = s.parseSwapTx(&tx)
+	case tx.To == s.stableToken.GoldTokenAddress || isApproval(s.stableToken, &tx):
+		ops, err = s.parseApprovalTx(&tx)
+	default:
+		ops, err = s.parseTransferTx(&tx)
+	}
+	if err != nil {
+		loggerFrom(ctx).Info("could not parse transaction", "to", tx.To.Hex(), "error", err)
+		return nil, ErrValidation
+	}
+	ops = append(ops, s.gatewayFeeOps(tx.TxMetadata, int64(len(ops)))...)
+	if s.node != nil {
+		// Best effort, parsing does not depend on the node
+		replacement, err := s.replacementIntent(ctx, tx.TxMetadata, hash)
+		if err != nil {
+			loggerFrom(ctx).Warn("could not check for a replaced transaction", "error", err)
+		} else if replacement != "" {
+			if metadata == nil {
+				metadata = make(map[string]interface{})
+			}
+			metadata[MetadataReplacement] = replacement
+		}
+	}
+
+	var resp *types.ConstructionParseResponse
+	resp = &types.ConstructionParseResponse{
+		Operations: ops,
+		Metadata:   metadata,
+	}
+	if request.Signed {
+		resp.AccountIdentifierSigners = []*types.AccountIdentifier{
+			{
+				Address: tx.From.Hex(),
+			},
+		}
+	}
+	return resp, nil
+}
+
+// Whether tx approves a spender of the StableToken.
+func isApproval(stableToken *StableToken, tx *airgap.Transaction) bool {
+	if tx.To != stableToken.Address || len(tx.Data) < 4 {
+		return false
 	}
+	method, err := stableToken.ABI.MethodById(tx.Data[:4])
+	return err == nil && method.Name == "approve"
+}
+
+// Decodes a StableToken.transfer transaction into its transfer operations.
+func (s *ConstructionAPIService) parseTransferTx(tx *airgap.Transaction) ([]*types.Operation, error) {
 	// Confirm that the transaction will be sent to the StableToken contract
 	if tx.To != s.stableToken.Address {
-		logError("transaction 'To' does not match StableToken address")
-		return nil, ErrValidation
+		return nil, errors.New("transaction 'To' does not match StableToken address")
+	}
+	if len(tx.Data) < 4 {
+		return nil, errors.New("missing method ID")
 	}
 
 	// Check method ID
 	transferMethod := s.stableToken.ABI.Methods["transfer"]
 	method, err := s.stableToken.ABI.MethodById(tx.Data[:4])
 	if err != nil || method.Name != "transfer" {
-		logError("could not parse method ID")
-		return nil, ErrValidation
+		return nil, fmt.Errorf("could not parse method ID: %v", err)
 	}
 	// Parse data according to transfer(to, value)
 	var transferArgs transferArgs
 	err = transferMethod.Inputs.Unpack(&transferArgs, tx.Data[4:])
 	if err != nil {
-		logError("could not unpack transaction data")
-		return nil, ErrValidation
+		return nil, fmt.Errorf("could not unpack transaction data: %w", err)
 	}
 	toAddr := transferArgs.To
 	value := transferArgs.Value
 
-	ops := []*types.Operation{
+	return []*types.Operation{
 		newAtomicOp(tx.From, 0, new(big.Int).Neg(value), nil, OpTransfer, nil),
 		newAtomicOp(toAddr, 1, value, nil, OpTransfer, []*types.OperationIdentifier{{Index: 0}}),
-	}
-	var resp *types.ConstructionParseResponse
-	resp = &types.ConstructionParseResponse{
-		Operations: ops,
-	}
-	if request.Signed {
-		resp.AccountIdentifierSigners = []*types.AccountIdentifier{
-			{
-				Address: tx.From.Hex(),
-			},
-		}
-	}
-	return resp, nil
+	}, nil
 }
 
 // endpoint: /construction/combine
@@ -306,9 +582,15 @@ func (s *ConstructionAPIService) ConstructionCombine(
 	ctx context.Context,
 	request *types.ConstructionCombineRequest,
 ) (*types.ConstructionCombineResponse, *types.Error) {
-	resp, clientErr, _ := s.client.ConstructionAPI.ConstructionCombine(ctx, request)
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionCombine")
+	defer span.Finish()
+
+	resp, clientErr, err := s.client.ConstructionAPI.ConstructionCombine(ctx, request)
+	if err != nil {
+		return nil, upstreamError(ctx, "/construction/combine", clientErr, err)
+	}
 
-	return resp, clientErr
+	return resp, nil
 }
 
 // endpoint: /construction/hash
@@ -316,9 +598,15 @@ func (s *ConstructionAPIService) ConstructionHash(
 	ctx context.Context,
 	request *types.ConstructionHashRequest,
 ) (*types.TransactionIdentifierResponse, *types.Error) {
-	resp, clientErr, _ := s.client.ConstructionAPI.ConstructionHash(ctx, request)
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionHash")
+	defer span.Finish()
 
-	return resp, clientErr
+	resp, clientErr, err := s.client.ConstructionAPI.ConstructionHash(ctx, request)
+	if err != nil {
+		return nil, upstreamError(ctx, "/construction/hash", clientErr, err)
+	}
+
+	return resp, nil
 }
 
 // endpoint: /construction/submit
@@ -326,7 +614,84 @@ func (s *ConstructionAPIService) ConstructionSubmit(
 	ctx context.Context,
 	request *types.ConstructionSubmitRequest,
 ) (*types.TransactionIdentifierResponse, *types.Error) {
-	resp, clientErr, _ := s.client.ConstructionAPI.ConstructionSubmit(ctx, request)
+	ctx, span := startSpan(ctx, "ConstructionAPIService.ConstructionSubmit")
+	defer span.Finish()
+
+	var tx *gethTypes.Transaction
+	var from common.Address
+	if s.nonces != nil || s.node != nil || s.submissions != nil {
+		var err error
+		tx, from, err = decodeSignedTransaction(request.SignedTransaction)
+		if err != nil {
+			// Core rejects it with a proper error
+			loggerFrom(ctx).Debug("could not decode signed transaction", "error", err)
+		}
+	}
+	// Whether the transaction replaces a pending one can only be told before
+	// it is submitted
+	var replacement string
+	if tx != nil && s.node != nil {
+		hash := tx.Hash()
+		var err error
+		replacement, err = s.replacementIntent(ctx, signedTxMetadata(tx, from), &hash)
+		if err != nil {
+			loggerFrom(ctx).Warn("could not check for a replaced transaction", "error", err)
+		}
+	}
+
+	resp, clientErr, err := s.client.ConstructionAPI.ConstructionSubmit(ctx, request)
+	if err != nil {
+		if tx != nil && s.nonces != nil {
+			s.nonces.Release(from, tx.Nonce())
+		}
+		return nil, upstreamError(ctx, "/construction/submit", clientErr, err)
+	}
+	if tx != nil && s.nonces != nil {
+		s.nonces.Submitted(from, tx.Nonce())
+	}
+	if tx != nil && s.submissions != nil {
+		s.submissions.Track(request.NetworkIdentifier, request.SignedTransaction, tx, from)
+	}
+	if replacement != "" {
+		if resp.Metadata == nil {
+			resp.Metadata = make(map[string]interface{})
+		}
+		resp.Metadata[MetadataReplacement] = replacement
+	}
 
-	return resp, clientErr
+	return resp, nil
+}
+
+// The metadata of the signed transaction t sent by from.
+func signedTxMetadata(t *gethTypes.Transaction, from common.Address) *airgap.TxMetadata {
+	tx := &airgap.TxMetadata{
+		From:                from,
+		ChainId:             t.ChainId(),
+		Gas:                 t.Gas(),
+		GasPrice:            t.GasPrice(),
+		Nonce:               t.Nonce(),
+		Data:                t.Data(),
+		Value:               t.Value(),
+		FeeCurrency:         t.FeeCurrency(),
+		GatewayFee:          t.GatewayFee(),
+		GatewayFeeRecipient: t.GatewayFeeRecipient(),
+	}
+	// Contract deployments have no recipient
+	if to := t.To(); to != nil {
+		tx.To = *to
+	}
+	return tx
+}
+
+// Decodes a signed transaction and recovers its sender.
+func decodeSignedTransaction(signed string) (*gethTypes.Transaction, common.Address, error) {
+	tx := new(gethTypes.Transaction)
+	if err := tx.UnmarshalJSON([]byte(signed)); err != nil {
+		return nil, common.Address{}, err
+	}
+	from, err := gethTypes.Sender(gethTypes.NewEIP155Signer(tx.ChainId()), tx)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	return tx, from, nil
 }
@@ -0,0 +1,194 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Interval between checks while core rosetta is reachable
+	coreCheckInterval = 10 * time.Second
+	// Bounds of the backoff between checks while it is not
+	coreMinBackoff = 1 * time.Second
+	coreMaxBackoff = 30 * time.Second
+)
+
+var (
+	errCoreNotDiscovered = errors.New("core rosetta has not been reached yet")
+)
+
+// Discovers the networks served by core rosetta, retrying with backoff
+// until it is reachable, and keeps checking that it stays reachable and
+// serves the same networks (e.g. after a restart).
+type CoreMonitor struct {
+	client *client.APIClient
+
+	mu           sync.RWMutex
+	networks     []*types.NetworkIdentifier
+	err          error
+	onDiscovered []func([]*types.NetworkIdentifier)
+}
+
+func NewCoreMonitor(client *client.APIClient) *CoreMonitor {
+	return &CoreMonitor{
+		client: client,
+		err:    errCoreNotDiscovered,
+	}
+}
+
+// Registers a callback invoked once, with the networks served by core
+// rosetta, the first time it is reached.
+func (m *CoreMonitor) OnDiscovered(callback func([]*types.NetworkIdentifier)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onDiscovered = append(m.onDiscovered, callback)
+}
+
+// Whether core rosetta is reachable and serves the networks first discovered.
+func (m *CoreMonitor) Ready() bool {
+	return m.Err() == nil
+}
+
+// The reason core rosetta is not ready, or nil.
+func (m *CoreMonitor) Err() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.err
+}
+
+// Networks first discovered, nil until core rosetta has been reached.
+func (m *CoreMonitor) Networks() []*types.NetworkIdentifier {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.networks
+}
+
+// Checks core rosetta until ctx is cancelled.
+func (m *CoreMonitor) Start(ctx context.Context) {
+	backoff := coreMinBackoff
+	for {
+		wait := coreCheckInterval
+		if err := m.check(ctx); err != nil {
+			rootLogger.Warn("core rosetta unavailable", "retry_in", backoff, "error", err)
+			wait = backoff
+			backoff *= 2
+			if backoff > coreMaxBackoff {
+				backoff = coreMaxBackoff
+			}
+		} else {
+			backoff = coreMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (m *CoreMonitor) check(ctx context.Context) error {
+	resp, clientErr, err := m.client.NetworkAPI.NetworkList(ctx, &types.MetadataRequest{})
+	if err == nil && len(resp.NetworkIdentifiers) == 0 {
+		err = errors.New("core rosetta serves no networks")
+	} else if clientErr != nil {
+		err = errors.New(clientErr.Message)
+	}
+	if err != nil {
+		m.mu.Lock()
+		m.err = err
+		m.mu.Unlock()
+		return err
+	}
+
+	m.mu.Lock()
+	if m.networks != nil && types.Hash(m.networks) != types.Hash(resp.NetworkIdentifiers) {
+		m.err = fmt.Errorf(
+			"core rosetta networks changed from %s to %s",
+			types.PrintStruct(m.networks),
+			types.PrintStruct(resp.NetworkIdentifiers),
+		)
+		m.mu.Unlock()
+		return m.err
+	}
+	m.err = nil
+	discovered := m.networks == nil
+	if discovered {
+		m.networks = resp.NetworkIdentifiers
+	}
+	callbacks := m.onDiscovered
+	m.mu.Unlock()
+
+	if discovered {
+		rootLogger.Info("discovered core rosetta networks", "networks", types.PrintStruct(resp.NetworkIdentifiers))
+		for _, callback := range callbacks {
+			callback(resp.NetworkIdentifiers)
+		}
+	}
+	return nil
+}
+
+// Serves the health probes and, once core rosetta has been discovered,
+// forwards every other request to the handler set with SetHandler. Until
+// then, or whenever core rosetta is unavailable, requests fail with
+// ErrCoreUnavailable.
+type CoreGate struct {
+	monitor *CoreMonitor
+	health  *HealthService
+
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func NewCoreGate(monitor *CoreMonitor, health *HealthService) *CoreGate {
+	return &CoreGate{
+		monitor: monitor,
+		health:  health,
+	}
+}
+
+func (g *CoreGate) SetHandler(handler http.Handler) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.handler = handler
+}
+
+func (g *CoreGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if probe, ok := g.health.handlerFor(r.URL.Path); ok {
+		probe(w, r)
+		return
+	}
+
+	g.mu.RLock()
+	handler := g.handler
+	g.mu.RUnlock()
+	err := g.monitor.Err()
+	if err == nil && handler == nil {
+		err = errors.New("server is initializing")
+	}
+	if err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrCoreUnavailable, err)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func TestCoreGate(t *testing.T) {
+	var mu sync.Mutex
+	// What core answers to /network/list
+	var networks interface{} = ErrCoreUnavailable
+	coreClient := newTestCore(t, func(path string, body []byte) interface{} {
+		if path != "/network/list" {
+			t.Errorf("unexpected core request %s", path)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return networks
+	})
+	setNetworks := func(resp interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		networks = resp
+	}
+	testNetwork := &types.NetworkIdentifier{Blockchain: "celo", Network: "test"}
+	monitor := NewCoreMonitor(coreClient)
+	gate := NewCoreGate(monitor, NewHealthService(coreClient, monitor, nil, DefaultMaxSyncLag))
+
+	// Each step checks core unless skipped, then sends /block to the gate
+	steps := []struct {
+		name       string
+		networks   interface{}
+		skipCheck  bool
+		setHandler bool
+		// Whether the request reaches the handler rather than failing with ErrCoreUnavailable
+		forwarded bool
+	}{
+		{name: "before any check", skipCheck: true},
+		{name: "core unreachable", networks: ErrCoreUnavailable},
+		{name: "no networks", networks: &types.NetworkListResponse{}},
+		{name: "discovered, not initialized", networks: &types.NetworkListResponse{NetworkIdentifiers: []*types.NetworkIdentifier{testNetwork}}},
+		{name: "initialized", skipCheck: true, setHandler: true, forwarded: true},
+		{name: "core restarted", networks: ErrCoreUnavailable},
+		{
+			name:     "other networks after a restart",
+			networks: &types.NetworkListResponse{NetworkIdentifiers: []*types.NetworkIdentifier{{Blockchain: "celo", Network: "other"}}},
+		},
+		{name: "same networks again", networks: &types.NetworkListResponse{NetworkIdentifiers: []*types.NetworkIdentifier{testNetwork}}, forwarded: true},
+	}
+	for _, step := range steps {
+		if !step.skipCheck {
+			setNetworks(step.networks)
+			_ = monitor.check(context.Background())
+		}
+		if step.setHandler {
+			gate.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+		}
+
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/block", nil))
+		if step.forwarded {
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: status %d, expected the request to be forwarded", step.name, w.Code)
+			}
+			continue
+		}
+		var rosettaErr types.Error
+		if err := json.Unmarshal(w.Body.Bytes(), &rosettaErr); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if w.Code != http.StatusInternalServerError || rosettaErr.Code != ErrCoreUnavailable.Code || !rosettaErr.Retriable {
+			t.Errorf("%s: status %d and error %s, expected %s", step.name, w.Code, w.Body, ErrCoreUnavailable.Message)
+		}
+
+		// Probes are served whatever the state of core
+		w = httptest.NewRecorder()
+		gate.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: /health status %d", step.name, w.Code)
+		}
+	}
+	if discovered := monitor.Networks(); len(discovered) != 1 || discovered[0].Network != testNetwork.Network {
+		t.Errorf("discovered networks %s, expected the first ones", types.PrintStruct(discovered))
+	}
+}
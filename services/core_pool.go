@@ -0,0 +1,481 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/fetcher"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Strategies for routing reads between core rosetta backends
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLowestLag  = "lowest-lag"
+
+	// Base URL given to the core rosetta client, whose requests are
+	// routed to one of the backends by CorePool
+	CorePoolURL = "http://core-rosetta"
+
+	DefaultCoreHealthInterval = 5 * time.Second
+	DefaultCoreMaxBlockLag    = 10
+)
+
+// Paths of requests pinned to a single backend, so that a construction
+// flow (metadata, then submit) and the mempool queries that follow it
+// reach the same node.
+var pinnedPathPrefixes = []string{"/construction/", "/mempool"}
+
+// The state of a core rosetta backend, as reported on /ready.
+type CoreBackendStatus struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	// Blocks behind the most advanced backend
+	BlockLag    int64  `json:"block_lag"`
+	Pinned      bool   `json:"pinned,omitempty"`
+	CircuitOpen bool   `json:"circuit_open,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type coreBackend struct {
+	url     *url.URL
+	client  *client.APIClient
+	breaker *circuitBreaker
+
+	mu      sync.RWMutex
+	healthy bool
+	tip     int64
+	err     error
+}
+
+func (b *coreBackend) state() (healthy bool, tip int64, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.healthy, b.tip, b.err
+}
+
+func (b *coreBackend) setHealthy(healthy bool, tip int64, err error) (changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed = b.healthy != healthy
+	b.healthy = healthy
+	if healthy {
+		b.tip = tip
+	}
+	b.err = err
+	return changed
+}
+
+// Routes the requests of the core rosetta client between several core
+// rosetta backends, applying an UpstreamPolicy. Backends are health-checked
+// in the background and also taken out of rotation as soon as a request to
+// them fails, so that retries fail over to another one; each has its own
+// circuit breaker, and is out of rotation while it is open. Reads are
+// spread round-robin or sent to the backend with the most recent tip;
+// construction and mempool requests stick to one backend while it stays
+// healthy. Requests made with a context from WithCoreAffinity all go to the
+// backend the first one did.
+type CorePool struct {
+	backends    []*coreBackend
+	next        http.RoundTripper
+	strategy    string
+	maxBlockLag int64
+	policy      UpstreamPolicy
+
+	counter uint64
+
+	mu     sync.Mutex
+	pinned *coreBackend
+}
+
+func NewCorePool(
+	urls []string,
+	next http.RoundTripper,
+	strategy string,
+	maxBlockLag int64,
+	policy UpstreamPolicy,
+) (*CorePool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no core rosetta backend")
+	}
+	if strategy != BalanceRoundRobin && strategy != BalanceLowestLag {
+		return nil, fmt.Errorf("unknown balancing strategy %q, expected %s or %s", strategy, BalanceRoundRobin, BalanceLowestLag)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	pool := &CorePool{
+		next:        next,
+		strategy:    strategy,
+		maxBlockLag: maxBlockLag,
+		policy:      policy,
+	}
+	for _, rawURL := range urls {
+		u, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid core rosetta URL %q", rawURL)
+		}
+		pool.backends = append(pool.backends, &coreBackend{
+			url: u,
+			// Health checks bypass the pool and the retries above it
+			client: client.NewAPIClient(client.NewConfiguration(
+				u.String(),
+				fetcher.DefaultUserAgent,
+				&http.Client{Transport: next, Timeout: probeTimeout},
+			)),
+			breaker: &circuitBreaker{
+				backend:   u.Host,
+				threshold: policy.BreakerThreshold,
+				cooldown:  policy.BreakerCooldown,
+			},
+			// Backends are assumed healthy until checked
+			healthy: true,
+		})
+	}
+	return pool, nil
+}
+
+// Ties the core rosetta requests made on behalf of one incoming request, or
+// one background task, to a single backend, so that they all see the same
+// chain. It is set on the first request and replaced only when its backend
+// stops being a candidate.
+type coreAffinity struct {
+	// Path of the incoming request, if any
+	path string
+
+	mu      sync.Mutex
+	backend *coreBackend
+}
+
+type coreAffinityKey struct{}
+
+// Returns a context whose core rosetta requests all go to the same backend
+// while it stays healthy. path is the path of the incoming request the
+// context serves, if any: construction and mempool requests use the
+// backend pinned for them.
+func WithCoreAffinity(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, coreAffinityKey{}, &coreAffinity{path: path})
+}
+
+// Sends the core rosetta requests made while serving a request to a single
+// backend.
+func CoreAffinityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithCoreAffinity(r.Context(), r.URL.Path)))
+	})
+}
+
+// Sends req to a backend, and again to another one, per the policy, if it
+// fails transiently.
+func (p *CorePool) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	attempts := p.policy.attemptsFor(req)
+	for attempt := 0; ; attempt++ {
+		backend := p.pickFor(ctx, req.URL.Path)
+		SpanFromContext(ctx).SetAttribute("core.backend", backend.url.Host)
+		if err := backend.breaker.allow(); err != nil {
+			return nil, err
+		}
+		attemptReq, cancel, err := p.policy.prepare(req, attempt)
+		if err != nil {
+			backend.breaker.abandon()
+			return nil, err
+		}
+		resp, err := p.next.RoundTrip(backend.outbound(attemptReq))
+		failed, retriable := classifyUpstream(resp, err)
+		if ctx.Err() != nil {
+			// Requests abandoned by their caller say nothing about the backend
+			backend.breaker.abandon()
+		} else {
+			backend.breaker.record(failed)
+			if failed {
+				cause := err
+				if cause == nil {
+					cause = fmt.Errorf("HTTP %d", resp.StatusCode)
+				}
+				p.markUnhealthy(backend, cause)
+			}
+		}
+
+		if !retriable || attempt+1 >= attempts || ctx.Err() != nil {
+			if resp == nil {
+				cancel()
+				return resp, err
+			}
+			// The attempt's deadline must hold until the body has been read
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, err
+		}
+		if resp != nil {
+			// Drain the body so that the connection can be reused
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+
+		backoff := p.policy.backoffFor(attempt)
+		loggerFrom(ctx).Debug(
+			"retrying request to core rosetta",
+			"path", req.URL.Path,
+			"backend", backend.url.Host,
+			"attempt", attempt+1,
+			"backoff", backoff,
+			"error", err,
+		)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// A copy of req, made to the pool, sent to the backend instead. A
+// RoundTripper must not modify the request it was given.
+func (b *coreBackend) outbound(req *http.Request) *http.Request {
+	outbound := req.Clone(req.Context())
+	outbound.Host = ""
+	outbound.URL.Scheme = b.url.Scheme
+	outbound.URL.Host = b.url.Host
+	outbound.URL.User = b.url.User
+	outbound.URL.Path = b.url.Path + req.URL.Path
+	outbound.URL.RawPath = ""
+	return outbound
+}
+
+func (p *CorePool) markUnhealthy(backend *coreBackend, err error) {
+	if backend.setHealthy(false, 0, err) {
+		coreBackendFailures.inc(backend.url.Host)
+		rootLogger.Warn("core rosetta backend unhealthy", "backend", backend.url.Host, "error", err)
+	}
+}
+
+// The backend to send a request for path to, made with ctx: the backend of
+// the affinity of ctx if it has one.
+func (p *CorePool) pickFor(ctx context.Context, path string) *coreBackend {
+	affinity, ok := ctx.Value(coreAffinityKey{}).(*coreAffinity)
+	if !ok {
+		return p.pick(p.candidates(), path)
+	}
+	affinity.mu.Lock()
+	defer affinity.mu.Unlock()
+	candidates := p.candidates()
+	for _, backend := range candidates {
+		if backend == affinity.backend {
+			return backend
+		}
+	}
+	if isPinnedPath(affinity.path) {
+		path = affinity.path
+	}
+	affinity.backend = p.pick(candidates, path)
+	return affinity.backend
+}
+
+// The backend among candidates to send a request for path to.
+func (p *CorePool) pick(candidates []*coreBackend, path string) *coreBackend {
+	if isPinnedPath(path) {
+		return p.pinnedBackend(candidates)
+	}
+	if p.strategy == BalanceLowestLag {
+		return mostAdvanced(candidates)
+	}
+	n := atomic.AddUint64(&p.counter, 1)
+	return candidates[n%uint64(len(candidates))]
+}
+
+func isPinnedPath(path string) bool {
+	for _, prefix := range pinnedPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Healthy backends within maxBlockLag of the most advanced one or, failing
+// that, any healthy backend or, failing that, every backend: requests are
+// still attempted rather than refused when the pool looks down, failing
+// fast on the backends whose circuit breaker is open. Backends whose
+// breaker is open, and not letting a probe through, count as unhealthy.
+func (p *CorePool) candidates() []*coreBackend {
+	var healthy, synced []*coreBackend
+	maxTip := p.maxTip()
+	for _, backend := range p.backends {
+		ok, tip, _ := backend.state()
+		if !ok || !backend.breaker.available() {
+			continue
+		}
+		healthy = append(healthy, backend)
+		if maxTip-tip <= p.maxBlockLag {
+			synced = append(synced, backend)
+		}
+	}
+	switch {
+	case len(synced) > 0:
+		return synced
+	case len(healthy) > 0:
+		return healthy
+	}
+	return p.backends
+}
+
+func (p *CorePool) maxTip() int64 {
+	var maxTip int64
+	for _, backend := range p.backends {
+		if ok, tip, _ := backend.state(); ok && tip > maxTip {
+			maxTip = tip
+		}
+	}
+	return maxTip
+}
+
+func mostAdvanced(backends []*coreBackend) *coreBackend {
+	best := backends[0]
+	_, bestTip, _ := best.state()
+	for _, backend := range backends[1:] {
+		if _, tip, _ := backend.state(); tip > bestTip {
+			best, bestTip = backend, tip
+		}
+	}
+	return best
+}
+
+// Keeps the pinned backend while it is a candidate, otherwise pins the
+// most advanced candidate.
+func (p *CorePool) pinnedBackend(candidates []*coreBackend) *coreBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, backend := range candidates {
+		if backend == p.pinned {
+			return backend
+		}
+	}
+	previous := p.pinned
+	p.pinned = mostAdvanced(candidates)
+	if previous != nil {
+		rootLogger.Warn(
+			"construction requests moved to another core rosetta backend",
+			"from", previous.url.Host,
+			"to", p.pinned.url.Host,
+		)
+	}
+	return p.pinned
+}
+
+// Checks every backend every interval until ctx is cancelled.
+func (p *CorePool) Start(ctx context.Context, interval time.Duration) {
+	for {
+		var wg sync.WaitGroup
+		for _, backend := range p.backends {
+			wg.Add(1)
+			go func(backend *coreBackend) {
+				defer wg.Done()
+				p.check(ctx, backend)
+			}(backend)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Healthy when the backend serves a network and reports its tip.
+func (p *CorePool) check(ctx context.Context, backend *coreBackend) {
+	tip, err := backendTip(ctx, backend.client)
+	if err != nil {
+		p.markUnhealthy(backend, err)
+		return
+	}
+	if backend.setHealthy(true, tip, nil) {
+		rootLogger.Info("core rosetta backend healthy", "backend", backend.url.Host, "tip", tip)
+	}
+}
+
+func backendTip(ctx context.Context, client *client.APIClient) (int64, error) {
+	list, clientErr, err := client.NetworkAPI.NetworkList(ctx, &types.MetadataRequest{})
+	if err == nil && len(list.NetworkIdentifiers) == 0 {
+		return 0, errors.New("core rosetta serves no networks")
+	}
+	if clientErr != nil {
+		return 0, errors.New(clientErr.Message)
+	}
+	if err != nil {
+		return 0, err
+	}
+	status, clientErr, err := client.NetworkAPI.NetworkStatus(ctx, &types.NetworkRequest{
+		NetworkIdentifier: list.NetworkIdentifiers[0],
+	})
+	if clientErr != nil {
+		return 0, errors.New(clientErr.Message)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return status.CurrentBlockIdentifier.Index, nil
+}
+
+// The state of every backend.
+func (p *CorePool) Status() []*CoreBackendStatus {
+	p.mu.Lock()
+	pinned := p.pinned
+	p.mu.Unlock()
+
+	maxTip := p.maxTip()
+	statuses := make([]*CoreBackendStatus, 0, len(p.backends))
+	for _, backend := range p.backends {
+		healthy, tip, err := backend.state()
+		status := &CoreBackendStatus{
+			// Credentials in the URL are not reported
+			URL:         backend.url.Scheme + "://" + backend.url.Host + backend.url.Path,
+			Healthy:     healthy,
+			Pinned:      backend == pinned,
+			CircuitOpen: backend.breaker.open(),
+		}
+		if healthy {
+			status.BlockLag = maxTip - tip
+		}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Nil if at least one backend is healthy and its circuit breaker closed.
+func (p *CorePool) Err() error {
+	for _, backend := range p.backends {
+		if healthy, _, _ := backend.state(); healthy && !backend.breaker.open() {
+			return nil
+		}
+	}
+	return errors.New("no healthy core rosetta backend")
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Returns a pool of two backends and the number of requests each received.
+func newTestCorePool(t *testing.T) (*CorePool, []*int) {
+	var counts []*int
+	var urls []string
+	for i := 0; i < 2; i++ {
+		count := new(int)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*count++
+		}))
+		t.Cleanup(server.Close)
+		counts = append(counts, count)
+		urls = append(urls, server.URL)
+	}
+	pool, err := NewCorePool(urls, nil, BalanceRoundRobin, DefaultCoreMaxBlockLag, DefaultUpstreamPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, counts
+}
+
+func sendCoreRequests(t *testing.T, pool *CorePool, ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, CorePoolURL+"/block", nil)
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestCorePoolAffinity(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      func() context.Context
+		expected []int
+	}{
+		{name: "round robin without affinity", ctx: context.Background, expected: []int{2, 2}},
+		{
+			name:     "one backend with affinity",
+			ctx:      func() context.Context { return WithCoreAffinity(context.Background(), "/block") },
+			expected: []int{0, 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool, counts := newTestCorePool(t)
+			sendCoreRequests(t, pool, test.ctx(), 4)
+			for i, count := range counts {
+				if *count != test.expected[i] {
+					t.Errorf("backend %d received %d requests, expected %d", i, *count, test.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCorePoolAffinityFailover(t *testing.T) {
+	pool, counts := newTestCorePool(t)
+	ctx := WithCoreAffinity(context.Background(), "/block")
+	sendCoreRequests(t, pool, ctx, 1)
+
+	// The affinity moves to the other backend once its own is unhealthy,
+	// and stays there
+	pool.markUnhealthy(pool.backends[1], nil)
+	sendCoreRequests(t, pool, ctx, 2)
+	pool.backends[1].setHealthy(true, 0, nil)
+	sendCoreRequests(t, pool, ctx, 2)
+	if *counts[0] != 4 || *counts[1] != 1 {
+		t.Errorf("backends received %d and %d requests, expected 4 and 1", *counts[0], *counts[1])
+	}
+}
+
+// A failing backend opens its own circuit breaker only, and stays out of
+// rotation while it is open, even once health checks pass again.
+func TestCorePoolBreakers(t *testing.T) {
+	var counts [2]int
+	var urls []string
+	for i := range counts {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[i]++
+			if i == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		t.Cleanup(server.Close)
+		urls = append(urls, server.URL)
+	}
+	pool, err := NewCorePool(urls, nil, BalanceRoundRobin, DefaultCoreMaxBlockLag, UpstreamPolicy{
+		Retries:          1,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			req, _ := http.NewRequest(http.MethodPost, CorePoolURL+"/block", nil)
+			resp, err := pool.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, expected the retry to fail over", resp.StatusCode)
+			}
+		}
+	}
+
+	send(4)
+	pool.backends[0].setHealthy(true, 0, nil)
+	send(2)
+	if counts[0] != 1 || counts[1] != 6 {
+		t.Errorf("backends received %d and %d requests, expected 1 and 6", counts[0], counts[1])
+	}
+	statuses := pool.Status()
+	if !statuses[0].CircuitOpen || statuses[1].CircuitOpen {
+		t.Errorf("circuit open %v and %v, expected true and false", statuses[0].CircuitOpen, statuses[1].CircuitOpen)
+	}
+	if err := pool.Err(); err != nil {
+		t.Errorf("pool unhealthy: %v", err)
+	}
+}
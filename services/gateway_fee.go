@@ -0,0 +1,214 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/parser"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Celo transactions may pay a fee to the full node that relayed them for a
+// light client (the gateway). In the Construction API it is given as a pair
+// of fee operations next to the transfer or swap: a debit of the sender and
+// a credit of the gateway, in the currency fees are paid in.
+type gatewayFee struct {
+	Payer     *common.Address
+	Recipient *common.Address
+	Amount    *big.Int
+	Currency  *types.Currency
+}
+
+// Separates the optional gateway fee operations from the other operations.
+func splitGatewayFee(ops []*types.Operation) ([]*types.Operation, *gatewayFee, error) {
+	var feeOps, otherOps []*types.Operation
+	for _, op := range ops {
+		if op.Type == OpFee {
+			feeOps = append(feeOps, op)
+		} else {
+			otherOps = append(otherOps, op)
+		}
+	}
+	if len(feeOps) == 0 {
+		return ops, nil, nil
+	}
+
+	descriptions := &parser.Descriptions{
+		OperationDescriptions: []*parser.OperationDescription{
+			{
+				Type:    OpFee,
+				Account: &parser.AccountDescription{Exists: true},
+				Amount: &parser.AmountDescription{
+					Exists: true,
+					Sign:   parser.NegativeAmountSign,
+				},
+			},
+			{
+				Type:    OpFee,
+				Account: &parser.AccountDescription{Exists: true},
+				Amount: &parser.AmountDescription{
+					Exists: true,
+					Sign:   parser.PositiveAmountSign,
+				},
+			},
+		},
+		OppositeAmounts: [][]int{{0, 1}},
+		ErrUnmatched:    true,
+	}
+	matches, err := parser.MatchOperations(descriptions, feeOps)
+	if err != nil {
+		return nil, nil, err
+	}
+	payerOp, _ := matches[0].First()
+	recipientOp, _ := matches[1].First()
+	if !currencyEqual(payerOp.Amount.Currency, recipientOp.Amount.Currency) {
+		return nil, nil, errors.New("gateway fee operations must be in the same currency")
+	}
+	payer, ok := rpc.ChecksumAddress(payerOp.Account.Address)
+	if !ok {
+		return nil, nil, errors.New("invalid gateway fee payer")
+	}
+	recipient, ok := rpc.ChecksumAddress(recipientOp.Account.Address)
+	if !ok {
+		return nil, nil, errors.New("invalid gateway fee recipient")
+	}
+	amount, ok := new(big.Int).SetString(recipientOp.Amount.Value, 10)
+	if !ok {
+		return nil, nil, errors.New("invalid gateway fee amount")
+	}
+	return otherOps, &gatewayFee{
+		Payer:     payer,
+		Recipient: recipient,
+		Amount:    amount,
+		Currency:  recipientOp.Amount.Currency,
+	}, nil
+}
+
+// Checks that fee, if any, is paid by the sender of the transaction.
+func (fee *gatewayFee) checkPayer(sender *common.Address) error {
+	if fee != nil && *fee.Payer != *sender {
+		return errors.New("the gateway fee must be paid by the sender")
+	}
+	return nil
+}
+
+// The currency fees of tx are paid in: cUSD if its fee currency is the
+// StableToken, CELO otherwise.
+func (st *StableToken) feeCurrency(feeCurrency *common.Address) *types.Currency {
+	if feeCurrency != nil && *feeCurrency == st.Address {
+		return CeloDollar
+	}
+	return CeloGold
+}
+
+// Sets the gateway fee of tx, which must be in the currency fees are paid in.
+func (s *ConstructionAPIService) setGatewayFee(tx *airgap.TxMetadata, fee *gatewayFee) error {
+	if fee == nil {
+		return nil
+	}
+	if !currencyEqual(fee.Currency, s.stableToken.feeCurrency(tx.FeeCurrency)) {
+		return errors.New("the gateway fee must be paid in the fee currency of the transaction")
+	}
+	tx.GatewayFeeRecipient = fee.Recipient
+	tx.GatewayFee = fee.Amount
+	return nil
+}
+
+// The fee operations paying the gateway fee of tx, if any, numbered from
+// index.
+func (s *ConstructionAPIService) gatewayFeeOps(tx *airgap.TxMetadata, index int64) []*types.Operation {
+	if tx.GatewayFeeRecipient == nil || tx.GatewayFee == nil || tx.GatewayFee.Sign() <= 0 {
+		return nil
+	}
+	currency := s.stableToken.feeCurrency(tx.FeeCurrency)
+	payerOp := newAtomicOp(tx.From, index, new(big.Int).Neg(tx.GatewayFee), nil, OpFee, nil)
+	payerOp.Amount = rpc.NewAmount(new(big.Int).Neg(tx.GatewayFee), currency)
+	recipientOp := newAtomicOp(
+		*tx.GatewayFeeRecipient, index+1, tx.GatewayFee, nil, OpFee,
+		[]*types.OperationIdentifier{{Index: index}},
+	)
+	recipientOp.Amount = rpc.NewAmount(tx.GatewayFee, currency)
+	return []*types.Operation{payerOp, recipientOp}
+}
+
+// Gateway fees paid in cUSD are moved with a Transfer log like any other,
+// so its operations are parsed as a transfer. Retypes the operations of
+// the log paying the gateway fee of tx as fee operations, related to each
+// other only. The fee is credited once the transaction has run, so its log
+// is the last Transfer of the gateway fee from the sender to the gateway.
+func (s *BlockAPIService) tagGatewayFee(tx *types.Transaction, nodeTx *nodeTransaction) {
+	if nodeTx.GatewayFeeRecipient == nil || nodeTx.GatewayFee == nil ||
+		s.stableToken.feeCurrency(nodeTx.FeeCurrency) != CeloDollar {
+		return
+	}
+	fee := (*big.Int)(nodeTx.GatewayFee)
+	opsByLog := make(map[int64][]*types.Operation)
+	var logIndexes []int64
+	for _, op := range tx.Operations {
+		index := op.OperationIdentifier.NetworkIndex
+		if index == nil || op.Type != OpTransfer {
+			continue
+		}
+		if _, ok := opsByLog[*index]; !ok {
+			logIndexes = append(logIndexes, *index)
+		}
+		opsByLog[*index] = append(opsByLog[*index], op)
+	}
+	var feeOps []*types.Operation
+	for i := len(logIndexes) - 1; i >= 0 && feeOps == nil; i-- {
+		if ops := opsByLog[logIndexes[i]]; isTransferOf(ops, nodeTx.From, *nodeTx.GatewayFeeRecipient, fee) {
+			feeOps = ops
+		}
+	}
+	if feeOps == nil {
+		return
+	}
+
+	isFee := make(map[int64]bool)
+	for _, op := range feeOps {
+		op.Type = OpFee
+		isFee[op.OperationIdentifier.Index] = true
+	}
+	for _, op := range tx.Operations {
+		var related []*types.OperationIdentifier
+		for _, id := range op.RelatedOperations {
+			if isFee[id.Index] == isFee[op.OperationIdentifier.Index] {
+				related = append(related, id)
+			}
+		}
+		if len(related) != len(op.RelatedOperations) {
+			op.RelatedOperations = related
+		}
+	}
+}
+
+// Whether ops, the operations of a Transfer log, move amount from sender
+// to recipient.
+func isTransferOf(ops []*types.Operation, sender common.Address, recipient common.Address, amount *big.Int) bool {
+	if len(ops) != 2 {
+		return false
+	}
+	debit, credit := ops[0], ops[1]
+	return debit.Amount != nil && credit.Amount != nil &&
+		debit.Amount.Value == new(big.Int).Neg(amount).String() &&
+		credit.Amount.Value == amount.String() &&
+		common.HexToAddress(debit.Account.Address) == sender &&
+		common.HexToAddress(credit.Account.Address) == recipient
+}
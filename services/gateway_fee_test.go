@@ -0,0 +1,109 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/celo-blockchain/common/hexutil"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+)
+
+func TestTagGatewayFee(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := common.HexToAddress("0xaa00000000000000000000000000000000000001")
+	payee := common.HexToAddress("0xbb00000000000000000000000000000000000002")
+	gateway := common.HexToAddress("0xcc00000000000000000000000000000000000003")
+	community := common.HexToAddress("0xdd00000000000000000000000000000000000004")
+	other := common.HexToAddress("0xee00000000000000000000000000000000000005")
+	tx1 := common.BigToHash(big.NewInt(1)).Hex()
+	op := opSummary
+
+	tests := []struct {
+		name        string
+		logs        []gethTypes.Log
+		feeCurrency *common.Address
+		noFee       bool
+		expected    []string
+	}{
+		{
+			name: "fee among the fee credits",
+			logs: []gethTypes.Log{
+				testTransferLog(0, 0, sender, payee, 10),
+				testTransferLog(0, 1, sender, gateway, 2),
+				testTransferLog(0, 2, sender, community, 1),
+			},
+			feeCurrency: &stableToken.Address,
+			expected: []string{
+				tx1,
+				op(0, OpTransfer, sender, "-10", 0), op(1, OpTransfer, payee, "10", 0, 0),
+				op(2, OpFee, sender, "-2", 1), op(3, OpFee, gateway, "2", 1, 2),
+				op(4, OpTransfer, sender, "-1", 2, 0, 1), op(5, OpTransfer, community, "1", 2, 0, 1, 4),
+			},
+		},
+		{
+			name: "payment of the fee amount to the gateway",
+			logs: []gethTypes.Log{
+				testTransferLog(0, 0, sender, gateway, 2),
+				testTransferLog(0, 1, sender, gateway, 2),
+			},
+			feeCurrency: &stableToken.Address,
+			expected: []string{
+				tx1,
+				op(0, OpTransfer, sender, "-2", 0), op(1, OpTransfer, gateway, "2", 0, 0),
+				op(2, OpFee, sender, "-2", 1), op(3, OpFee, gateway, "2", 1, 2),
+			},
+		},
+		{
+			name:        "fee amount to the gateway from another account",
+			logs:        []gethTypes.Log{testTransferLog(0, 0, other, gateway, 2)},
+			feeCurrency: &stableToken.Address,
+			expected:    []string{tx1, op(0, OpTransfer, other, "-2", 0), op(1, OpTransfer, gateway, "2", 0, 0)},
+		},
+		{
+			name:     "fee paid in CELO",
+			logs:     []gethTypes.Log{testTransferLog(0, 0, sender, gateway, 2)},
+			expected: []string{tx1, op(0, OpTransfer, sender, "-2", 0), op(1, OpTransfer, gateway, "2", 0, 0)},
+		},
+		{
+			name:        "no gateway fee",
+			logs:        []gethTypes.Log{testTransferLog(0, 0, sender, gateway, 2)},
+			feeCurrency: &stableToken.Address,
+			noFee:       true,
+			expected:    []string{tx1, op(0, OpTransfer, sender, "-2", 0), op(1, OpTransfer, gateway, "2", 0, 0)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &BlockAPIService{stableToken: stableToken}
+			nodeTx := &nodeTransaction{From: sender, FeeCurrency: test.feeCurrency}
+			if !test.noFee {
+				nodeTx.GatewayFeeRecipient = &gateway
+				nodeTx.GatewayFee = (*hexutil.Big)(big.NewInt(2))
+			}
+			transactions := transactionsFromLogs(test.logs)
+			s.tagGatewayFee(transactions[0], nodeTx)
+			if summary := summarizeTransactions(transactions); !reflect.DeepEqual(summary, test.expected) {
+				t.Errorf("transactions\n%v\nexpected\n%v", summary, test.expected)
+			}
+		})
+	}
+}
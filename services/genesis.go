@@ -0,0 +1,208 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/celo-org/celo-blockchain/common"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Transaction metadata key set on the synthetic genesis transaction
+	MetadataStableTokenGenesis = "stable_token_genesis"
+	// Sub-account of the StableToken contract holding the part of the
+	// initial supply that no known holder accounts for
+	SubAccountGenesisSupply = "genesis_supply"
+)
+
+// Identifier of the synthetic transaction holding the initial balances
+// that were set without a Transfer log when the StableToken was initialized.
+func genesisTxHash(blockHash string) string {
+	return fmt.Sprintf("%s-stable-token-genesis", blockHash)
+}
+
+// The account credited with the initial supply not held by known holders.
+func genesisSupplyAccount(stableToken *StableToken) *types.AccountIdentifier {
+	return &types.AccountIdentifier{
+		Address:    stableToken.Address.Hex(),
+		SubAccount: &types.SubAccountIdentifier{Address: SubAccountGenesisSupply},
+	}
+}
+
+func isGenesisSupplyAccount(account *types.AccountIdentifier, stableToken *StableToken) bool {
+	return account.SubAccount != nil &&
+		account.SubAccount.Address == SubAccountGenesisSupply &&
+		common.HexToAddress(account.Address) == stableToken.Address
+}
+
+// Builds the transactions for the StableToken activation block. Any balance
+// that the Transfer logs in that block do not account for is reported in a
+// synthetic transaction, as a mint or a burn, so that summing all operations
+// from genesis reproduces balanceOf for every account.
+func (s *BlockAPIService) activationTransactions(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	blockIdentifier *types.BlockIdentifier,
+	logs []gethTypes.Log,
+) ([]*types.Transaction, *types.Error) {
+	transactions := transactionsFromLogs(logs)
+	operations, clientErr := s.genesisOperations(ctx, networkId, blockIdentifier.Index, logs)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	if len(operations) == 0 {
+		return transactions, nil
+	}
+	genesis := &types.Transaction{
+		TransactionIdentifier: &types.TransactionIdentifier{Hash: genesisTxHash(blockIdentifier.Hash)},
+		Operations:            operations,
+		Metadata: map[string]interface{}{
+			MetadataStableTokenGenesis: true,
+		},
+	}
+	return append([]*types.Transaction{genesis}, transactions...), nil
+}
+
+// The operations of the synthetic genesis transaction of the activation
+// block, given its Transfer logs.
+//
+// Initial holders are the accounts seen in the logs plus StableToken.InitialHolders.
+// initialize() emits no log naming the others, so whatever part of the total
+// supply their balances do not add up to is minted to the genesis supply
+// sub-account of the StableToken contract.
+func (s *BlockAPIService) genesisOperations(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	index int64,
+	logs []gethTypes.Log,
+) ([]*types.Operation, *types.Error) {
+	blockNumber := new(big.Int).SetInt64(index)
+
+	// The contract does not exist before activation, so the logs in this block are the whole history
+	logged := make(map[common.Address]*big.Int)
+	credit := func(addr common.Address, value *big.Int) {
+		if addr == ZeroAddress {
+			return
+		}
+		if _, ok := logged[addr]; !ok {
+			logged[addr] = new(big.Int)
+		}
+		logged[addr].Add(logged[addr], value)
+	}
+	for _, transferLog := range logs {
+		if transferLog.Removed {
+			continue
+		}
+		from := common.HexToAddress(transferLog.Topics[1].Hex())
+		to := common.HexToAddress(transferLog.Topics[2].Hex())
+		value := new(big.Int).SetBytes(transferLog.Data)
+		credit(from, new(big.Int).Neg(value))
+		credit(to, value)
+	}
+	for _, addr := range s.stableToken.InitialHolders {
+		credit(addr, new(big.Int))
+	}
+
+	// Sort for deterministic operation ordering
+	holders := make([]common.Address, 0, len(logged))
+	for addr := range logged {
+		holders = append(holders, addr)
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		return holders[i].Hex() < holders[j].Hex()
+	})
+
+	operations := []*types.Operation{}
+	// A mint for a positive value, a burn for a negative one
+	addOp := func(addr common.Address, value *big.Int) *types.Operation {
+		opType := OpMint
+		if value.Sign() < 0 {
+			opType = OpBurn
+		}
+		op := newAtomicOp(addr, int64(len(operations)), value, &OpSuccess, opType, nil)
+		operations = append(operations, op)
+		return op
+	}
+	balancesSum := new(big.Int)
+	for _, addr := range holders {
+		balance, _, clientErr := callStableTokenUint(
+			ctx, s.client, networkId, "balanceOf", []interface{}{addr.Hex()}, blockNumber,
+		)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		balancesSum.Add(balancesSum, balance)
+		if unlogged := new(big.Int).Sub(balance, logged[addr]); unlogged.Sign() != 0 {
+			addOp(addr, unlogged)
+		}
+	}
+
+	totalSupply, _, clientErr := callStableTokenUint(ctx, s.client, networkId, "totalSupply", nil, blockNumber)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	if unaccounted := new(big.Int).Sub(totalSupply, balancesSum); unaccounted.Sign() != 0 {
+		loggerFrom(ctx).Warn(
+			"StableToken genesis: part of the total supply is held by accounts outside of InitialHolders",
+			"block_index", index,
+			"unaccounted", unaccounted,
+		)
+		op := addOp(s.stableToken.Address, unaccounted)
+		op.Account = genesisSupplyAccount(s.stableToken)
+	}
+	return operations, nil
+}
+
+// The balance of the genesis supply sub-account, which does not change
+// after the activation block.
+func (s *BlockAPIService) genesisSupply(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+) (*big.Int, *types.Error) {
+	s.genesisMu.Lock()
+	defer s.genesisMu.Unlock()
+	if s.genesisBalance != nil {
+		return s.genesisBalance, nil
+	}
+
+	index := s.stableToken.BlockThreshold
+	logs, clientErr := s.transferLogs(ctx, index, index, networkId)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	operations, clientErr := s.genesisOperations(ctx, networkId, index, logs)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	balance := new(big.Int)
+	for _, op := range operations {
+		if op.Account.SubAccount == nil {
+			continue
+		}
+		value, ok := new(big.Int).SetString(op.Amount.Value, 10)
+		if !ok {
+			return nil, ErrInternal
+		}
+		balance.Add(balance, value)
+	}
+	s.genesisBalance = balance
+	return balance, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// A core rosetta server answering celo_getLogs with logs, balanceOf with
+// balances and totalSupply with totalSupply. Counts the requests in calls.
+func newTestTokenCore(
+	t *testing.T,
+	logs []gethTypes.Log,
+	balances map[common.Address]int64,
+	totalSupply int64,
+	calls *int32,
+) *BlockAPIService {
+	block := &types.BlockIdentifier{Index: 100, Hash: "0x64"}
+	coreClient := newTestCore(t, func(path string, body []byte) interface{} {
+		atomic.AddInt32(calls, 1)
+		var request types.CallRequest
+		if err := json.Unmarshal(body, &request); err != nil || path != "/call" {
+			t.Errorf("unexpected core request %s: %s", path, body)
+			return ErrInternal
+		}
+		if request.Method == "celo_getLogs" {
+			result, err := airgap.MarshallToMap(&rpc.CallLogsResult{Logs: logs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &types.CallResponse{Result: result}
+		}
+		var params airgap.CallParams
+		if err := airgap.UnmarshallFromMap(request.Parameters, &params); err != nil {
+			t.Fatal(err)
+		}
+		// balanceOf is the only method called with an argument
+		if len(params.Args) == 0 {
+			return testCallResponse(t, totalSupply, block)
+		}
+		return testCallResponse(t, balances[common.HexToAddress(fmt.Sprint(params.Args[0]))], block)
+	})
+	stableToken := &StableToken{BlockThreshold: 100, Address: common.HexToAddress("0x7e")}
+	return NewBlockAPIService(coreClient, nil, stableToken)
+}
+
+func TestGenesisOperations(t *testing.T) {
+	a := common.HexToAddress("0xaa00000000000000000000000000000000000001")
+	b := common.HexToAddress("0xbb00000000000000000000000000000000000002")
+	token := common.HexToAddress("0x7e").Hex()
+
+	tests := []struct {
+		name           string
+		logs           []gethTypes.Log
+		initialHolders []common.Address
+		balances       map[common.Address]int64
+		totalSupply    int64
+		// Type, account and amount of each operation
+		expected      []string
+		genesisSupply string
+	}{
+		{
+			name:          "balances logged",
+			logs:          []gethTypes.Log{testTransferLog(0, 0, ZeroAddress, a, 10)},
+			balances:      map[common.Address]int64{a: 10},
+			totalSupply:   10,
+			expected:      []string{},
+			genesisSupply: "0",
+		},
+		{
+			name:           "unlogged initial balance",
+			logs:           []gethTypes.Log{testTransferLog(0, 0, ZeroAddress, a, 10)},
+			initialHolders: []common.Address{b},
+			balances:       map[common.Address]int64{a: 10, b: 5},
+			totalSupply:    15,
+			expected:       []string{"mint " + b.Hex() + " 5"},
+			genesisSupply:  "0",
+		},
+		{
+			name:          "balance below the logged one",
+			logs:          []gethTypes.Log{testTransferLog(0, 0, ZeroAddress, a, 10), testTransferLog(0, 1, a, b, 4)},
+			balances:      map[common.Address]int64{a: 3, b: 4},
+			totalSupply:   7,
+			expected:      []string{"burn " + a.Hex() + " -3"},
+			genesisSupply: "0",
+		},
+		{
+			name:          "supply of unknown holders",
+			logs:          []gethTypes.Log{testTransferLog(0, 0, ZeroAddress, a, 10)},
+			balances:      map[common.Address]int64{a: 10},
+			totalSupply:   25,
+			expected:      []string{"mint " + token + "/" + SubAccountGenesisSupply + " 15"},
+			genesisSupply: "15",
+		},
+		{
+			name:          "no logs",
+			balances:      map[common.Address]int64{a: 10},
+			totalSupply:   25,
+			expected:      []string{"mint " + token + "/" + SubAccountGenesisSupply + " 25"},
+			genesisSupply: "25",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			s := newTestTokenCore(t, tt.logs, tt.balances, tt.totalSupply, &calls)
+			s.stableToken.InitialHolders = tt.initialHolders
+			network := &types.NetworkIdentifier{Blockchain: "celo", Network: "test"}
+
+			operations, clientErr := s.genesisOperations(context.Background(), network, 100, tt.logs)
+			if clientErr != nil {
+				t.Fatal(clientErr.Message)
+			}
+			summary := []string{}
+			for i, op := range operations {
+				if op.OperationIdentifier.Index != int64(i) {
+					t.Errorf("operation %d has index %d", i, op.OperationIdentifier.Index)
+				}
+				account := op.Account.Address
+				if op.Account.SubAccount != nil {
+					account += "/" + op.Account.SubAccount.Address
+				}
+				summary = append(summary, fmt.Sprintf("%s %s %s", op.Type, account, op.Amount.Value))
+			}
+			if !reflect.DeepEqual(summary, tt.expected) {
+				t.Errorf("operations %v, expected %v", summary, tt.expected)
+			}
+
+			// Read once, from the logs of the activation block
+			for i := 0; i < 2; i++ {
+				atomic.StoreInt32(&calls, 0)
+				supply, clientErr := s.genesisSupply(context.Background(), network)
+				if clientErr != nil {
+					t.Fatal(clientErr.Message)
+				}
+				if supply.String() != tt.genesisSupply {
+					t.Errorf("genesis supply %s, expected %s", supply, tt.genesisSupply)
+				}
+				if i == 1 && atomic.LoadInt32(&calls) != 0 {
+					t.Error("genesis supply read again")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Default for the largest acceptable delay between the chain tip and wall-clock
+	DefaultMaxSyncLag = 1 * time.Minute
+
+	// Upper bound on the upstream calls made by a readiness or sync probe
+	probeTimeout = 5 * time.Second
+
+	checkOK = "ok"
+)
+
+// Liveness report served on /health.
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// Readiness report served on /ready.
+type ReadinessResponse struct {
+	Ready    bool                       `json:"ready"`
+	Networks []*types.NetworkIdentifier `json:"network_identifiers,omitempty"`
+	Backends []*CoreBackendStatus       `json:"core_backends,omitempty"`
+	// Result of each readiness check, "ok" or the reason it failed
+	Checks map[string]string `json:"checks"`
+}
+
+// Sync report served on /sync.
+type SyncResponse struct {
+	Synced                 bool                   `json:"synced"`
+	CurrentBlockIdentifier *types.BlockIdentifier `json:"current_block_identifier,omitempty"`
+	CurrentBlockTimestamp  int64                  `json:"current_block_timestamp,omitempty"`
+	LagSeconds             float64                `json:"lag_seconds"`
+	MaxLagSeconds          float64                `json:"max_lag_seconds"`
+	SyncStatus             *types.SyncStatus      `json:"sync_status,omitempty"`
+	Error                  string                 `json:"error,omitempty"`
+}
+
+// Serves the /health, /ready and /sync probes. They answer with 200 when
+// healthy and 503 otherwise, so that they can be used by load balancers.
+type HealthService struct {
+	client  *client.APIClient
+	monitor *CoreMonitor
+	pool    *CorePool
+	maxLag  time.Duration
+
+	mu          sync.RWMutex
+	stableToken *StableToken
+}
+
+func NewHealthService(
+	client *client.APIClient,
+	monitor *CoreMonitor,
+	pool *CorePool,
+	maxLag time.Duration,
+) *HealthService {
+	return &HealthService{
+		client:  client,
+		monitor: monitor,
+		pool:    pool,
+		maxLag:  maxLag,
+	}
+}
+
+// Records the StableToken resolved once core rosetta has been discovered.
+func (h *HealthService) SetStableToken(stableToken *StableToken) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stableToken = stableToken
+}
+
+func (h *HealthService) getStableToken() *StableToken {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.stableToken
+}
+
+// Returns the handler for path if it is one of the probes.
+func (h *HealthService) handlerFor(path string) (http.HandlerFunc, bool) {
+	switch path {
+	case "/health":
+		return h.Health, true
+	case "/ready":
+		return h.Ready, true
+	case "/sync":
+		return h.Sync, true
+	}
+	return nil, false
+}
+
+// endpoint: /health
+func (h *HealthService) Health(w http.ResponseWriter, r *http.Request) {
+	encodeJSONResponse(w, http.StatusOK, &HealthResponse{Status: checkOK})
+}
+
+// endpoint: /ready
+//
+// Ready once core rosetta is reachable, serves the networks it served at
+// startup, and the StableToken can be called on the first of them. The
+// state of each core rosetta backend is reported along with the checks.
+func (h *HealthService) Ready(w http.ResponseWriter, r *http.Request) {
+	networks := h.monitor.Networks()
+	resp := &ReadinessResponse{
+		Ready:    true,
+		Networks: networks,
+		Checks:   make(map[string]string),
+	}
+	fail := func(check string, err error) {
+		resp.Ready = false
+		resp.Checks[check] = err.Error()
+	}
+
+	if err := h.monitor.Err(); err != nil {
+		fail("core", err)
+	} else {
+		resp.Checks["core"] = checkOK
+	}
+	if h.pool != nil {
+		resp.Backends = h.pool.Status()
+		if err := h.pool.Err(); err != nil {
+			fail("core_backends", err)
+		} else {
+			resp.Checks["core_backends"] = checkOK
+		}
+	}
+
+	stableToken := h.getStableToken()
+	switch {
+	case stableToken == nil:
+		fail("stable_token", errors.New("StableToken not resolved"))
+	case len(networks) == 0:
+		fail("stable_token", errCoreNotDiscovered)
+	default:
+		ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+		defer cancel()
+		_, _, clientErr := callStableTokenUint(ctx, h.client, networks[0], "totalSupply", nil, nil)
+		if clientErr != nil {
+			fail("stable_token", errors.New(clientErr.Message))
+		} else {
+			resp.Checks["stable_token"] = checkOK
+		}
+	}
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	encodeJSONResponse(w, status, resp)
+}
+
+// endpoint: /sync
+//
+// Synced if the timestamp of the tip reported by core rosetta is within
+// the configured lag of wall-clock time.
+func (h *HealthService) Sync(w http.ResponseWriter, r *http.Request) {
+	resp := &SyncResponse{
+		MaxLagSeconds: h.maxLag.Seconds(),
+	}
+	networks := h.monitor.Networks()
+	if len(networks) == 0 {
+		resp.Error = errCoreNotDiscovered.Error()
+		encodeJSONResponse(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	status, clientErr, err := h.client.NetworkAPI.NetworkStatus(ctx, &types.NetworkRequest{
+		NetworkIdentifier: networks[0],
+	})
+	if err != nil {
+		resp.Error = err.Error()
+		if clientErr != nil {
+			resp.Error = clientErr.Message
+		}
+		encodeJSONResponse(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	// Rosetta timestamps are in milliseconds
+	lag := time.Since(time.Unix(0, status.CurrentBlockTimestamp*int64(time.Millisecond)))
+	if lag < 0 {
+		lag = 0
+	}
+	resp.CurrentBlockIdentifier = status.CurrentBlockIdentifier
+	resp.CurrentBlockTimestamp = status.CurrentBlockTimestamp
+	resp.SyncStatus = status.SyncStatus
+	resp.LagSeconds = lag.Seconds()
+	resp.Synced = lag <= h.maxLag
+
+	code := http.StatusOK
+	if !resp.Synced {
+		code = http.StatusServiceUnavailable
+	}
+	encodeJSONResponse(w, code, resp)
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func TestHealthProbes(t *testing.T) {
+	testNetwork := &types.NetworkIdentifier{Blockchain: "celo", Network: "test"}
+	tip := &types.BlockIdentifier{Index: 100, Hash: "0x64"}
+
+	tests := []struct {
+		name string
+		// Whether core has been discovered
+		discovered  bool
+		stableToken bool
+		// Answers of core to /call and /network/status
+		call   interface{}
+		status interface{}
+
+		health, ready, sync int
+	}{
+		{
+			name:   "core not discovered",
+			health: http.StatusOK, ready: http.StatusServiceUnavailable, sync: http.StatusServiceUnavailable,
+		},
+		{
+			name:        "synced",
+			discovered:  true,
+			stableToken: true,
+			call:        testCallResponse(t, 1000, tip),
+			status:      &types.NetworkStatusResponse{CurrentBlockIdentifier: tip, CurrentBlockTimestamp: time.Now().Unix() * 1000},
+			health:      http.StatusOK, ready: http.StatusOK, sync: http.StatusOK,
+		},
+		{
+			name:        "lagging",
+			discovered:  true,
+			stableToken: true,
+			call:        testCallResponse(t, 1000, tip),
+			status:      &types.NetworkStatusResponse{CurrentBlockIdentifier: tip, CurrentBlockTimestamp: time.Now().Add(-time.Hour).Unix() * 1000},
+			health:      http.StatusOK, ready: http.StatusOK, sync: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "StableToken not resolved",
+			discovered: true,
+			call:       testCallResponse(t, 1000, tip),
+			status:     &types.NetworkStatusResponse{CurrentBlockIdentifier: tip, CurrentBlockTimestamp: time.Now().Unix() * 1000},
+			health:     http.StatusOK, ready: http.StatusServiceUnavailable, sync: http.StatusOK,
+		},
+		{
+			name:        "core failing",
+			discovered:  true,
+			stableToken: true,
+			call:        ErrCoreUnavailable,
+			status:      ErrCoreUnavailable,
+			health:      http.StatusOK, ready: http.StatusServiceUnavailable, sync: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coreClient := newTestCore(t, func(path string, body []byte) interface{} {
+				switch path {
+				case "/network/list":
+					return &types.NetworkListResponse{NetworkIdentifiers: []*types.NetworkIdentifier{testNetwork}}
+				case "/call":
+					return tt.call
+				case "/network/status":
+					return tt.status
+				}
+				t.Errorf("unexpected core request %s", path)
+				return ErrInternal
+			})
+			monitor := NewCoreMonitor(coreClient)
+			if tt.discovered {
+				if err := monitor.check(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			health := NewHealthService(coreClient, monitor, nil, DefaultMaxSyncLag)
+			if tt.stableToken {
+				health.SetStableToken(&StableToken{})
+			}
+
+			for path, expected := range map[string]int{"/health": tt.health, "/ready": tt.ready, "/sync": tt.sync} {
+				handler, ok := health.handlerFor(path)
+				if !ok {
+					t.Fatalf("no handler for %s", path)
+				}
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != expected {
+					t.Errorf("%s: status %d, expected %d: %s", path, w.Code, expected, w.Body)
+				}
+				if contentType := w.Header().Get("Content-Type"); contentType != "application/json; charset=UTF-8" {
+					t.Errorf("%s: content type %q", path, contentType)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Sender of the operations built by the helpers below
+var testAccount = common.HexToAddress("0x000000000000000000000000000000000000dEaD")
+
+// A cUSD transfer of value from from to to.
+func transferOps(from, to common.Address, value string) []*types.Operation {
+	return []*types.Operation{
+		{
+			OperationIdentifier: &types.OperationIdentifier{Index: 0},
+			Type:                OpTransfer,
+			Account:             &types.AccountIdentifier{Address: from.Hex()},
+			Amount:              &types.Amount{Value: value, Currency: CeloDollar},
+		},
+		{
+			OperationIdentifier: &types.OperationIdentifier{Index: 1},
+			RelatedOperations:   []*types.OperationIdentifier{{Index: 0}},
+			Type:                OpTransfer,
+			Account:             &types.AccountIdentifier{Address: to.Hex()},
+			Amount:              &types.Amount{Value: value, Currency: CeloDollar},
+		},
+	}
+}
+
+// Leg index of a swap of account, the second leg relating to the first.
+func swapOp(index int64, account common.Address, value string, currency *types.Currency) *types.Operation {
+	op := &types.Operation{
+		OperationIdentifier: &types.OperationIdentifier{Index: index},
+		Type:                OpSwap,
+		Account:             &types.AccountIdentifier{Address: account.Hex()},
+		Amount:              &types.Amount{Value: value, Currency: currency},
+	}
+	if index > 0 {
+		op.RelatedOperations = []*types.OperationIdentifier{{Index: 0}}
+	}
+	return op
+}
+
+// An approval by testAccount of spender.
+func approveOp(spender common.Address, value string, currency *types.Currency) *types.Operation {
+	return &types.Operation{
+		OperationIdentifier: &types.OperationIdentifier{Index: 0},
+		Type:                OpApprove,
+		Account:             &types.AccountIdentifier{Address: testAccount.Hex()},
+		Metadata: map[string]interface{}{
+			MetadataSpender: spender.Hex(),
+			MetadataAmount:  &types.Amount{Value: value, Currency: currency},
+		},
+	}
+}
+
+// Operations as JSON, to compare them regardless of how their metadata is typed.
+func operationsJSON(t *testing.T, ops []*types.Operation) string {
+	encoded, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
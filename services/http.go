@@ -0,0 +1,49 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Helpers for the non-Rosetta endpoints served alongside the generated controllers.
+
+func encodeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		rootLogger.Error("could not encode response", "error", err)
+	}
+}
+
+func decodeJSONRequest(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// Writes a Rosetta style error body, with the cause as its description.
+func encodeErrorResponse(w http.ResponseWriter, status int, rosettaErr *types.Error, cause error) {
+	resp := *rosettaErr
+	if cause != nil {
+		description := cause.Error()
+		resp.Description = &description
+	}
+	encodeJSONResponse(w, status, &resp)
+}
@@ -0,0 +1,475 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/celo-org/celo-blockchain/common"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/celo-org/celo-blockchain/crypto"
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// The StableToken stores balances in internal units and converts them to
+// value (what balanceOf, Transfer logs and this module report) with an
+// inflation factor. While inflation is disabled (rate and factor both equal
+// to FixidityLib's fixed1) units and value are the same. Once it is enabled,
+// balances change without any Transfer log whenever the factor is updated,
+// which the StableToken announces with an InflationFactorUpdated event; the
+// InflationTracker reports those changes as explicit adjustment operations.
+
+const (
+	// Block metadata key holding the inflation parameters when they change
+	MetadataInflationParameters = "inflation_parameters"
+	// Transaction metadata key set on the synthetic adjustment transaction
+	MetadataInflationAdjustment = "inflation_adjustment"
+	// Adjustment transaction metadata key holding the number of holders whose
+	// balance was read, and so the bound of the rounding of the adjustments
+	MetadataInflationHolders = "inflation_holders"
+
+	DefaultInflationCacheSize = 256
+
+	// Blocks whose Transfer logs are read at once when listing holders
+	holderScanBlocks = 10000
+	// Concurrent balance requests to core rosetta when adjusting holders
+	inflationConcurrency = 16
+)
+
+var (
+	// FixidityLib.fixed1()
+	fixed1 = new(big.Int).Exp(big.NewInt(10), big.NewInt(24), nil)
+
+	// Number of blocks whose parameters an InflationTracker caches; set it before creating services
+	InflationCacheSize = DefaultInflationCacheSize
+)
+
+// Values returned by StableToken.getInflationParameters
+type InflationParameters struct {
+	Rate              *big.Int `json:"rate"`
+	Factor            *big.Int `json:"factor"`
+	UpdatePeriod      *big.Int `json:"update_period"`
+	FactorLastUpdated *big.Int `json:"factor_last_updated"`
+}
+
+// Parameters in effect before the StableToken is deployed
+func defaultInflationParameters() *InflationParameters {
+	return &InflationParameters{
+		Rate:              new(big.Int).Set(fixed1),
+		Factor:            new(big.Int).Set(fixed1),
+		UpdatePeriod:      new(big.Int),
+		FactorLastUpdated: new(big.Int),
+	}
+}
+
+// StableToken events changing the inflation parameters, by name, with the
+// parameters they carry in order
+var inflationEventFields = map[string][]string{
+	"InflationFactorUpdated":     {"factor", "factor_last_updated"},
+	"InflationParametersUpdated": {"rate", "update_period", "factor_last_updated"},
+}
+
+// Names of the events in inflationEventFields, in the order their logs are fetched
+var inflationEvents = []string{"InflationFactorUpdated", "InflationParametersUpdated"}
+
+// Fetches the StableToken Transfer logs emitted in blocks [fromBlock, toBlock]
+type transferLogSource func(
+	ctx context.Context,
+	fromBlock int64,
+	toBlock int64,
+	networkId *types.NetworkIdentifier,
+) ([]gethTypes.Log, *types.Error)
+
+// Tracks StableToken inflation parameters per block and computes the
+// balance adjustments of the blocks changing them.
+type InflationTracker struct {
+	client       *client.APIClient
+	stableToken  *StableToken
+	transferLogs transferLogSource
+
+	mu     sync.Mutex
+	params map[int64]*InflationParameters
+
+	holdersMu sync.Mutex
+	// Accounts seen in the Transfer logs up to scanned, and the initial holders
+	holders map[common.Address]bool
+	scanned int64
+}
+
+func NewInflationTracker(
+	client *client.APIClient,
+	stableToken *StableToken,
+	transferLogs transferLogSource,
+) *InflationTracker {
+	return &InflationTracker{
+		client:       client,
+		stableToken:  stableToken,
+		transferLogs: transferLogs,
+		params:       make(map[int64]*InflationParameters),
+	}
+}
+
+// Returns the inflation parameters stored by the StableToken at blockIndex.
+func (t *InflationTracker) Parameters(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	blockIndex int64,
+) (*InflationParameters, *types.Error) {
+	if !t.stableToken.DeployedAt(blockIndex) {
+		return defaultInflationParameters(), nil
+	}
+	t.mu.Lock()
+	cached, ok := t.params[blockIndex]
+	t.mu.Unlock()
+	recordCacheLookup("inflation_parameters", ok)
+	if ok {
+		return cached, nil
+	}
+
+	result, clientErr := celoCall(
+		ctx,
+		t.client,
+		networkId,
+		"StableToken.getInflationParameters",
+		nil,
+		new(big.Int).SetInt64(blockIndex),
+	)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	outputs, err := t.stableToken.ABI.Methods["getInflationParameters"].Outputs.UnpackValues(result.Raw)
+	if err != nil || len(outputs) != 4 {
+		loggerFrom(ctx).Error("could not unpack inflation parameters", "block_index", blockIndex, "error", err)
+		return nil, ErrInternal
+	}
+	values := make([]*big.Int, len(outputs))
+	for i, output := range outputs {
+		value, ok := output.(*big.Int)
+		if !ok {
+			loggerFrom(ctx).Error("unexpected inflation parameter type", "type", fmt.Sprintf("%T", output))
+			return nil, ErrInternal
+		}
+		values[i] = value
+	}
+	params := &InflationParameters{
+		Rate:              values[0],
+		Factor:            values[1],
+		UpdatePeriod:      values[2],
+		FactorLastUpdated: values[3],
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.params) >= InflationCacheSize {
+		for index := range t.params {
+			delete(t.params, index)
+			break
+		}
+	}
+	t.params[blockIndex] = params
+	return params, nil
+}
+
+// Decodes the parameters set by the inflation event logs of a block, in log
+// order, as block metadata values.
+func inflationChanges(logs []gethTypes.Log) (map[string]interface{}, error) {
+	sorted := make([]gethTypes.Log, len(logs))
+	copy(sorted, logs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Index < sorted[j].Index
+	})
+	changes := make(map[string]interface{})
+	for _, inflationLog := range sorted {
+		if inflationLog.Removed || len(inflationLog.Topics) == 0 {
+			continue
+		}
+		fields, ok := inflationEventFields[inflationEventName(inflationLog.Topics[0])]
+		if !ok {
+			return nil, fmt.Errorf("unexpected log topic %s", inflationLog.Topics[0].Hex())
+		}
+		if len(inflationLog.Data) != 32*len(fields) {
+			return nil, fmt.Errorf("unexpected log data length %d", len(inflationLog.Data))
+		}
+		for i, field := range fields {
+			changes[field] = new(big.Int).SetBytes(inflationLog.Data[32*i : 32*(i+1)]).String()
+		}
+	}
+	return changes, nil
+}
+
+// Name of the inflation event whose signature hash is topic, if any.
+func inflationEventName(topic common.Hash) string {
+	for _, name := range inflationEvents {
+		if inflationEventTopic(name) == topic {
+			return name
+		}
+	}
+	return ""
+}
+
+// The topic of the logs of the inflation event name.
+func inflationEventTopic(name string) common.Hash {
+	types := strings.TrimSuffix(strings.Repeat("uint256,", len(inflationEventFields[name])), ",")
+	return crypto.Keccak256Hash([]byte(name + "(" + types + ")"))
+}
+
+// Returns the accounts that may hold cUSD at toBlock: those of the Transfer
+// logs since the activation, and StableToken.InitialHolders. Logs are read
+// incrementally, the last watcherReorgDepth blocks of the previous scan again
+// as they may have been replaced since. Accounts only join the set, so for an
+// earlier toBlock it may include accounts holding nothing yet.
+func (t *InflationTracker) Holders(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	toBlock int64,
+) ([]common.Address, *types.Error) {
+	t.holdersMu.Lock()
+	defer t.holdersMu.Unlock()
+	if t.holders == nil {
+		t.holders = make(map[common.Address]bool)
+		for _, addr := range t.stableToken.InitialHolders {
+			t.holders[addr] = true
+		}
+		t.scanned = t.stableToken.BlockThreshold - 1
+	}
+
+	fromBlock := t.scanned - watcherReorgDepth + 1
+	if fromBlock < t.stableToken.BlockThreshold {
+		fromBlock = t.stableToken.BlockThreshold
+	}
+	for ; fromBlock <= toBlock; fromBlock += holderScanBlocks {
+		endBlock := fromBlock + holderScanBlocks - 1
+		if endBlock > toBlock {
+			endBlock = toBlock
+		}
+		logs, clientErr := t.transferLogs(ctx, fromBlock, endBlock, networkId)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		for _, transferLog := range logs {
+			if len(transferLog.Topics) < 3 {
+				continue
+			}
+			for _, topic := range transferLog.Topics[1:3] {
+				if addr := common.HexToAddress(topic.Hex()); addr != ZeroAddress {
+					t.holders[addr] = true
+				}
+			}
+		}
+		if endBlock > t.scanned {
+			t.scanned = endBlock
+		}
+	}
+
+	holders := make([]common.Address, 0, len(t.holders))
+	for addr := range t.holders {
+		holders = append(holders, addr)
+	}
+	return holders, nil
+}
+
+// Returns a synthetic transaction adjusting the accounts whose balance change
+// in the block is not explained by transactions, and the block metadata
+// holding the inflation parameters the block changed, both derived from the
+// inflation event logs of the block. Without such logs, the parameters are
+// unchanged and nothing is read from the chain.
+//
+// Balances only move without a Transfer log when the inflation factor
+// changes, for every holder, so every account listed by Holders is checked,
+// along with those with operations in the block. Each balance is rounded
+// down separately from totalSupply(), so the adjustments add up to its change
+// within one unit per holder; the adjustment transaction metadata holds the
+// number of accounts checked.
+func (t *InflationTracker) Adjustments(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	blockIdentifier *types.BlockIdentifier,
+	transactions []*types.Transaction,
+	logs []gethTypes.Log,
+) (*types.Transaction, map[string]interface{}, *types.Error) {
+	ctx, span := startSpan(ctx, "InflationTracker.Adjustments")
+	defer span.Finish()
+	if len(logs) == 0 {
+		return nil, nil, nil
+	}
+	index := blockIdentifier.Index
+	changes, err := inflationChanges(logs)
+	if err != nil {
+		loggerFrom(ctx).Error("could not decode inflation logs", "block_index", index, "error", err)
+		return nil, nil, ErrInternal
+	}
+	if len(changes) == 0 {
+		return nil, nil, nil
+	}
+	metadata := map[string]interface{}{
+		MetadataInflationParameters: changes,
+	}
+
+	// Updates of the last update time alone leave balances unchanged
+	factor, ok := changes["factor"]
+	if !ok {
+		return nil, metadata, nil
+	}
+	previous, clientErr := t.Parameters(ctx, networkId, index-1)
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	if factor == previous.Factor.String() {
+		return nil, metadata, nil
+	}
+
+	// Net effect of the block's operations on each account
+	deltas := make(map[common.Address]*big.Int)
+	for _, tx := range transactions {
+		for _, op := range tx.Operations {
+			if op.Account == nil || op.Amount == nil || op.Account.SubAccount != nil {
+				continue
+			}
+			addr := common.HexToAddress(op.Account.Address)
+			if _, ok := deltas[addr]; !ok {
+				deltas[addr] = new(big.Int)
+			}
+			if op.Status != OpSuccess.Status {
+				continue
+			}
+			value, ok := new(big.Int).SetString(op.Amount.Value, 10)
+			if !ok {
+				return nil, nil, ErrInternal
+			}
+			deltas[addr].Add(deltas[addr], value)
+		}
+	}
+	holders, clientErr := t.Holders(ctx, networkId, index-1)
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	for _, addr := range holders {
+		if _, ok := deltas[addr]; !ok {
+			deltas[addr] = new(big.Int)
+		}
+	}
+	accounts := make([]common.Address, 0, len(deltas))
+	for addr := range deltas {
+		accounts = append(accounts, addr)
+	}
+	// Sort for deterministic operation ordering
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Hex() < accounts[j].Hex()
+	})
+
+	adjustments, clientErr := t.balanceAdjustments(ctx, networkId, index, accounts, deltas)
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	operations := []*types.Operation{}
+	for i, addr := range accounts {
+		if adjustments[i].Sign() == 0 {
+			continue
+		}
+		operations = append(operations, newAtomicOp(addr, int64(len(operations)), adjustments[i], &OpSuccess, OpInflation, nil))
+	}
+	if len(operations) == 0 {
+		return nil, metadata, nil
+	}
+
+	return &types.Transaction{
+		TransactionIdentifier: &types.TransactionIdentifier{Hash: inflationTxHash(blockIdentifier.Hash)},
+		Operations:            operations,
+		Metadata: map[string]interface{}{
+			MetadataInflationAdjustment: true,
+			MetadataInflationHolders:    len(accounts),
+		},
+	}, metadata, nil
+}
+
+// The change of the balance of each of accounts in block index that deltas,
+// the effect of the block's operations, do not explain. Balances are read
+// with up to inflationConcurrency concurrent requests.
+func (t *InflationTracker) balanceAdjustments(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	index int64,
+	accounts []common.Address,
+	deltas map[common.Address]*big.Int,
+) ([]*big.Int, *types.Error) {
+	blockNumber := new(big.Int).SetInt64(index)
+	previousBlockNumber := new(big.Int).SetInt64(index - 1)
+	adjustments := make([]*big.Int, len(accounts))
+	// Cancelled on the first error, so that no more balances are read
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr *types.Error
+	fail := func(clientErr *types.Error) {
+		errOnce.Do(func() {
+			firstErr = clientErr
+			cancel()
+		})
+	}
+	sem := make(chan struct{}, inflationConcurrency)
+	for i, addr := range accounts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, addr common.Address) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			balance, _, clientErr := callStableTokenUint(
+				ctx, t.client, networkId, "balanceOf", []interface{}{addr.Hex()}, blockNumber,
+			)
+			if clientErr != nil {
+				fail(clientErr)
+				return
+			}
+			previousBalance := new(big.Int)
+			if t.stableToken.DeployedAt(index - 1) {
+				previousBalance, _, clientErr = callStableTokenUint(
+					ctx, t.client, networkId, "balanceOf", []interface{}{addr.Hex()}, previousBlockNumber,
+				)
+				if clientErr != nil {
+					fail(clientErr)
+					return
+				}
+			}
+			expected := new(big.Int).Add(previousBalance, deltas[addr])
+			adjustments[i] = new(big.Int).Sub(balance, expected)
+		}(i, addr)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, upstreamError(ctx, "/call", nil, err)
+	}
+	return adjustments, nil
+}
+
+// Identifier of the synthetic transaction holding a block's inflation adjustments
+func inflationTxHash(blockHash string) string {
+	return fmt.Sprintf("%s-inflation-adjustment", blockHash)
+}
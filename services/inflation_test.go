@@ -0,0 +1,197 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/celo-org/celo-blockchain/crypto"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func inflationLog(index uint, signature string, values ...int64) gethTypes.Log {
+	var data []byte
+	for _, value := range values {
+		data = append(data, common.BigToHash(big.NewInt(value)).Bytes()...)
+	}
+	return gethTypes.Log{
+		Topics: []common.Hash{crypto.Keccak256Hash([]byte(signature))},
+		Data:   data,
+		Index:  index,
+	}
+}
+
+func TestInflationChanges(t *testing.T) {
+	const (
+		factorUpdated     = "InflationFactorUpdated(uint256,uint256)"
+		parametersUpdated = "InflationParametersUpdated(uint256,uint256,uint256)"
+	)
+	tests := []struct {
+		name     string
+		logs     []gethTypes.Log
+		expected map[string]interface{}
+		err      bool
+	}{
+		{name: "no logs", expected: map[string]interface{}{}},
+		{
+			name:     "factor",
+			logs:     []gethTypes.Log{inflationLog(0, factorUpdated, 5, 100)},
+			expected: map[string]interface{}{"factor": "5", "factor_last_updated": "100"},
+		},
+		{
+			name: "parameters after factor",
+			logs: []gethTypes.Log{
+				inflationLog(3, parametersUpdated, 7, 86400, 200),
+				inflationLog(2, factorUpdated, 5, 100),
+			},
+			expected: map[string]interface{}{
+				"factor":              "5",
+				"rate":                "7",
+				"update_period":       "86400",
+				"factor_last_updated": "200",
+			},
+		},
+		{
+			name: "removed log",
+			logs: []gethTypes.Log{func() gethTypes.Log {
+				l := inflationLog(0, factorUpdated, 5, 100)
+				l.Removed = true
+				return l
+			}()},
+			expected: map[string]interface{}{},
+		},
+		{name: "other event", logs: []gethTypes.Log{inflationLog(0, "Transfer(address,address,uint256)", 1)}, err: true},
+		{name: "short data", logs: []gethTypes.Log{inflationLog(0, factorUpdated, 5)}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := inflationChanges(test.logs)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(changes, test.expected) {
+				t.Errorf("changes %v, expected %v", changes, test.expected)
+			}
+		})
+	}
+}
+
+func TestInflationAdjustmentsWithoutLogs(t *testing.T) {
+	// No client: a block without inflation logs must not read the chain
+	tracker := NewInflationTracker(nil, &StableToken{}, nil)
+	adjustment, metadata, clientErr := tracker.Adjustments(
+		context.Background(),
+		&types.NetworkIdentifier{},
+		&types.BlockIdentifier{Index: 10, Hash: "0x01"},
+		[]*types.Transaction{},
+		nil,
+	)
+	if adjustment != nil || metadata != nil || clientErr != nil {
+		t.Errorf("got %v, %v, %v, expected nothing", adjustment, metadata, clientErr)
+	}
+}
+
+func TestInflationAdjustments(t *testing.T) {
+	a := common.HexToAddress("0xaa00000000000000000000000000000000000001")
+	b := common.HexToAddress("0xbb00000000000000000000000000000000000002")
+	c := common.HexToAddress("0xcc00000000000000000000000000000000000003")
+	d := common.HexToAddress("0xdd00000000000000000000000000000000000004")
+	// Balances by block: a received cUSD before the block, b is an initial
+	// holder, c is minted cUSD in the block and d emptied its balance
+	balances := map[int64]map[common.Address]int64{
+		9:  {a: 100, b: 50},
+		10: {a: 99, b: 49, c: 10},
+	}
+	coreClient := newTestCore(t, func(path string, body []byte) interface{} {
+		var request types.CallRequest
+		if err := json.Unmarshal(body, &request); err != nil || path != "/call" {
+			t.Errorf("unexpected core request %s: %s", path, body)
+			return ErrInternal
+		}
+		var params airgap.CallParams
+		if err := airgap.UnmarshallFromMap(request.Parameters, &params); err != nil {
+			t.Fatal(err)
+		}
+		index := params.BlockNumber.Int64()
+		addr := common.HexToAddress(fmt.Sprint(params.Args[0]))
+		return testCallResponse(t, balances[index][addr], &types.BlockIdentifier{Index: index})
+	})
+	var scans [][2]int64
+	transferLogs := func(ctx context.Context, fromBlock, toBlock int64, networkId *types.NetworkIdentifier) ([]gethTypes.Log, *types.Error) {
+		scans = append(scans, [2]int64{fromBlock, toBlock})
+		return []gethTypes.Log{
+			testTransferLog(0, 0, ZeroAddress, a, 100),
+			testTransferLog(1, 1, ZeroAddress, d, 5),
+			testTransferLog(2, 2, d, ZeroAddress, 5),
+		}, nil
+	}
+	stableToken := &StableToken{BlockThreshold: 1, InitialHolders: []common.Address{b}}
+	tracker := NewInflationTracker(coreClient, stableToken, transferLogs)
+	tracker.params[9] = defaultInflationParameters()
+
+	mint := newAtomicOp(c, 0, big.NewInt(10), &OpSuccess, OpMint, nil)
+	adjustment, metadata, clientErr := tracker.Adjustments(
+		context.Background(),
+		&types.NetworkIdentifier{},
+		&types.BlockIdentifier{Index: 10, Hash: "0x0a"},
+		[]*types.Transaction{{Operations: []*types.Operation{mint}}},
+		[]gethTypes.Log{inflationLog(3, "InflationFactorUpdated(uint256,uint256)", 2, 10)},
+	)
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	if metadata == nil {
+		t.Error("no inflation parameters metadata")
+	}
+	if adjustment == nil {
+		t.Fatal("no adjustment transaction")
+	}
+	var summary []string
+	for _, op := range adjustment.Operations {
+		summary = append(summary, op.Type+" "+op.Account.Address+" "+op.Amount.Value)
+	}
+	expected := []string{
+		OpInflation + " " + a.Hex() + " -1",
+		OpInflation + " " + b.Hex() + " -1",
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("operations %v, expected %v", summary, expected)
+	}
+	if holders := adjustment.Metadata[MetadataInflationHolders]; holders != 4 {
+		t.Errorf("%s = %v, expected 4", MetadataInflationHolders, holders)
+	}
+
+	// Later blocks read the logs since the last scan, the reorg window included
+	if _, clientErr := tracker.Holders(context.Background(), &types.NetworkIdentifier{}, 20); clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	if expectedScans := [][2]int64{{1, 9}, {1, 20}}; !reflect.DeepEqual(scans, expectedScans) {
+		t.Errorf("scanned %v, expected %v", scans, expectedScans)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Leveled, structured logging. Loggers carry key/value fields (request ID,
+// network, block index, transaction hash...) and are threaded through
+// request contexts, so that every line logged while serving a request can
+// be correlated with it.
+
+type LogLevel int32
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	requestIDHeader = "X-Request-ID"
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+	return strconv.Itoa(int(l))
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+type logSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  LogLevel
+	format string
+}
+
+// Writes log lines with a fixed set of fields.
+type Logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+var rootLogger = &Logger{
+	sink: &logSink{w: os.Stderr, level: LogLevelInfo, format: LogFormatText},
+}
+
+// Configures the destination, level and format ("text" or "json") of all loggers.
+func SetupLogging(w io.Writer, level LogLevel, format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	rootLogger.sink.mu.Lock()
+	defer rootLogger.sink.mu.Unlock()
+	rootLogger.sink.w = w
+	rootLogger.sink.level = level
+	rootLogger.sink.format = format
+	return nil
+}
+
+// The logger with no fields, for use outside of requests.
+func RootLogger() *Logger {
+	return rootLogger
+}
+
+// Returns a logger adding keyValues (alternating keys and values) to every line.
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(LogLevelDebug, msg, keyValues)
+}
+
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(LogLevelInfo, msg, keyValues)
+}
+
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(LogLevelWarn, msg, keyValues)
+}
+
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(LogLevelError, msg, keyValues)
+}
+
+// Logs at error level and exits.
+func (l *Logger) Fatal(msg string, keyValues ...interface{}) {
+	l.log(LogLevelError, msg, keyValues)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level LogLevel, msg string, keyValues []interface{}) {
+	sink := l.sink
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if level < sink.level {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	now := time.Now().UTC()
+	var line string
+	if sink.format == LogFormatJSON {
+		line = jsonLogLine(now, level, msg, fields)
+	} else {
+		line = textLogLine(now, level, msg, fields)
+	}
+	_, _ = io.WriteString(sink.w, line)
+}
+
+func jsonLogLine(now time.Time, level LogLevel, msg string, fields []interface{}) string {
+	var b strings.Builder
+	writeJSONField := func(key string, value interface{}) {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+		encodedKey, _ := json.Marshal(key)
+		b.WriteByte(',')
+		b.Write(encodedKey)
+		b.WriteByte(':')
+		b.Write(encoded)
+	}
+	b.WriteString(`{"time":`)
+	b.WriteString(strconv.Quote(now.Format(time.RFC3339Nano)))
+	writeJSONField("level", level.String())
+	writeJSONField("msg", msg)
+	for i := 0; i < len(fields); i += 2 {
+		writeJSONField(fmt.Sprint(fields[i]), logValue(fields[i+1], true))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func textLogLine(now time.Time, level LogLevel, msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteByte('=')
+		value := fmt.Sprint(logValue(fields[i+1], false))
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// Renders values that do not format usefully on their own. Rosetta errors
+// keep their code and retriability, along with any upstream details.
+func logValue(value interface{}, structured bool) interface{} {
+	switch v := value.(type) {
+	case *types.Error:
+		if v == nil {
+			return nil
+		}
+		if structured {
+			return v
+		}
+		s := fmt.Sprintf("%s (code %d", v.Message, v.Code)
+		if v.Retriable {
+			s += ", retriable"
+		}
+		s += ")"
+		if len(v.Details) > 0 {
+			s += " " + types.PrintStruct(v.Details)
+		}
+		return s
+	case error:
+		if v == nil {
+			return nil
+		}
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+type loggerKey struct{}
+
+// The logger carried by ctx, or the root logger.
+func loggerFrom(ctx context.Context) *Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+			return logger
+		}
+	}
+	return rootLogger
+}
+
+// Returns ctx carrying a logger that adds keyValues to those already in ctx.
+func withLogFields(ctx context.Context, keyValues ...interface{}) context.Context {
+	return context.WithValue(ctx, loggerKey{}, loggerFrom(ctx).With(keyValues...))
+}
+
+// Assigns each request an ID (the caller's X-Request-ID, if any), returns
+// it in the response headers, threads a logger with it through the request
+// context and logs the outcome of the request.
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			var id [8]byte
+			randomBytes(id[:])
+			requestID = fmt.Sprintf("%x", id)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		fields := []interface{}{"request_id", requestID}
+		if span := SpanFromContext(r.Context()); span != nil {
+			fields = append(fields, "trace_id", span.TraceID.String())
+		}
+		ctx := withLogFields(r.Context(), fields...)
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		logger := loggerFrom(ctx).With(
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration", time.Since(start),
+		)
+		switch {
+		case recorder.status >= http.StatusInternalServerError:
+			logger.Warn("request failed", "error_code", recorder.errorCode())
+		case recorder.status >= http.StatusBadRequest:
+			logger.Info("request rejected", "error_code", recorder.errorCode())
+		default:
+			logger.Debug("request served")
+		}
+	})
+}
+
+// Network name for log fields, tolerating a missing identifier.
+func networkName(networkId *types.NetworkIdentifier) string {
+	if networkId == nil {
+		return ""
+	}
+	return networkId.Network
+}
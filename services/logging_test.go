@@ -0,0 +1,221 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Logs through the root logger into the returned buffer for the duration of the test.
+func captureRootLogger(t *testing.T, level LogLevel) *bytes.Buffer {
+	var buf bytes.Buffer
+	sink := rootLogger.sink
+	rootLogger.sink = &logSink{w: &buf, level: level, format: LogFormatText}
+	t.Cleanup(func() { rootLogger.sink = sink })
+	return &buf
+}
+
+func TestTextLogLine(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 30, 0, 5e6, time.UTC)
+	tests := []struct {
+		name     string
+		level    LogLevel
+		msg      string
+		fields   []interface{}
+		expected string
+	}{
+		{
+			name:     "no fields",
+			level:    LogLevelInfo,
+			msg:      "started",
+			expected: "2020-06-01T12:30:00.005Z INFO started\n",
+		},
+		{
+			name:     "plain values",
+			level:    LogLevelWarn,
+			msg:      "block fetched",
+			fields:   []interface{}{"network", "alfajores", "block", int64(12), "retry", true},
+			expected: "2020-06-01T12:30:00.005Z WARN block fetched network=alfajores block=12 retry=true\n",
+		},
+		{
+			name:     "quoted values",
+			level:    LogLevelDebug,
+			msg:      "call",
+			fields:   []interface{}{"empty", "", "spaces", "a b", "quote", `a"b`, "equals", "a=b"},
+			expected: `2020-06-01T12:30:00.005Z DEBUG call empty="" spaces="a b" quote="a\"b" equals="a=b"` + "\n",
+		},
+		{
+			name:     "errors and stringers",
+			level:    LogLevelError,
+			msg:      "failed",
+			fields:   []interface{}{"error", errors.New("connection refused"), "duration", 1500 * time.Millisecond},
+			expected: `2020-06-01T12:30:00.005Z ERROR failed error="connection refused" duration=1.5s` + "\n",
+		},
+		{
+			name:   "rosetta error",
+			level:  LogLevelError,
+			msg:    "failed",
+			fields: []interface{}{"error", &types.Error{Code: 5, Message: "core unavailable", Retriable: true}},
+			expected: `2020-06-01T12:30:00.005Z ERROR failed ` +
+				`error="core unavailable (code 5, retriable)"` + "\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if line := textLogLine(now, test.level, test.msg, test.fields); line != test.expected {
+				t.Errorf("got %q, expected %q", line, test.expected)
+			}
+		})
+	}
+}
+
+func TestJSONLogLine(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 30, 0, 5e6, time.UTC)
+	fields := []interface{}{
+		"block", int64(12),
+		"error", errors.New("connection refused"),
+		"rosetta_error", &types.Error{Code: 5, Message: "core unavailable", Retriable: true},
+	}
+	expected := `{"time":"2020-06-01T12:30:00.005Z","level":"warn","msg":"block \"fetched\"","block":12,` +
+		`"error":"connection refused",` +
+		`"rosetta_error":{"code":5,"message":"core unavailable","retriable":true}}` + "\n"
+	line := jsonLogLine(now, LogLevelWarn, `block "fetched"`, fields)
+	if line != expected {
+		t.Errorf("got %s, expected %s", line, expected)
+	}
+	if !json.Valid([]byte(line)) {
+		t.Errorf("invalid JSON %s", line)
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	buf := captureRootLogger(t, LogLevelInfo)
+	ctx := withLogFields(context.Background(), "request_id", "abc")
+	ctx = withLogFields(ctx, "network", "alfajores")
+
+	loggerFrom(ctx).Debug("filtered out", "block", 1)
+	loggerFrom(ctx).Info("block fetched", "block", 2)
+	RootLogger().With("unpaired").Warn("odd fields")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	expected := []string{
+		"INFO block fetched request_id=abc network=alfajores block=2",
+		"WARN odd fields unpaired=(MISSING)",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("logged %q", buf.String())
+	}
+	for i, line := range lines {
+		// Drop the timestamp
+		if line = line[strings.IndexByte(line, ' ')+1:]; line != expected[i] {
+			t.Errorf("line %d: got %q, expected %q", i, line, expected[i])
+		}
+	}
+
+	if loggerFrom(context.Background()) != rootLogger {
+		t.Error("expected the root logger outside of requests")
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		status    int
+		body      string
+		expected  string
+		errorCode string
+	}{
+		{
+			name:      "caller request id",
+			requestID: "req-1",
+			status:    http.StatusOK,
+			expected:  "DEBUG request served request_id=req-1 method=POST path=/block status=200",
+		},
+		{
+			name:      "rejected",
+			requestID: "req-2",
+			status:    http.StatusBadRequest,
+			body:      `{"code":8,"message":"invalid request"}`,
+			expected:  "INFO request rejected request_id=req-2 method=POST path=/block status=400",
+			errorCode: "8",
+		},
+		{
+			name:      "failed",
+			requestID: "req-3",
+			status:    http.StatusInternalServerError,
+			body:      `{"code":5,"message":"core unavailable"}`,
+			expected:  "WARN request failed request_id=req-3 method=POST path=/block status=500",
+			errorCode: "5",
+		},
+		{
+			name:     "generated request id",
+			status:   http.StatusOK,
+			expected: "DEBUG request served request_id=",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := captureRootLogger(t, LogLevelDebug)
+			var handlerID string
+			handler := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				loggerFrom(r.Context()).Info("handling")
+				handlerID = w.Header().Get(requestIDHeader)
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.body))
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/block", nil)
+			if test.requestID != "" {
+				req.Header.Set(requestIDHeader, test.requestID)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			requestID := rec.Header().Get(requestIDHeader)
+			if test.requestID != "" && requestID != test.requestID {
+				t.Errorf("responded with request id %q, expected %q", requestID, test.requestID)
+			}
+			if len(requestID) == 0 || requestID != handlerID {
+				t.Errorf("request id %q, handler saw %q", requestID, handlerID)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("logged %q", buf.String())
+			}
+			// Lines logged by the handler carry the request id
+			if !strings.HasSuffix(lines[0], "INFO handling request_id="+requestID) {
+				t.Errorf("handler logged %q", lines[0])
+			}
+			outcome := lines[1][strings.IndexByte(lines[1], ' ')+1:]
+			if !strings.HasPrefix(outcome, test.expected) {
+				t.Errorf("got %q, expected %q", outcome, test.expected)
+			}
+			if test.errorCode != "" && !strings.HasSuffix(outcome, " error_code="+test.errorCode) {
+				t.Errorf("missing error code %s in %q", test.errorCode, outcome)
+			}
+		})
+	}
+}
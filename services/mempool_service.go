@@ -39,9 +39,14 @@ func (s *MempoolAPIService) Mempool(
 	ctx context.Context,
 	request *types.NetworkRequest,
 ) (*types.MempoolResponse, *types.Error) {
-	resp, clientErr, _ := s.client.MempoolAPI.Mempool(ctx, request)
+	ctx, span := startSpan(ctx, "MempoolAPIService.Mempool")
+	defer span.Finish()
 
-	return resp, clientErr
+	resp, clientErr, err := s.client.MempoolAPI.Mempool(ctx, request)
+	if err != nil {
+		return nil, upstreamError(ctx, "/mempool", clientErr, err)
+	}
+	return resp, nil
 }
 
 // endpoint: /mempool/transaction
@@ -49,6 +54,12 @@ func (s *MempoolAPIService) MempoolTransaction(
 	ctx context.Context,
 	request *types.MempoolTransactionRequest,
 ) (*types.MempoolTransactionResponse, *types.Error) {
-	resp, clientErr, _ := s.client.MempoolAPI.MempoolTransaction(ctx, request)
-	return resp, clientErr
+	ctx, span := startSpan(ctx, "MempoolAPIService.MempoolTransaction")
+	defer span.Finish()
+
+	resp, clientErr, err := s.client.MempoolAPI.MempoolTransaction(ctx, request)
+	if err != nil {
+		return nil, upstreamError(ctx, "/mempool/transaction", clientErr, err)
+	}
+	return resp, nil
 }
@@ -0,0 +1,302 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus registry, exposing counters and histograms in the
+// text exposition format on /metrics.
+
+const metricsNamespace = "rosetta_cusd"
+
+var (
+	// Prometheus client default buckets, in seconds
+	defaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	metricsRegistry = &registry{}
+
+	httpRequests = metricsRegistry.newCounter(
+		"http_requests_total",
+		"HTTP requests served, by endpoint and status code.",
+		"endpoint", "status",
+	)
+	httpRequestDuration = metricsRegistry.newHistogram(
+		"http_request_duration_seconds",
+		"Latency of HTTP requests served, by endpoint.",
+		defaultDurationBuckets,
+		"endpoint",
+	)
+	rosettaErrors = metricsRegistry.newCounter(
+		"errors_total",
+		"Rosetta errors returned, by endpoint and Rosetta error code.",
+		"endpoint", "code",
+	)
+	upstreamRequestDuration = metricsRegistry.newHistogram(
+		"upstream_request_duration_seconds",
+		"Latency of requests to core rosetta, by call (endpoint, or /call method).",
+		defaultDurationBuckets,
+		"call",
+	)
+	upstreamErrors = metricsRegistry.newCounter(
+		"upstream_errors_total",
+		"Failed requests to core rosetta, by call.",
+		"call",
+	)
+	upstreamCircuitOpens = metricsRegistry.newCounter(
+		"upstream_circuit_opens_total",
+		"Times the circuit breaker in front of a core rosetta backend opened, by backend.",
+		"backend",
+	)
+	coreBackendFailures = metricsRegistry.newCounter(
+		"core_backend_failures_total",
+		"Times a core rosetta backend was taken out of rotation, by backend.",
+		"backend",
+	)
+	blockMismatches = metricsRegistry.newCounter(
+		"block_log_mismatches_total",
+		"Blocks whose transfer logs came from a different block with the same index.",
+	)
+	nonceReleases = metricsRegistry.newCounter(
+		"nonce_releases_total",
+		"Nonces reserved by the nonce manager and released before use, by reason (failed or expired).",
+		"reason",
+	)
+	submissionRebroadcasts = metricsRegistry.newCounter(
+		"submission_rebroadcasts_total",
+		"Submitted transactions sent again after dropping out of the transaction pool.",
+	)
+	cacheRequests = metricsRegistry.newCounter(
+		"cache_requests_total",
+		"Cache lookups, by cache and result (hit or miss).",
+		"cache", "result",
+	)
+	blockLogs = metricsRegistry.newHistogram(
+		"block_logs",
+		"Number of StableToken Transfer logs parsed per block.",
+		[]float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	)
+)
+
+// Serves the metrics of this process in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		metricsRegistry.write(buf)
+		if err := buf.Flush(); err != nil {
+			rootLogger.Warn("could not write metrics", "error", err)
+		}
+	})
+}
+
+func recordCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.inc(cache, result)
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *registry) newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		desc:   desc{name: metricsNamespace + "_" + name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(c)
+	return c
+}
+
+// buckets are upper bounds in increasing order; the +Inf bucket is implicit.
+func (r *registry) newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	var bounds []float64
+	for _, bound := range buckets {
+		if !math.IsInf(bound, 1) {
+			bounds = append(bounds, bound)
+		}
+	}
+	h := &histogramVec{
+		desc:    desc{name: metricsNamespace + "_" + name, help: help, labels: labels},
+		buckets: bounds,
+		values:  make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *registry) write(w io.Writer) {
+	r.mu.Lock()
+	metrics := r.metrics
+	r.mu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// Key identifying a combination of label values
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Escaping of label values and help texts in the text format, which only
+// escapes backslashes, line feeds and, in label values, double quotes. Go
+// quoting produces escapes such as \t that Prometheus does not decode.
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// Formats label pairs for key, plus any extra pair (e.g. le="0.5")
+func (d *desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+labelValueEscaper.Replace(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelValueEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d *desc) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, helpEscaper.Replace(d.help), d.name, kind)
+}
+
+type counterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), hist.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
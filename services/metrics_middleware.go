@@ -0,0 +1,179 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Largest error response body buffered to read its Rosetta error code
+const maxErrorBodySize = 4096
+
+// Paths reported as endpoint labels; anything else is reported as "other"
+// to keep label cardinality bounded.
+var knownEndpoints = map[string]struct{}{
+	"/network/list":            {},
+	"/network/options":         {},
+	"/network/status":          {},
+	"/account/balance":         {},
+	"/block":                   {},
+	"/block/transaction":       {},
+	"/blocks/range":            {},
+	"/mempool":                 {},
+	"/mempool/transaction":     {},
+	"/call":                    {},
+	"/construction/derive":     {},
+	"/construction/preprocess": {},
+	"/construction/metadata":   {},
+	"/construction/payloads":   {},
+	"/construction/combine":    {},
+	"/construction/parse":      {},
+	"/construction/hash":       {},
+	"/construction/submit":     {},
+	"/construction/status":     {},
+	"/stream/transactions":     {},
+	"/admin/webhooks/register": {},
+	"/admin/webhooks/list":     {},
+	"/admin/webhooks/remove":   {},
+	"/health":                  {},
+	"/ready":                   {},
+	"/sync":                    {},
+}
+
+func endpointLabel(path string) string {
+	if _, ok := knownEndpoints[path]; ok {
+		return path
+	}
+	return "other"
+}
+
+// Records request counts, latencies and Rosetta error codes for every
+// request served by next.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		endpoint := endpointLabel(r.URL.Path)
+		httpRequests.inc(endpoint, strconv.Itoa(recorder.status))
+		httpRequestDuration.observe(time.Since(start).Seconds(), endpoint)
+		if recorder.status >= http.StatusBadRequest {
+			rosettaErrors.inc(endpoint, recorder.errorCode())
+		}
+	})
+}
+
+// Captures the status and, for errors, the start of the body of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	errorBody   bytes.Buffer
+}
+
+func (m *responseRecorder) WriteHeader(status int) {
+	if !m.wroteHeader {
+		m.status = status
+		m.wroteHeader = true
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *responseRecorder) Write(b []byte) (int, error) {
+	m.wroteHeader = true
+	if m.status >= http.StatusBadRequest && m.errorBody.Len() < maxErrorBodySize {
+		m.errorBody.Write(b[:minInt(len(b), maxErrorBodySize-m.errorBody.Len())])
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+// Keeps streaming responses working through the recorder
+func (m *responseRecorder) Flush() {
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// The Rosetta error code of the response, or "none" if it is not a Rosetta error
+func (m *responseRecorder) errorCode() string {
+	var rosettaErr struct {
+		Code *int32 `json:"code"`
+	}
+	if err := json.Unmarshal(m.errorBody.Bytes(), &rosettaErr); err != nil || rosettaErr.Code == nil {
+		return "none"
+	}
+	return strconv.Itoa(int(*rosettaErr.Code))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Wraps the transport of the core rosetta client to record the latency
+// and failures of each upstream call. Calls to /call are labelled with
+// their method (e.g. celo_getLogs), other calls with their path.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func NewMetricsTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &metricsTransport{next: next}
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := upstreamCallLabel(req)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	upstreamRequestDuration.observe(time.Since(start).Seconds(), call)
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		upstreamErrors.inc(call)
+	}
+	return resp, err
+}
+
+func upstreamCallLabel(req *http.Request) string {
+	if req.URL.Path != "/call" || req.GetBody == nil {
+		return req.URL.Path
+	}
+	// Read a copy of the body, leaving the request's own untouched
+	body, err := req.GetBody()
+	if err != nil {
+		return req.URL.Path
+	}
+	defer body.Close()
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return req.URL.Path
+	}
+	var call struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(raw, &call); err != nil || call.Method == "" {
+		return req.URL.Path
+	}
+	return "/call:" + call.Method
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   func(r *registry)
+		expected string
+	}{
+		{
+			name: "counter without labels",
+			record: func(r *registry) {
+				c := r.newCounter("events_total", "Events.")
+				c.inc()
+				c.inc()
+			},
+			expected: `# HELP rosetta_cusd_events_total Events.
+# TYPE rosetta_cusd_events_total counter
+rosetta_cusd_events_total 2
+`,
+		},
+		{
+			name: "counter with labels, sorted",
+			record: func(r *registry) {
+				c := r.newCounter("requests_total", "Requests.", "path", "code")
+				c.inc("/network/status", "200")
+				c.inc("/block", "500")
+				c.inc("/block", "500")
+			},
+			expected: `# HELP rosetta_cusd_requests_total Requests.
+# TYPE rosetta_cusd_requests_total counter
+rosetta_cusd_requests_total{path="/block",code="500"} 2
+rosetta_cusd_requests_total{path="/network/status",code="200"} 1
+`,
+		},
+		{
+			name: "escaping",
+			record: func(r *registry) {
+				c := r.newCounter("errors_total", "Errors by\ncause, with \\ in help.", "error")
+				c.inc("quote \" backslash \\ newline \n tab \t é")
+			},
+			expected: "# HELP rosetta_cusd_errors_total Errors by\\ncause, with \\\\ in help.\n" +
+				"# TYPE rosetta_cusd_errors_total counter\n" +
+				"rosetta_cusd_errors_total{error=\"quote \\\" backslash \\\\ newline \\n tab \t é\"} 1\n",
+		},
+		{
+			name: "histogram",
+			record: func(r *registry) {
+				h := r.newHistogram("duration_seconds", "Durations.", []float64{0.1, 1}, "call")
+				h.observe(0.05, "/block")
+				h.observe(0.5, "/block")
+				h.observe(2, "/block")
+			},
+			expected: `# HELP rosetta_cusd_duration_seconds Durations.
+# TYPE rosetta_cusd_duration_seconds histogram
+rosetta_cusd_duration_seconds_bucket{call="/block",le="0.1"} 1
+rosetta_cusd_duration_seconds_bucket{call="/block",le="1"} 2
+rosetta_cusd_duration_seconds_bucket{call="/block",le="+Inf"} 3
+rosetta_cusd_duration_seconds_sum{call="/block"} 2.55
+rosetta_cusd_duration_seconds_count{call="/block"} 3
+`,
+		},
+		{
+			// The +Inf bucket is written once
+			name: "histogram without labels",
+			record: func(r *registry) {
+				h := r.newHistogram("size", "Sizes.", []float64{10, math.Inf(1)})
+				h.observe(3)
+			},
+			expected: `# HELP rosetta_cusd_size Sizes.
+# TYPE rosetta_cusd_size histogram
+rosetta_cusd_size_bucket{le="10"} 1
+rosetta_cusd_size_bucket{le="+Inf"} 1
+rosetta_cusd_size_sum 3
+rosetta_cusd_size_count 1
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &registry{}
+			test.record(r)
+			var buf bytes.Buffer
+			r.write(&buf)
+			if buf.String() != test.expected {
+				t.Errorf("exposition:\n%s\nexpected:\n%s", buf.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", contentType)
+	}
+	if !strings.Contains(rec.Body.String(), "# TYPE rosetta_cusd_upstream_errors_total counter\n") {
+		t.Errorf("registered metrics missing from:\n%s", rec.Body.String())
+	}
+}
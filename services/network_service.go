@@ -23,14 +23,17 @@ import (
 
 // Implements the server.NetworkAPIService interface.
 type NetworkAPIService struct {
-	client *client.APIClient
+	client      *client.APIClient
+	stableToken *StableToken
 }
 
 func NewNetworkAPIService(
 	client *client.APIClient,
+	stableToken *StableToken,
 ) *NetworkAPIService {
 	return &NetworkAPIService{
-		client: client,
+		client:      client,
+		stableToken: stableToken,
 	}
 }
 
@@ -39,9 +42,14 @@ func (s *NetworkAPIService) NetworkList(
 	ctx context.Context,
 	request *types.MetadataRequest,
 ) (*types.NetworkListResponse, *types.Error) {
-	resp, clientErr, _ := s.client.NetworkAPI.NetworkList(ctx, request)
+	ctx, span := startSpan(ctx, "NetworkAPIService.NetworkList")
+	defer span.Finish()
 
-	return resp, clientErr
+	resp, clientErr, err := s.client.NetworkAPI.NetworkList(ctx, request)
+	if err != nil {
+		return nil, upstreamError(ctx, "/network/list", clientErr, err)
+	}
+	return resp, nil
 }
 
 // endpoint: /network/status
@@ -49,9 +57,14 @@ func (s *NetworkAPIService) NetworkStatus(
 	ctx context.Context,
 	request *types.NetworkRequest,
 ) (*types.NetworkStatusResponse, *types.Error) {
-	resp, clientErr, _ := s.client.NetworkAPI.NetworkStatus(ctx, request)
+	ctx, span := startSpan(ctx, "NetworkAPIService.NetworkStatus")
+	defer span.Finish()
 
-	return resp, clientErr
+	resp, clientErr, err := s.client.NetworkAPI.NetworkStatus(ctx, request)
+	if err != nil {
+		return nil, upstreamError(ctx, "/network/status", clientErr, err)
+	}
+	return resp, nil
 }
 
 // endpoint: /network/options
@@ -59,9 +72,12 @@ func (s *NetworkAPIService) NetworkOptions(
 	ctx context.Context,
 	request *types.NetworkRequest,
 ) (*types.NetworkOptionsResponse, *types.Error) {
+	ctx, span := startSpan(ctx, "NetworkAPIService.NetworkOptions")
+	defer span.Finish()
+
 	resp, clientErr, err := s.client.NetworkAPI.NetworkOptions(ctx, request)
 	if err != nil {
-		return nil, clientErr
+		return nil, upstreamError(ctx, "/network/options", clientErr, err)
 	}
 
 	// TODO check that resp.Version.MiddlewareVersion matches expected RosettaCoreVersion
@@ -71,11 +87,36 @@ func (s *NetworkAPIService) NetworkOptions(
 			RosettaVersion:    resp.Version.RosettaVersion,
 			NodeVersion:       resp.Version.NodeVersion,
 			MiddlewareVersion: &MiddlewareVersion,
+			Metadata: map[string]interface{}{
+				MetadataStableTokenAddress:         s.stableToken.Address.Hex(),
+				MetadataStableTokenActivationIndex: s.stableToken.BlockThreshold,
+			},
 		},
 		Allow: &types.Allow{
 			OperationStatuses: AllOperationStatuses,
 			OperationTypes:    AllOperationTypes,
-			Errors:            AllErrors,
+			Errors:            allowedErrors(resp.Allow),
+			CallMethods:       AllCallMethods,
 		},
 	}, nil
 }
+
+// Errors of this module along with those core rosetta may return, since
+// core's errors are passed through to callers.
+func allowedErrors(coreAllow *types.Allow) []*types.Error {
+	errs := append([]*types.Error{}, AllErrors...)
+	if coreAllow == nil {
+		return errs
+	}
+	known := make(map[int32]bool, len(errs))
+	for _, err := range errs {
+		known[err.Code] = true
+	}
+	for _, err := range coreAllow.Errors {
+		if !known[err.Code] {
+			known[err.Code] = true
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
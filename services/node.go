@@ -0,0 +1,250 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/celo-blockchain/common/hexutil"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/celo-org/celo-blockchain/rpc"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+var errTransactionNotFound = errors.New("transaction not found")
+
+// Client of the JSON-RPC API of the Celo node behind core rosetta, for the
+// data core rosetta does not expose, such as transaction receipts.
+type NodeClient struct {
+	rpc *rpc.Client
+}
+
+func NewNodeClient(url string, httpClient *http.Client) (*NodeClient, error) {
+	client, err := rpc.DialHTTPWithClient(url, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeClient{rpc: client}, nil
+}
+
+// A transaction as returned by eth_getTransactionByHash, with the Celo fields.
+type nodeTransaction struct {
+	Hash                common.Hash     `json:"hash"`
+	BlockHash           *common.Hash    `json:"blockHash"`
+	From                common.Address  `json:"from"`
+	To                  *common.Address `json:"to"`
+	Input               hexutil.Bytes   `json:"input"`
+	Nonce               hexutil.Uint64  `json:"nonce"`
+	Gas                 hexutil.Uint64  `json:"gas"`
+	GasPrice            *hexutil.Big    `json:"gasPrice"`
+	Value               *hexutil.Big    `json:"value"`
+	FeeCurrency         *common.Address `json:"feeCurrency"`
+	GatewayFeeRecipient *common.Address `json:"gatewayFeeRecipient"`
+	GatewayFee          *hexutil.Big    `json:"gatewayFee"`
+}
+
+// The fields of eth_getTransactionReceipt this module uses.
+type nodeReceipt struct {
+	BlockHash   common.Hash    `json:"blockHash"`
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	Status      hexutil.Uint64 `json:"status"`
+	GasUsed     hexutil.Uint64 `json:"gasUsed"`
+}
+
+// Fetches the transactions with the given hashes and their receipts in a
+// single batch. Fails if any of them is unknown or not yet mined.
+func (c *NodeClient) minedTransactions(
+	ctx context.Context,
+	hashes []common.Hash,
+) ([]*nodeTransaction, []*nodeReceipt, error) {
+	ctx, span := startSpan(ctx, "NodeClient.minedTransactions")
+	defer span.Finish()
+	span.SetAttribute("node.transactions", len(hashes))
+
+	txs := make([]*nodeTransaction, len(hashes))
+	receipts := make([]*nodeReceipt, len(hashes))
+	batch := make([]rpc.BatchElem, 0, 2*len(hashes))
+	for i, hash := range hashes {
+		txs[i] = new(nodeTransaction)
+		receipts[i] = new(nodeReceipt)
+		batch = append(batch,
+			rpc.BatchElem{Method: "eth_getTransactionByHash", Args: []interface{}{hash}, Result: &txs[i]},
+			rpc.BatchElem{Method: "eth_getTransactionReceipt", Args: []interface{}{hash}, Result: &receipts[i]},
+		)
+	}
+	if err := c.rpc.BatchCallContext(ctx, batch); err != nil {
+		span.SetError(err.Error())
+		return nil, nil, err
+	}
+	for i, elem := range batch {
+		if elem.Error != nil {
+			span.SetError(elem.Error.Error())
+			return nil, nil, fmt.Errorf("%s: %w", elem.Method, elem.Error)
+		}
+		// The node answers null for unknown transactions
+		hash := hashes[i/2]
+		if txs[i/2] == nil || receipts[i/2] == nil {
+			return nil, nil, fmt.Errorf("%s %s: %w", elem.Method, hash.Hex(), errTransactionNotFound)
+		}
+	}
+	return txs, receipts, nil
+}
+
+// Fetches a transaction, mined or pending. Nil if the node does not know it.
+func (c *NodeClient) transaction(ctx context.Context, hash common.Hash) (*nodeTransaction, error) {
+	ctx, span := startSpan(ctx, "NodeClient.transaction")
+	defer span.Finish()
+
+	var tx *nodeTransaction
+	if err := c.rpc.CallContext(ctx, &tx, "eth_getTransactionByHash", hash); err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Fetches the receipt of a transaction. Nil if it is not mined.
+func (c *NodeClient) receipt(ctx context.Context, hash common.Hash) (*nodeReceipt, error) {
+	ctx, span := startSpan(ctx, "NodeClient.receipt")
+	defer span.Finish()
+
+	var receipt *nodeReceipt
+	if err := c.rpc.CallContext(ctx, &receipt, "eth_getTransactionReceipt", hash); err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// The logsBloom of the header of the block with the given hash. Nil if the
+// node does not know the block.
+func (c *NodeClient) logsBloom(ctx context.Context, hash common.Hash) (*gethTypes.Bloom, error) {
+	ctx, span := startSpan(ctx, "NodeClient.logsBloom")
+	defer span.Finish()
+
+	var header *struct {
+		LogsBloom gethTypes.Bloom `json:"logsBloom"`
+	}
+	if err := c.rpc.CallContext(ctx, &header, "eth_getBlockByHash", hash, false); err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	if header == nil {
+		return nil, nil
+	}
+	return &header.LogsBloom, nil
+}
+
+// The logs of the block with the given hash emitted by address with any of
+// topics as first topic.
+func (c *NodeClient) blockLogs(
+	ctx context.Context,
+	hash common.Hash,
+	address common.Address,
+	topics []common.Hash,
+) ([]gethTypes.Log, error) {
+	ctx, span := startSpan(ctx, "NodeClient.blockLogs")
+	defer span.Finish()
+
+	var logs []gethTypes.Log
+	filter := map[string]interface{}{
+		"blockHash": hash,
+		"address":   address,
+		"topics":    [][]common.Hash{topics},
+	}
+	if err := c.rpc.CallContext(ctx, &logs, "eth_getLogs", filter); err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	return logs, nil
+}
+
+// The logs of blocks [fromBlock, toBlock] emitted by address with any of
+// topics as first topic.
+func (c *NodeClient) rangeLogs(
+	ctx context.Context,
+	fromBlock int64,
+	toBlock int64,
+	address common.Address,
+	topics []common.Hash,
+) ([]gethTypes.Log, error) {
+	ctx, span := startSpan(ctx, "NodeClient.rangeLogs")
+	defer span.Finish()
+
+	var logs []gethTypes.Log
+	filter := map[string]interface{}{
+		"fromBlock": hexutil.Uint64(fromBlock),
+		"toBlock":   hexutil.Uint64(toBlock),
+		"address":   address,
+		"topics":    [][]common.Hash{topics},
+	}
+	if err := c.rpc.CallContext(ctx, &logs, "eth_getLogs", filter); err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	return logs, nil
+}
+
+// The number of the latest block.
+func (c *NodeClient) blockNumber(ctx context.Context) (uint64, error) {
+	ctx, span := startSpan(ctx, "NodeClient.blockNumber")
+	defer span.Finish()
+
+	var number hexutil.Uint64
+	if err := c.rpc.CallContext(ctx, &number, "eth_blockNumber"); err != nil {
+		span.SetError(err.Error())
+		return 0, err
+	}
+	return uint64(number), nil
+}
+
+// The nonces of the next transaction of account on top of the latest block,
+// and on top of the transactions pending in the pool of the node.
+func (c *NodeClient) nonces(ctx context.Context, account common.Address) (uint64, uint64, error) {
+	ctx, span := startSpan(ctx, "NodeClient.nonces")
+	defer span.Finish()
+
+	var latest, pending hexutil.Uint64
+	batch := []rpc.BatchElem{
+		{Method: "eth_getTransactionCount", Args: []interface{}{account, "latest"}, Result: &latest},
+		{Method: "eth_getTransactionCount", Args: []interface{}{account, "pending"}, Result: &pending},
+	}
+	if err := c.rpc.BatchCallContext(ctx, batch); err != nil {
+		span.SetError(err.Error())
+		return 0, 0, err
+	}
+	for _, elem := range batch {
+		if elem.Error != nil {
+			span.SetError(elem.Error.Error())
+			return 0, 0, fmt.Errorf("%s: %w", elem.Method, elem.Error)
+		}
+	}
+	return uint64(latest), uint64(pending), nil
+}
+
+// The error to return for a failed call to the Celo node.
+func nodeError(ctx context.Context, call string, err error) *types.Error {
+	loggerFrom(ctx).Warn("celo node call failed", "call", call, "error", err)
+	unavailable := *ErrNodeUnavailable
+	unavailable.Details = map[string]interface{}{
+		"call":  call,
+		"error": err.Error(),
+	}
+	return &unavailable
+}
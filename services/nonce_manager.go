@@ -0,0 +1,213 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Preprocess metadata key pinning the nonce of the transaction to build
+	MetadataNonce = "nonce"
+
+	// Preprocess option only used by this module, not forwarded to core
+	optionNonce = "nonce"
+
+	DefaultNonceReservationTTL = 10 * time.Minute
+)
+
+// Core reads the pending nonce of the sender on every /construction/metadata
+// request, so concurrent construction flows of a sender get the same nonce.
+// The NonceManager hands out the lowest nonce of a sender, at or above the
+// pending nonce, that no other flow holds, until the flow's transaction is
+// submitted and counted in the pending nonce, its submission fails, or the
+// reservation expires.
+type NonceManager struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+	// Expiry of the reserved nonces of each sender
+	reserved map[common.Address]map[uint64]time.Time
+}
+
+func NewNonceManager(ttl time.Duration) *NonceManager {
+	return &NonceManager{
+		ttl:      ttl,
+		reserved: make(map[common.Address]map[uint64]time.Time),
+	}
+}
+
+// Reserves the next free nonce of sender, given its pending nonce on chain.
+func (m *NonceManager) Reserve(sender common.Address, pending uint64) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nonces := m.resync(sender, pending)
+	nonce := pending
+	for {
+		if _, ok := nonces[nonce]; !ok {
+			break
+		}
+		nonce++
+	}
+	nonces[nonce] = time.Now().Add(m.ttl)
+	return nonce
+}
+
+// Reserves nonce for sender, so that it is not handed out to other flows.
+// Nonces below the pending nonce are used on chain and cannot be pinned.
+func (m *NonceManager) Pin(sender common.Address, nonce, pending uint64) error {
+	if err := checkPinnedNonce(nonce, pending); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resync(sender, pending)[nonce] = time.Now().Add(m.ttl)
+	return nil
+}
+
+// Keeps nonce reserved for another ttl after the transaction using it was
+// submitted, until the pending nonce of the sender catches up.
+func (m *NonceManager) Submitted(sender common.Address, nonce uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if nonces, ok := m.reserved[sender]; ok {
+		if _, ok := nonces[nonce]; ok {
+			nonces[nonce] = time.Now().Add(m.ttl)
+		}
+	}
+}
+
+// Frees nonce for other flows of sender, e.g. after its submission failed.
+func (m *NonceManager) Release(sender common.Address, nonce uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if nonces, ok := m.reserved[sender]; ok {
+		if _, ok := nonces[nonce]; ok {
+			delete(nonces, nonce)
+			nonceReleases.inc("failed")
+		}
+		if len(nonces) == 0 {
+			delete(m.reserved, sender)
+		}
+	}
+}
+
+// Drops the nonces of sender that are used on chain or expired, returning
+// the remaining ones. Must be called with m.mu held.
+func (m *NonceManager) resync(sender common.Address, pending uint64) map[uint64]time.Time {
+	nonces, ok := m.reserved[sender]
+	if !ok {
+		nonces = make(map[uint64]time.Time)
+		m.reserved[sender] = nonces
+	}
+	now := time.Now()
+	for nonce, expiry := range nonces {
+		switch {
+		case nonce < pending:
+			delete(nonces, nonce)
+		case now.After(expiry):
+			delete(nonces, nonce)
+			nonceReleases.inc("expired")
+		}
+	}
+	return nonces
+}
+
+// Reads the nonce pinned in preprocess metadata, if any.
+func pinnedNonce(metadata map[string]interface{}) (uint64, bool, error) {
+	raw, ok := metadata[MetadataNonce]
+	if !ok {
+		return 0, false, nil
+	}
+	nonce, err := parseNonce(raw)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s %v: %w", MetadataNonce, raw, err)
+	}
+	return nonce, true, nil
+}
+
+// Removes the pinned nonce option from options.
+func takeNonceOption(options map[string]interface{}) (uint64, bool, error) {
+	raw, ok := options[optionNonce]
+	if !ok {
+		return 0, false, nil
+	}
+	delete(options, optionNonce)
+	nonce, err := parseNonce(raw)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s %v: %w", optionNonce, raw, err)
+	}
+	return nonce, true, nil
+}
+
+// A pinned nonce below the pending nonce would either fail or, if its
+// transaction is still in the pool, replace it unannounced. Replacements
+// are requested with replace_tx or cancel_tx instead.
+func checkPinnedNonce(nonce, pending uint64) error {
+	if nonce < pending {
+		return fmt.Errorf("%s %d is below the pending nonce %d", MetadataNonce, nonce, pending)
+	}
+	return nil
+}
+
+// Nonces are given as JSON numbers or decimal strings.
+func parseNonce(raw interface{}) (uint64, error) {
+	switch v := raw.(type) {
+	case float64:
+		if v < 0 || v != math.Trunc(v) || v > math.MaxInt64 {
+			return 0, errors.New("not a non-negative integer")
+		}
+		return uint64(v), nil
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	}
+	return 0, errors.New("expected a number or a decimal string")
+}
+
+// Sets the nonce of tx, as returned by core, to the pinned nonce, or else to
+// one reserved above the pending nonce core read.
+func (s *ConstructionAPIService) assignNonce(
+	ctx context.Context,
+	tx *airgap.TxMetadata,
+	nonce uint64,
+	pinned bool,
+) *types.Error {
+	pending := tx.Nonce
+	var err error
+	switch {
+	case pinned && s.nonces != nil:
+		err = s.nonces.Pin(tx.From, nonce, pending)
+	case pinned:
+		err = checkPinnedNonce(nonce, pending)
+	default:
+		nonce = s.nonces.Reserve(tx.From, pending)
+	}
+	if err != nil {
+		loggerFrom(ctx).Info("invalid nonce", "error", err)
+		return ErrValidation
+	}
+	tx.Nonce = nonce
+	return nil
+}
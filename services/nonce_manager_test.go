@@ -0,0 +1,267 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/airgap"
+)
+
+func TestNonceManager(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	a := common.HexToAddress("0xaa00000000000000000000000000000000000001")
+	b := common.HexToAddress("0xbb00000000000000000000000000000000000002")
+	type step struct {
+		// "reserve" expects Reserve to return nonce, "pin" expects Pin to
+		// fail if rejected, "submitted" and "release" call the method of
+		// the same name, "wait" sleeps for 60% of the ttl, "empty" expects
+		// no sender to hold a reservation
+		action   string
+		sender   common.Address
+		nonce    uint64
+		pending  uint64
+		rejected bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "consecutive reservations",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 6},
+				{action: "reserve", sender: a, pending: 5, nonce: 7},
+			},
+		},
+		{
+			name: "senders are independent",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "reserve", sender: b, pending: 5, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 6},
+			},
+		},
+		{
+			name: "nonces used on chain are dropped",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 6},
+				{action: "reserve", sender: a, pending: 7, nonce: 7},
+				{action: "reserve", sender: a, pending: 8, nonce: 8},
+			},
+		},
+		{
+			name: "released nonce is handed out again",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 6},
+				{action: "release", sender: a, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 7},
+			},
+		},
+		{
+			name: "releasing the last nonce forgets the sender",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "release", sender: a, nonce: 5},
+				{action: "empty"},
+			},
+		},
+		{
+			name: "releasing an unknown nonce",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "release", sender: a, nonce: 9},
+				{action: "release", sender: b, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 6},
+			},
+		},
+		{
+			name: "pinned nonce is skipped",
+			steps: []step{
+				{action: "pin", sender: a, nonce: 6, pending: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 7},
+			},
+		},
+		{
+			name: "nonce pinned below pending is rejected",
+			steps: []step{
+				{action: "pin", sender: a, nonce: 3, pending: 5, rejected: true},
+				{action: "empty"},
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+			},
+		},
+		{
+			name: "expired reservation",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "wait"},
+				{action: "wait"},
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+			},
+		},
+		{
+			name: "submission extends the reservation",
+			steps: []step{
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+				{action: "wait"},
+				{action: "submitted", sender: a, nonce: 5},
+				{action: "wait"},
+				{action: "reserve", sender: a, pending: 5, nonce: 6},
+			},
+		},
+		{
+			name: "submission of an unreserved nonce",
+			steps: []step{
+				{action: "submitted", sender: a, nonce: 5},
+				{action: "reserve", sender: a, pending: 5, nonce: 5},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewNonceManager(ttl)
+			for i, step := range test.steps {
+				switch step.action {
+				case "reserve":
+					if nonce := m.Reserve(step.sender, step.pending); nonce != step.nonce {
+						t.Fatalf("step %d: reserved %d, expected %d", i, nonce, step.nonce)
+					}
+				case "pin":
+					if err := m.Pin(step.sender, step.nonce, step.pending); (err != nil) != step.rejected {
+						t.Fatalf("step %d: pin error %v, expected rejected %v", i, err, step.rejected)
+					}
+				case "submitted":
+					m.Submitted(step.sender, step.nonce)
+				case "release":
+					m.Release(step.sender, step.nonce)
+				case "wait":
+					time.Sleep(ttl * 6 / 10)
+				case "empty":
+					m.mu.Lock()
+					held := len(m.reserved)
+					m.mu.Unlock()
+					if held != 0 {
+						t.Fatalf("step %d: %d senders hold reservations, expected none", i, held)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseNonce(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      interface{}
+		expected uint64
+		err      bool
+	}{
+		{name: "number", raw: float64(7), expected: 7},
+		{name: "zero", raw: float64(0), expected: 0},
+		{name: "string", raw: "18446744073709551615", expected: 18446744073709551615},
+		{name: "negative number", raw: float64(-1), err: true},
+		{name: "fraction", raw: 1.5, err: true},
+		{name: "negative string", raw: "-1", err: true},
+		{name: "hex string", raw: "0x10", err: true},
+		{name: "other type", raw: true, err: true},
+		{name: "missing", raw: nil, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nonce, err := parseNonce(test.raw)
+			if test.err {
+				if err == nil {
+					t.Fatalf("parsed %d, expected an error", nonce)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nonce != test.expected {
+				t.Errorf("nonce %d, expected %d", nonce, test.expected)
+			}
+		})
+	}
+}
+
+func TestNonceOptions(t *testing.T) {
+	nonce, pinned, err := pinnedNonce(map[string]interface{}{})
+	if nonce != 0 || pinned || err != nil {
+		t.Errorf("no nonce: got %d %v %v", nonce, pinned, err)
+	}
+	if _, _, err := pinnedNonce(map[string]interface{}{MetadataNonce: "x"}); err == nil {
+		t.Error("invalid nonce accepted")
+	}
+
+	options := map[string]interface{}{optionNonce: "12", "From": "0x"}
+	nonce, pinned, err = takeNonceOption(options)
+	if nonce != 12 || !pinned || err != nil {
+		t.Errorf("pinned nonce: got %d %v %v", nonce, pinned, err)
+	}
+	if _, ok := options[optionNonce]; ok || len(options) != 1 {
+		t.Errorf("options %v, expected the nonce option removed", options)
+	}
+}
+
+func TestAssignNonce(t *testing.T) {
+	sender := common.HexToAddress("0xaa00000000000000000000000000000000000001")
+	tests := []struct {
+		name     string
+		manager  bool
+		nonce    uint64
+		pinned   bool
+		expected uint64
+		rejected bool
+	}{
+		{name: "pending nonce", manager: true, expected: 5},
+		{name: "pinned at pending", manager: true, nonce: 5, pinned: true, expected: 5},
+		{name: "pinned above pending", manager: true, nonce: 8, pinned: true, expected: 8},
+		{name: "pinned below pending", manager: true, nonce: 4, pinned: true, rejected: true},
+		{name: "pinned above pending without manager", nonce: 8, pinned: true, expected: 8},
+		{name: "pinned below pending without manager", nonce: 4, pinned: true, rejected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &ConstructionAPIService{}
+			if test.manager {
+				s.nonces = NewNonceManager(time.Minute)
+			}
+			// Core returns the pending nonce of the sender
+			tx := &airgap.TxMetadata{From: sender, Nonce: 5}
+			clientErr := s.assignNonce(context.Background(), tx, test.nonce, test.pinned)
+			if test.rejected {
+				if clientErr != ErrValidation {
+					t.Fatalf("got %v, expected ErrValidation", clientErr)
+				}
+				return
+			}
+			if clientErr != nil {
+				t.Fatal(clientErr)
+			}
+			if tx.Nonce != test.expected {
+				t.Errorf("nonce %d, expected %d", tx.Nonce, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"github.com/celo-org/celo-blockchain/accounts/abi"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Operation metadata set on the cUSD movements of transactions that do not
+// call the StableToken directly
+const (
+	MetadataIntent       = "intent"
+	MetadataContract     = "contract"
+	MetadataContractName = "contract_name"
+
+	// cUSD bought from the Exchange with CELO
+	IntentExchangeBuy = "exchange_buy"
+	// cUSD sold to the Exchange for CELO
+	IntentExchangeSell = "exchange_sell"
+	// cUSD moved by any other contract, or by a contract deployment
+	IntentContractTransfer = "contract_transfer"
+)
+
+// Tags the operations of tx with the contract it called and the intent of
+// the call, unless tx calls the StableToken directly (a user payment).
+func (s *BlockAPIService) tagOperations(tx *types.Transaction, nodeTx *nodeTransaction) {
+	if nodeTx.To != nil && *nodeTx.To == s.stableToken.Address {
+		return
+	}
+
+	metadata := map[string]interface{}{
+		MetadataIntent: IntentContractTransfer,
+	}
+	if nodeTx.To != nil {
+		metadata[MetadataContract] = nodeTx.To.Hex()
+		switch *nodeTx.To {
+		case s.stableToken.ExchangeAddress:
+			metadata[MetadataContractName] = "Exchange"
+			if intent, ok := exchangeIntent(s.stableToken.ExchangeABI, nodeTx.Input); ok {
+				metadata[MetadataIntent] = intent
+			}
+		case s.stableToken.ReserveAddress:
+			metadata[MetadataContractName] = "Reserve"
+		}
+	}
+
+	for _, op := range tx.Operations {
+		if op.Metadata == nil {
+			op.Metadata = make(map[string]interface{})
+		}
+		for k, v := range metadata {
+			op.Metadata[k] = v
+		}
+	}
+}
+
+// Whether an Exchange call buys or sells cUSD: sell(sellAmount,
+// minBuyAmount, sellGold) and its deprecated alias exchange() buy cUSD
+// when selling CELO, buy(buyAmount, maxSellAmount, buyGold) sells cUSD
+// when buying CELO.
+func exchangeIntent(exchangeABI *abi.ABI, input []byte) (string, bool) {
+	if exchangeABI == nil || len(input) < 4 {
+		return "", false
+	}
+	method, err := exchangeABI.MethodById(input[:4])
+	if err != nil {
+		return "", false
+	}
+	values, err := method.Inputs.UnpackValues(input[4:])
+	if err != nil || len(values) != 3 {
+		return "", false
+	}
+	goldSide, ok := values[2].(bool)
+	if !ok {
+		return "", false
+	}
+	switch method.Name {
+	case "sell", "exchange":
+		if goldSide {
+			return IntentExchangeBuy, true
+		}
+		return IntentExchangeSell, true
+	case "buy":
+		if goldSide {
+			return IntentExchangeSell, true
+		}
+		return IntentExchangeBuy, true
+	}
+	return "", false
+}
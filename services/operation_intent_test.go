@@ -0,0 +1,214 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func TestTagOperations(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := common.HexToAddress("0xaa00000000000000000000000000000000000001")
+	payee := common.HexToAddress("0xbb00000000000000000000000000000000000002")
+	pool := common.HexToAddress("0xcc00000000000000000000000000000000000003")
+	pack := func(method string, args ...interface{}) []byte {
+		data, err := stableToken.ExchangeABI.Pack(method, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	transfer, err := stableToken.ABI.Pack("transfer", payee, big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := big.NewInt(1), big.NewInt(2)
+	exchange := map[string]interface{}{
+		MetadataContract:     stableToken.ExchangeAddress.Hex(),
+		MetadataContractName: "Exchange",
+	}
+	with := func(metadata map[string]interface{}, intent string) map[string]interface{} {
+		tagged := map[string]interface{}{MetadataIntent: intent}
+		for k, v := range metadata {
+			tagged[k] = v
+		}
+		return tagged
+	}
+
+	tests := []struct {
+		name     string
+		to       *common.Address
+		input    []byte
+		expected map[string]interface{}
+	}{
+		{
+			name:     "sell cUSD",
+			to:       &stableToken.ExchangeAddress,
+			input:    pack("sell", one, two, false),
+			expected: with(exchange, IntentExchangeSell),
+		},
+		{
+			name:     "buy cUSD",
+			to:       &stableToken.ExchangeAddress,
+			input:    pack("buy", one, two, false),
+			expected: with(exchange, IntentExchangeBuy),
+		},
+		{
+			name:     "sell CELO",
+			to:       &stableToken.ExchangeAddress,
+			input:    pack("sell", one, two, true),
+			expected: with(exchange, IntentExchangeBuy),
+		},
+		{
+			name:     "other Exchange method",
+			to:       &stableToken.ExchangeAddress,
+			input:    []byte{1, 2, 3, 4},
+			expected: with(exchange, IntentContractTransfer),
+		},
+		{
+			name: "Reserve",
+			to:   &stableToken.ReserveAddress,
+			expected: map[string]interface{}{
+				MetadataIntent:       IntentContractTransfer,
+				MetadataContract:     stableToken.ReserveAddress.Hex(),
+				MetadataContractName: "Reserve",
+			},
+		},
+		{
+			name:  "other contract",
+			to:    &pool,
+			input: pack("sell", one, two, false),
+			expected: map[string]interface{}{
+				MetadataIntent:   IntentContractTransfer,
+				MetadataContract: pool.Hex(),
+			},
+		},
+		{
+			name:     "contract deployment",
+			expected: map[string]interface{}{MetadataIntent: IntentContractTransfer},
+		},
+		{
+			// A user payment is left untagged
+			name:  "plain transfer",
+			to:    &stableToken.Address,
+			input: transfer,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &BlockAPIService{stableToken: stableToken}
+			tx := &types.Transaction{
+				Operations: []*types.Operation{
+					{Type: OpTransfer, Metadata: map[string]interface{}{"log_index": 3}},
+					{Type: OpTransfer},
+				},
+			}
+			s.tagOperations(tx, &nodeTransaction{From: sender, To: test.to, Input: test.input})
+
+			for i, op := range tx.Operations {
+				expected := make(map[string]interface{})
+				if i == 0 {
+					// Existing metadata is kept
+					expected["log_index"] = 3
+				}
+				for k, v := range test.expected {
+					expected[k] = v
+				}
+				if len(expected) == 0 {
+					expected = nil
+				}
+				if !reflect.DeepEqual(op.Metadata, expected) {
+					t.Errorf("operation %d metadata %v, expected %v", i, op.Metadata, expected)
+				}
+			}
+		})
+	}
+}
+
+// Without a node the calling transaction is unknown, so operations are not tagged.
+func TestTagOperationsWithoutNode(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &BlockAPIService{stableToken: stableToken}
+	tx := &types.Transaction{
+		TransactionIdentifier: &types.TransactionIdentifier{Hash: common.BigToHash(big.NewInt(1)).Hex()},
+		Operations:            []*types.Operation{{Type: OpTransfer}},
+	}
+	block := &types.BlockIdentifier{Index: 1, Hash: common.BigToHash(big.NewInt(2)).Hex()}
+	if clientErr := s.addTransactionMetadata(context.Background(), block, []*types.Transaction{tx}); clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	if tx.Metadata != nil || tx.Operations[0].Metadata != nil {
+		t.Errorf("metadata %v, operation metadata %v, expected none", tx.Metadata, tx.Operations[0].Metadata)
+	}
+}
+
+func TestExchangeIntent(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeABI := stableToken.ExchangeABI
+	pack := func(method string, args ...interface{}) []byte {
+		data, err := exchangeABI.Pack(method, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	one, two := big.NewInt(1), big.NewInt(2)
+
+	tests := []struct {
+		name     string
+		abi      bool
+		input    []byte
+		expected string
+	}{
+		{name: "sell CELO", abi: true, input: pack("sell", one, two, true), expected: IntentExchangeBuy},
+		{name: "sell cUSD", abi: true, input: pack("sell", one, two, false), expected: IntentExchangeSell},
+		{name: "exchange CELO", abi: true, input: pack("exchange", one, two, true), expected: IntentExchangeBuy},
+		{name: "exchange cUSD", abi: true, input: pack("exchange", one, two, false), expected: IntentExchangeSell},
+		{name: "buy CELO", abi: true, input: pack("buy", one, two, true), expected: IntentExchangeSell},
+		{name: "buy cUSD", abi: true, input: pack("buy", one, two, false), expected: IntentExchangeBuy},
+		{name: "other method", abi: true, input: pack("getBuyTokenAmount", one, true)},
+		{name: "unknown method", abi: true, input: []byte{1, 2, 3, 4}},
+		{name: "short input", abi: true, input: []byte{1, 2}},
+		{name: "truncated arguments", abi: true, input: pack("sell", one, two, true)[:40]},
+		{name: "no ABI", input: pack("sell", one, two, true)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			abi := exchangeABI
+			if !test.abi {
+				abi = nil
+			}
+			intent, ok := exchangeIntent(abi, test.input)
+			if ok != (test.expected != "") || intent != test.expected {
+				t.Errorf("intent %q %v, expected %q", intent, ok, test.expected)
+			}
+		})
+	}
+}
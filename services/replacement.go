@@ -0,0 +1,236 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/celo-blockchain/common/hexutil"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/parser"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// A pending transaction is replaced by another transaction of its sender
+// with the same nonce and a higher gas price. A replacement is requested by
+// passing the hash of the pending transaction in the preprocess metadata,
+// under "replace_tx" along with the operations of the new transaction, or
+// under "cancel_tx" along with a zero-value cUSD transfer of the sender to
+// itself, which is the cheapest transaction taking the nonce.
+
+const (
+	// Preprocess metadata keys requesting the replacement of a pending transaction
+	MetadataReplaceTx = "replace_tx"
+	MetadataCancelTx  = "cancel_tx"
+	// Metadata keys returned for replacements by /construction/metadata,
+	// /construction/parse and /construction/submit
+	MetadataReplacement = "replacement"
+	MetadataReplacesTx  = "replaces_tx"
+	ReplacementReplace  = "replace"
+	ReplacementCancel   = "cancel"
+
+	// Preprocess options only used by this module, not forwarded to core
+	optionReplaceTx   = "replace_tx"
+	optionReplacement = "replacement"
+
+	// Least increase of the gas price of a replacement, in percent, for the
+	// transaction pool of the node to accept it
+	replacementPriceBump = 10
+)
+
+// Reads the replacement requested in preprocess metadata, if any: its kind
+// and the hash of the pending transaction to replace.
+func replacementRequest(metadata map[string]interface{}) (string, common.Hash, error) {
+	rawReplace, replace := metadata[MetadataReplaceTx]
+	rawCancel, cancel := metadata[MetadataCancelTx]
+	var kind string
+	var raw interface{}
+	switch {
+	case replace && cancel:
+		return "", common.Hash{}, fmt.Errorf("only one of %s and %s may be given", MetadataReplaceTx, MetadataCancelTx)
+	case replace:
+		kind, raw = ReplacementReplace, rawReplace
+	case cancel:
+		kind, raw = ReplacementCancel, rawCancel
+	default:
+		return "", common.Hash{}, nil
+	}
+	hash, _ := raw.(string)
+	if bytes, err := hexutil.Decode(hash); err != nil || len(bytes) != common.HashLength {
+		return "", common.Hash{}, fmt.Errorf("invalid transaction hash %v", raw)
+	}
+	return kind, common.HexToHash(hash), nil
+}
+
+// Parses the zero-value cUSD transfer of an account to itself cancelling a
+// pending transaction, returning the account.
+func parseCancellation(ops []*types.Operation) (*common.Address, error) {
+	descriptions := &parser.Descriptions{
+		OperationDescriptions: []*parser.OperationDescription{
+			{
+				Type:    OpTransfer,
+				Account: &parser.AccountDescription{Exists: true},
+				Amount: &parser.AmountDescription{
+					Exists:   true,
+					Currency: CeloDollar,
+				},
+			},
+			{
+				Type:    OpTransfer,
+				Account: &parser.AccountDescription{Exists: true},
+				Amount: &parser.AmountDescription{
+					Exists:   true,
+					Currency: CeloDollar,
+				},
+			},
+		},
+		EqualAddresses: [][]int{{0, 1}},
+		ErrUnmatched:   true,
+	}
+	matches, err := parser.MatchOperations(descriptions, ops)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		op, _ := match.First()
+		if value, ok := new(big.Int).SetString(op.Amount.Value, 10); !ok || value.Sign() != 0 {
+			return nil, errors.New("a cancellation must transfer zero cUSD")
+		}
+	}
+	op, _ := matches[0].First()
+	account, ok := rpc.ChecksumAddress(op.Account.Address)
+	if !ok {
+		return nil, errors.New("invalid cancellation account")
+	}
+	return account, nil
+}
+
+// Preprocess options for the zero-value transfer of account to itself.
+func cancellationOptions(account *common.Address) map[string]interface{} {
+	return map[string]interface{}{
+		"From":   account.String(),
+		"Method": "StableToken.transfer",
+		"Args":   []string{account.String(), "0"},
+	}
+}
+
+// Removes the replacement options from options, returning the kind of
+// replacement (empty for other transactions) and the transaction replaced.
+func takeReplacementOptions(options map[string]interface{}) (string, common.Hash) {
+	kind, _ := options[optionReplacement].(string)
+	hash, _ := options[optionReplaceTx].(string)
+	delete(options, optionReplacement)
+	delete(options, optionReplaceTx)
+	return kind, common.HexToHash(hash)
+}
+
+// Fetches the pending transaction of from to replace.
+func (s *ConstructionAPIService) pendingTransaction(
+	ctx context.Context,
+	hash common.Hash,
+	from string,
+) (*nodeTransaction, *types.Error) {
+	if s.node == nil {
+		loggerFrom(ctx).Info("replacing transactions requires --node.url")
+		return nil, ErrUnimplemented
+	}
+	tx, err := s.node.transaction(ctx, hash)
+	if err != nil {
+		return nil, nodeError(ctx, "eth_getTransactionByHash", err)
+	}
+	if tx == nil || tx.BlockHash != nil {
+		notPending := *ErrNotPending
+		notPending.Details = map[string]interface{}{
+			"tx_hash": hash.Hex(),
+		}
+		return nil, &notPending
+	}
+	if tx.From != common.HexToAddress(from) {
+		loggerFrom(ctx).Info("replacement sent from another account", "tx_hash", hash.Hex(), "from", from)
+		return nil, ErrValidation
+	}
+	return tx, nil
+}
+
+// Gives tx the nonce of pending and a gas price high enough to replace it.
+func setReplacement(tx *airgap.TxMetadata, pending *nodeTransaction) error {
+	if (tx.FeeCurrency == nil) != (pending.FeeCurrency == nil) ||
+		tx.FeeCurrency != nil && *tx.FeeCurrency != *pending.FeeCurrency {
+		return errors.New("a replacement must pay fees in the currency of the transaction it replaces")
+	}
+	if pending.GasPrice == nil {
+		return errors.New("the node returned no gas price for the transaction to replace")
+	}
+	tx.Nonce = uint64(pending.Nonce)
+	minPrice := new(big.Int).Mul((*big.Int)(pending.GasPrice), big.NewInt(100+replacementPriceBump))
+	minPrice.Add(minPrice, big.NewInt(99)).Div(minPrice, big.NewInt(100))
+	if tx.GasPrice == nil || tx.GasPrice.Cmp(minPrice) < 0 {
+		tx.GasPrice = minPrice
+	}
+	return nil
+}
+
+// Whether tx, of the given hash if signed, replaces a pending transaction
+// of its sender, and how: the kind of replacement, or empty.
+func (s *ConstructionAPIService) replacementIntent(
+	ctx context.Context,
+	tx *airgap.TxMetadata,
+	hash *common.Hash,
+) (string, error) {
+	if hash != nil {
+		// A transaction the node knows of replaces nothing
+		known, err := s.node.transaction(ctx, *hash)
+		if err != nil {
+			return "", err
+		}
+		if known != nil {
+			return "", nil
+		}
+	}
+	latest, pending, err := s.node.nonces(ctx, tx.From)
+	if err != nil {
+		return "", err
+	}
+	if tx.Nonce < latest || tx.Nonce >= pending {
+		return "", nil
+	}
+	if s.isCancellation(tx) {
+		return ReplacementCancel, nil
+	}
+	return ReplacementReplace, nil
+}
+
+// Whether tx is a zero-value cUSD transfer of its sender to itself.
+func (s *ConstructionAPIService) isCancellation(tx *airgap.TxMetadata) bool {
+	if tx.To != s.stableToken.Address || len(tx.Data) < 4 {
+		return false
+	}
+	method, err := s.stableToken.ABI.MethodById(tx.Data[:4])
+	if err != nil || method.Name != "transfer" {
+		return false
+	}
+	values, err := method.Inputs.UnpackValues(tx.Data[4:])
+	if err != nil || len(values) != 2 {
+		return false
+	}
+	to, ok1 := values[0].(common.Address)
+	value, ok2 := values[1].(*big.Int)
+	return ok1 && ok2 && to == tx.From && value.Sign() == 0
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/celo-blockchain/common/hexutil"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func TestParseCancellation(t *testing.T) {
+	other := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	celoOps := transferOps(testAccount, testAccount, "0")
+	for _, op := range celoOps {
+		op.Amount.Currency = CeloGold
+	}
+	tests := []struct {
+		name  string
+		ops   []*types.Operation
+		valid bool
+		err   string
+	}{
+		{name: "zero transfer to self", ops: transferOps(testAccount, testAccount, "0"), valid: true},
+		{name: "non zero transfer", ops: transferOps(testAccount, testAccount, "1"), err: "must transfer zero cUSD"},
+		{name: "transfer to another account", ops: transferOps(testAccount, other, "0")},
+		{name: "CELO transfer", ops: celoOps},
+		{name: "single operation", ops: transferOps(testAccount, testAccount, "0")[:1]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			account, err := parseCancellation(test.ops)
+			if !test.valid {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *account != testAccount {
+				t.Errorf("account %s, expected %s", account.Hex(), testAccount.Hex())
+			}
+		})
+	}
+}
+
+func TestSetReplacement(t *testing.T) {
+	stableToken := common.HexToAddress("0x765DE816845861e75A25fCA122bb6898B8B1282a")
+	tests := []struct {
+		name             string
+		gasPrice         *big.Int
+		feeCurrency      *common.Address
+		pendingPrice     *hexutil.Big
+		pendingCurrency  *common.Address
+		expectedGasPrice int64
+		err              string
+	}{
+		{name: "price bumped", gasPrice: big.NewInt(100), pendingPrice: (*hexutil.Big)(big.NewInt(100)), expectedGasPrice: 110},
+		{name: "bump rounded up", gasPrice: big.NewInt(1), pendingPrice: (*hexutil.Big)(big.NewInt(101)), expectedGasPrice: 112},
+		{name: "no gas price", pendingPrice: (*hexutil.Big)(big.NewInt(100)), expectedGasPrice: 110},
+		{name: "higher price kept", gasPrice: big.NewInt(500), pendingPrice: (*hexutil.Big)(big.NewInt(100)), expectedGasPrice: 500},
+		{
+			name:             "same fee currency",
+			gasPrice:         big.NewInt(100),
+			feeCurrency:      &stableToken,
+			pendingPrice:     (*hexutil.Big)(big.NewInt(100)),
+			pendingCurrency:  &stableToken,
+			expectedGasPrice: 110,
+		},
+		{name: "pending price missing", gasPrice: big.NewInt(100), err: "no gas price"},
+		{
+			name:            "other fee currency",
+			gasPrice:        big.NewInt(100),
+			pendingPrice:    (*hexutil.Big)(big.NewInt(100)),
+			pendingCurrency: &stableToken,
+			err:             "fees in the currency",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &airgap.TxMetadata{Nonce: 9, GasPrice: test.gasPrice, FeeCurrency: test.feeCurrency}
+			pending := &nodeTransaction{Nonce: 3, GasPrice: test.pendingPrice, FeeCurrency: test.pendingCurrency}
+			err := setReplacement(tx, pending)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tx.Nonce != 3 || tx.GasPrice.Cmp(big.NewInt(test.expectedGasPrice)) != 0 {
+				t.Errorf("nonce %d gas price %s, expected 3 %d", tx.Nonce, tx.GasPrice, test.expectedGasPrice)
+			}
+		})
+	}
+}
+
+// A cancellation goes through preprocess, metadata, payloads and parse,
+// and parses back into the operations it was built from.
+func TestCancellationConstructionFlow(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkId := &types.NetworkIdentifier{Blockchain: "celo", Network: "mainnet"}
+	pendingHash := common.HexToHash("0x01")
+
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/construction/metadata" {
+			t.Errorf("unexpected core request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		var request types.ConstructionMetadataRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		if _, ok := request.Options[optionReplacement]; ok {
+			t.Error("replacement options forwarded to core")
+		}
+		// Core reads the pending nonce, above the transaction to cancel
+		metadata, err := airgap.MarshallToMap(&airgap.TxMetadata{
+			From:     testAccount,
+			To:       stableToken.Address,
+			Nonce:    4,
+			GasPrice: big.NewInt(50),
+			Gas:      50000,
+			ChainId:  big.NewInt(42220),
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&types.ConstructionMetadataResponse{Metadata: metadata})
+	}))
+	defer core.Close()
+	node := newTestNode(t, func(method string, params []json.RawMessage) interface{} {
+		switch method {
+		case "eth_getTransactionByHash":
+			return map[string]interface{}{
+				"hash":     pendingHash,
+				"from":     testAccount,
+				"nonce":    "0x3",
+				"gasPrice": "0x64",
+			}
+		case "eth_getTransactionCount":
+			if string(params[1]) == `"latest"` {
+				return "0x3"
+			}
+			return "0x4"
+		}
+		t.Errorf("unexpected node call %s", method)
+		return nil
+	})
+	s := NewConstructionAPIService(
+		client.NewAPIClient(client.NewConfiguration(core.URL, "test", core.Client())),
+		node,
+		stableToken,
+		nil,
+		nil,
+	)
+	ctx := context.Background()
+	ops := transferOps(testAccount, testAccount, "0")
+
+	preprocess, clientErr := s.ConstructionPreprocess(ctx, &types.ConstructionPreprocessRequest{
+		NetworkIdentifier: networkId,
+		Operations:        ops,
+		Metadata:          map[string]interface{}{MetadataCancelTx: pendingHash.Hex()},
+	})
+	if clientErr != nil {
+		t.Fatalf("preprocess: %v", clientErr)
+	}
+	metadata, clientErr := s.ConstructionMetadata(ctx, &types.ConstructionMetadataRequest{
+		NetworkIdentifier: networkId,
+		Options:           preprocess.Options,
+	})
+	if clientErr != nil {
+		t.Fatalf("metadata: %v", clientErr)
+	}
+	if metadata.Metadata[MetadataReplacement] != ReplacementCancel {
+		t.Errorf("replacement %v, expected %s", metadata.Metadata[MetadataReplacement], ReplacementCancel)
+	}
+	payloads, clientErr := s.ConstructionPayloads(ctx, &types.ConstructionPayloadsRequest{
+		NetworkIdentifier: networkId,
+		Operations:        ops,
+		Metadata:          metadata.Metadata,
+	})
+	if clientErr != nil {
+		t.Fatalf("payloads: %v", clientErr)
+	}
+
+	var unsigned airgap.Transaction
+	if err := json.Unmarshal([]byte(payloads.UnsignedTransaction), &unsigned); err != nil {
+		t.Fatal(err)
+	}
+	if unsigned.Nonce != 3 || unsigned.GasPrice.Cmp(big.NewInt(110)) != 0 {
+		t.Errorf("nonce %d gas price %s, expected 3 110", unsigned.Nonce, unsigned.GasPrice)
+	}
+	parsed, clientErr := s.ConstructionParse(ctx, &types.ConstructionParseRequest{
+		NetworkIdentifier: networkId,
+		Transaction:       payloads.UnsignedTransaction,
+	})
+	if clientErr != nil {
+		t.Fatalf("parse: %v", clientErr)
+	}
+	if got, expected := operationsJSON(t, parsed.Operations), operationsJSON(t, ops); got != expected {
+		t.Errorf("operations %s, expected %s", got, expected)
+	}
+	if parsed.Metadata[MetadataReplacement] != ReplacementCancel {
+		t.Errorf("parsed replacement %v, expected %s", parsed.Metadata[MetadataReplacement], ReplacementCancel)
+	}
+}
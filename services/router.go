@@ -23,37 +23,52 @@ import (
 )
 
 // Creates a Mux http.Handler from a collection of server controllers.
+// Any extraRouters (e.g. the webhook admin API) are served alongside the Rosetta endpoints.
 func CreateRouter(
 	client *client.APIClient,
+	node *NodeClient,
 	asserter *asserter.Asserter,
 	stableToken *StableToken,
+	nonces *NonceManager,
+	submissions *SubmissionTracker,
+	extraRouters ...server.Router,
 ) (http.Handler, error) {
 
 	// Proxy calls to /network from core rosetta
-	networkAPIService := NewNetworkAPIService(client)
+	networkAPIService := NewNetworkAPIService(client, stableToken)
 	networkAPIController := server.NewNetworkAPIController(networkAPIService, asserter)
 
 	// Proxy calls to /account from core rosetta + implement own options
-	blockAPIService := NewBlockAPIService(client, stableToken)
+	blockAPIService := NewBlockAPIService(client, node, stableToken)
 	blockAPIController := server.NewBlockAPIController(blockAPIService, asserter)
+	// Non-standard bulk endpoint for backfills
+	blockRangeAPIController := NewBlockRangeAPIController(blockAPIService, asserter)
 
 	// Proxy calls to /mempool from core rosetta
 	mempoolAPIService := NewMempoolAPIService(client)
 	mempoolAPIController := server.NewMempoolAPIController(mempoolAPIService, asserter)
 
 	// Proxy calls to /account from core rosetta + implement own options
-	accountAPIService := NewAccountAPIService(client)
+	accountAPIService := NewAccountAPIService(client, blockAPIService, stableToken)
 	accountAPIController := server.NewAccountAPIController(accountAPIService, asserter)
 
+	// Implement /call with cUSD specific methods
+	supplyService := NewSupplyService(client, blockAPIService, stableToken)
+	callAPIService := NewCallAPIService(client, stableToken, supplyService)
+	callAPIController := server.NewCallAPIController(callAPIService, asserter)
+
 	// Proxy calls to /construction/* from core rosetta + implement own options
-	constructionAPIService := NewConstructionAPIService(client, stableToken)
+	constructionAPIService := NewConstructionAPIService(client, node, stableToken, nonces, submissions)
 	constructionAPIController := server.NewConstructionAPIController(constructionAPIService, asserter)
 
-	return server.NewRouter(
+	routers := []server.Router{
 		networkAPIController,
 		blockAPIController,
+		blockRangeAPIController,
 		mempoolAPIController,
 		accountAPIController,
+		callAPIController,
 		constructionAPIController,
-	), nil
+	}
+	return server.NewRouter(append(routers, extraRouters...)...), nil
 }
@@ -0,0 +1,261 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/server"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	streamHeartbeatInterval = 15 * time.Second
+	// Events buffered per client before it is considered too slow and dropped
+	streamClientBuffer = 256
+)
+
+// Event sent to stream clients for every matching cUSD transaction.
+type StreamEvent struct {
+	BlockIdentifier *types.BlockIdentifier `json:"block_identifier"`
+	Timestamp       int64                  `json:"timestamp"`
+	Transaction     *types.Transaction     `json:"transaction"`
+}
+
+// Restricts the transactions sent to a stream client. A transaction matches
+// if any of its operations satisfies every filter that is set.
+type StreamFilter struct {
+	Addresses map[common.Address]struct{}
+	OpTypes   map[string]struct{}
+	MinAmount *big.Int
+}
+
+func (f *StreamFilter) matches(tx *types.Transaction) bool {
+	for _, op := range tx.Operations {
+		if f.matchesOp(op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *StreamFilter) matchesOp(op *types.Operation) bool {
+	if len(f.Addresses) > 0 {
+		if op.Account == nil {
+			return false
+		}
+		if _, ok := f.Addresses[common.HexToAddress(op.Account.Address)]; !ok {
+			return false
+		}
+	}
+	if len(f.OpTypes) > 0 {
+		if _, ok := f.OpTypes[op.Type]; !ok {
+			return false
+		}
+	}
+	if f.MinAmount != nil {
+		if op.Amount == nil {
+			return false
+		}
+		value, ok := new(big.Int).SetString(op.Amount.Value, 10)
+		if !ok || value.Abs(value).Cmp(f.MinAmount) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type streamClient struct {
+	filter *StreamFilter
+	events chan *StreamEvent
+}
+
+// Fans out cUSD transactions from blocks delivered by a BlockWatcher
+// to Server-Sent Events clients. Implements the server.Router interface.
+type StreamService struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+}
+
+func NewStreamService() *StreamService {
+	return &StreamService{
+		clients: make(map[*streamClient]struct{}),
+	}
+}
+
+func (s *StreamService) Routes() server.Routes {
+	return server.Routes{
+		{
+			Name:        "StreamTransactions",
+			Method:      http.MethodGet,
+			Pattern:     "/stream/transactions",
+			HandlerFunc: s.StreamTransactions,
+		},
+	}
+}
+
+// Implements BlockHandler.
+func (s *StreamService) HandleBlock(ctx context.Context, block *types.Block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tx := range block.Transactions {
+		event := &StreamEvent{
+			BlockIdentifier: block.BlockIdentifier,
+			Timestamp:       block.Timestamp,
+			Transaction:     tx,
+		}
+		for client := range s.clients {
+			if !client.filter.matches(tx) {
+				continue
+			}
+			select {
+			case client.events <- event:
+			default:
+				// Disconnect clients that cannot keep up rather than block the watcher
+				close(client.events)
+				delete(s.clients, client)
+			}
+		}
+	}
+}
+
+func (s *StreamService) subscribe(filter *StreamFilter) *streamClient {
+	client := &streamClient{
+		filter: filter,
+		events: make(chan *StreamEvent, streamClientBuffer),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[client] = struct{}{}
+	return client
+}
+
+func (s *StreamService) unsubscribe(client *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[client]; ok {
+		close(client.events)
+		delete(s.clients, client)
+	}
+}
+
+// endpoint: /stream/transactions
+//
+// Query parameters (all optional, repeatable unless noted):
+//
+//	address     only transactions with an operation on this account
+//	type        only transactions with an operation of this type
+//	min_amount  only operations moving at least this many base units (single value)
+func (s *StreamService) StreamTransactions(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrInternal, errors.New("streaming unsupported"))
+		return
+	}
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+
+	client := s.subscribe(filter)
+	defer s.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				loggerFrom(r.Context()).Error("could not encode stream event", "error", err)
+				continue
+			}
+			_, err = fmt.Fprintf(
+				w,
+				"id: %d:%s\nevent: transaction\ndata: %s\n\n",
+				event.BlockIdentifier.Index,
+				event.Transaction.TransactionIdentifier.Hash,
+				data,
+			)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func parseStreamFilter(r *http.Request) (*StreamFilter, error) {
+	query := r.URL.Query()
+	filter := &StreamFilter{
+		Addresses: make(map[common.Address]struct{}),
+		OpTypes:   make(map[string]struct{}),
+	}
+	for _, addr := range query["address"] {
+		checksummed, ok := rpc.ChecksumAddress(addr)
+		if !ok {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+		filter.Addresses[*checksummed] = struct{}{}
+	}
+	for _, opType := range query["type"] {
+		if !isOperationType(opType) {
+			return nil, fmt.Errorf("unknown operation type %q", opType)
+		}
+		filter.OpTypes[opType] = struct{}{}
+	}
+	if minAmount := query.Get("min_amount"); minAmount != "" {
+		value, ok := new(big.Int).SetString(minAmount, 10)
+		if !ok || value.Sign() < 0 {
+			return nil, fmt.Errorf("invalid min_amount %q", minAmount)
+		}
+		filter.MinAmount = value
+	}
+	return filter, nil
+}
+
+func isOperationType(opType string) bool {
+	for _, t := range AllOperationTypes {
+		if t == opType {
+			return true
+		}
+	}
+	return false
+}
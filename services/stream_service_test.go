@@ -0,0 +1,122 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func TestParseStreamFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		err       bool
+		addresses []string
+		opTypes   []string
+		minAmount string
+	}{
+		{name: "empty", query: ""},
+		{
+			name:      "addresses",
+			query:     "address=0x000000000000000000000000000000000000dEaD&address=0x0000000000000000000000000000000000000001",
+			addresses: []string{"0x000000000000000000000000000000000000dEaD", "0x0000000000000000000000000000000000000001"},
+		},
+		{name: "types", query: "type=transfer&type=mint", opTypes: []string{OpTransfer, OpMint}},
+		{name: "min amount", query: "min_amount=1000", minAmount: "1000"},
+		{name: "zero min amount", query: "min_amount=0", minAmount: "0"},
+		{name: "invalid address", query: "address=0x1234", err: true},
+		{name: "unknown type", query: "type=withdrawal", err: true},
+		{name: "negative min amount", query: "min_amount=-1", err: true},
+		{name: "decimal min amount", query: "min_amount=1.5", err: true},
+		{name: "hex min amount", query: "min_amount=0x10", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := parseStreamFilter(httptest.NewRequest("GET", "/stream?"+test.query, nil))
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(filter.Addresses) != len(test.addresses) {
+				t.Errorf("%d addresses, expected %d", len(filter.Addresses), len(test.addresses))
+			}
+			for _, addr := range test.addresses {
+				if _, ok := filter.Addresses[common.HexToAddress(addr)]; !ok {
+					t.Errorf("missing address %s", addr)
+				}
+			}
+			if len(filter.OpTypes) != len(test.opTypes) {
+				t.Errorf("%d operation types, expected %d", len(filter.OpTypes), len(test.opTypes))
+			}
+			for _, opType := range test.opTypes {
+				if _, ok := filter.OpTypes[opType]; !ok {
+					t.Errorf("missing operation type %s", opType)
+				}
+			}
+			switch {
+			case test.minAmount == "" && filter.MinAmount != nil:
+				t.Errorf("min amount %s, expected none", filter.MinAmount)
+			case test.minAmount != "" && (filter.MinAmount == nil || filter.MinAmount.String() != test.minAmount):
+				t.Errorf("min amount %v, expected %s", filter.MinAmount, test.minAmount)
+			}
+		})
+	}
+}
+
+func TestStreamFilterMatches(t *testing.T) {
+	filter, err := parseStreamFilter(httptest.NewRequest("GET", "/stream?address=0x000000000000000000000000000000000000dEaD&type=transfer&min_amount=100", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := func(address, opType, value string) *types.Operation {
+		return &types.Operation{
+			Type:    opType,
+			Account: &types.AccountIdentifier{Address: address},
+			Amount:  &types.Amount{Value: value, Currency: CeloDollar},
+		}
+	}
+	watched := "0x000000000000000000000000000000000000dead"
+	other := "0x0000000000000000000000000000000000000001"
+	tests := []struct {
+		name    string
+		op      *types.Operation
+		matches bool
+	}{
+		{"matching debit", op(watched, OpTransfer, "-100"), true},
+		{"matching credit", op(watched, OpTransfer, "250"), true},
+		{"other account", op(other, OpTransfer, "100"), false},
+		{"other type", op(watched, OpMint, "100"), false},
+		{"below min amount", op(watched, OpTransfer, "-99"), false},
+		{"no account", &types.Operation{Type: OpTransfer, Amount: &types.Amount{Value: "100"}}, false},
+		{"no amount", &types.Operation{Type: OpTransfer, Account: &types.AccountIdentifier{Address: watched}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &types.Transaction{Operations: []*types.Operation{test.op}}
+			if filter.matches(tx) != test.matches {
+				t.Errorf("matches %v, expected %v", !test.matches, test.matches)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/celo-org/celo-blockchain/common"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/coinbase/rosetta-sdk-go/asserter"
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/server"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Statuses of submitted transactions
+	SubmissionPending   = "pending"
+	SubmissionConfirmed = "confirmed"
+	SubmissionFailed    = "failed"
+
+	DefaultSubmissionRetention = 24 * time.Hour
+	// Confirmations after which a mined submission is no longer checked
+	DefaultSubmissionConfirmations = 10
+)
+
+// A transaction submitted through /construction/submit.
+type submission struct {
+	network     *types.NetworkIdentifier
+	signed      string
+	hash        common.Hash
+	from        common.Address
+	nonce       uint64
+	submittedAt time.Time
+
+	status       string
+	block        *types.BlockIdentifier
+	transaction  *types.Transaction
+	rebroadcasts int
+	// A later submission with the same sender and nonce
+	replacedBy *common.Hash
+}
+
+// Whether the status of sub no longer changes, given the latest block: it
+// failed without being mined, or was mined, its transaction read and its
+// block has the given number of confirmations. Mined transactions are
+// followed until then, in case their block is reorganized away.
+func (sub *submission) final(tip uint64, confirmations uint64) bool {
+	if sub.status == SubmissionPending {
+		return false
+	}
+	if sub.block == nil {
+		return true
+	}
+	return sub.transaction != nil && tip+1 >= uint64(sub.block.Index)+confirmations
+}
+
+// Follows the transactions submitted through this server until they are
+// mined: rebroadcasts those that drop out of the transaction pool of the
+// node, and marks as failed those whose nonce is taken by another
+// transaction. Submissions are kept in memory for the retention period,
+// and no longer polled once final.
+type SubmissionTracker struct {
+	client        *client.APIClient
+	node          *NodeClient
+	blockService  *BlockAPIService
+	interval      time.Duration
+	retention     time.Duration
+	confirmations uint64
+
+	mu          sync.Mutex
+	submissions map[common.Hash]*submission
+	tip         uint64
+}
+
+func NewSubmissionTracker(
+	client *client.APIClient,
+	node *NodeClient,
+	blockService *BlockAPIService,
+	interval time.Duration,
+	retention time.Duration,
+	confirmations uint64,
+) *SubmissionTracker {
+	return &SubmissionTracker{
+		client:        client,
+		node:          node,
+		blockService:  blockService,
+		interval:      interval,
+		retention:     retention,
+		confirmations: confirmations,
+		submissions:   make(map[common.Hash]*submission),
+	}
+}
+
+// Starts following a transaction accepted by /construction/submit.
+func (t *SubmissionTracker) Track(
+	network *types.NetworkIdentifier,
+	signed string,
+	tx *gethTypes.Transaction,
+	from common.Address,
+) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hash := tx.Hash()
+	if _, ok := t.submissions[hash]; ok {
+		return
+	}
+	for _, other := range t.submissions {
+		if other.status == SubmissionPending && other.from == from && other.nonce == tx.Nonce() {
+			other.replacedBy = &hash
+		}
+	}
+	t.submissions[hash] = &submission{
+		network:     network,
+		signed:      signed,
+		hash:        hash,
+		from:        from,
+		nonce:       tx.Nonce(),
+		submittedAt: time.Now(),
+		status:      SubmissionPending,
+	}
+}
+
+// Polls the node until ctx is cancelled.
+func (t *SubmissionTracker) Start(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		if err := t.poll(ctx); err != nil {
+			rootLogger.Warn("submission tracker could not poll the celo node", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *SubmissionTracker) poll(ctx context.Context) error {
+	tip, err := t.node.blockNumber(ctx)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.tip = tip
+	var tracked []*submission
+	for hash, sub := range t.submissions {
+		if time.Since(sub.submittedAt) > t.retention {
+			delete(t.submissions, hash)
+			continue
+		}
+		if sub.final(tip, t.confirmations) {
+			continue
+		}
+		copied := *sub
+		if sub.replacedBy != nil {
+			copied.replacedBy = t.liveReplacement(sub)
+		}
+		tracked = append(tracked, &copied)
+	}
+	t.mu.Unlock()
+
+	// Checked outside the lock, then written back
+	for _, sub := range tracked {
+		if err := t.check(WithCoreAffinity(ctx, ""), sub); err != nil {
+			rootLogger.Warn("could not check submitted transaction", "tx_hash", sub.hash.Hex(), "error", err)
+			continue
+		}
+		t.mu.Lock()
+		if current, ok := t.submissions[sub.hash]; ok {
+			current.status = sub.status
+			current.block = sub.block
+			current.transaction = sub.transaction
+			current.rebroadcasts = sub.rebroadcasts
+		}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// The last submission of the chain of replacements of sub that has not
+// failed without being mined, or nil if they all did. Called with t.mu held.
+func (t *SubmissionTracker) liveReplacement(sub *submission) *common.Hash {
+	var live *common.Hash
+	seen := map[common.Hash]bool{sub.hash: true}
+	for next := sub.replacedBy; next != nil && !seen[*next]; {
+		seen[*next] = true
+		replacement, ok := t.submissions[*next]
+		if !ok {
+			break
+		}
+		if replacement.status != SubmissionFailed || replacement.block != nil {
+			live = next
+		}
+		next = replacement.replacedBy
+	}
+	return live
+}
+
+// Updates the status of sub from the node, rebroadcasting it if the node
+// does not know it. A replaced submission is left to the live tip of its
+// chain of replacements, polled on its own, and only rebroadcast once all
+// its replacements failed; poll sets replacedBy to that tip.
+func (t *SubmissionTracker) check(ctx context.Context, sub *submission) error {
+	receipt, err := t.node.receipt(ctx, sub.hash)
+	if err != nil {
+		return err
+	}
+	if receipt != nil {
+		t.setMined(ctx, sub, receipt)
+		return nil
+	}
+
+	// Not mined, or no longer after a reorg
+	sub.status = SubmissionPending
+	sub.block = nil
+	sub.transaction = nil
+	latest, _, err := t.node.nonces(ctx, sub.from)
+	if err != nil {
+		return err
+	}
+	if latest > sub.nonce {
+		// The transaction may have been mined since its receipt was read
+		receipt, err := t.node.receipt(ctx, sub.hash)
+		if err != nil {
+			return err
+		}
+		if receipt != nil {
+			t.setMined(ctx, sub, receipt)
+			return nil
+		}
+		// Another transaction of the sender took the nonce
+		sub.status = SubmissionFailed
+		return nil
+	}
+	if sub.replacedBy != nil {
+		return nil
+	}
+	known, err := t.node.transaction(ctx, sub.hash)
+	if err != nil {
+		return err
+	}
+	if known == nil {
+		sub.rebroadcasts++
+		submissionRebroadcasts.inc()
+		_, _, err := t.client.ConstructionAPI.ConstructionSubmit(ctx, &types.ConstructionSubmitRequest{
+			NetworkIdentifier: sub.network,
+			SignedTransaction: sub.signed,
+		})
+		if err != nil {
+			rootLogger.Warn("could not rebroadcast transaction", "tx_hash", sub.hash.Hex(), "error", err)
+		}
+	}
+	return nil
+}
+
+// Updates sub, mined with the given receipt.
+func (t *SubmissionTracker) setMined(ctx context.Context, sub *submission, receipt *nodeReceipt) {
+	block := &types.BlockIdentifier{
+		Index: int64(receipt.BlockNumber),
+		Hash:  receipt.BlockHash.Hex(),
+	}
+	if uint64(receipt.Status) == gethTypes.ReceiptStatusSuccessful {
+		sub.status = SubmissionConfirmed
+	} else {
+		sub.status = SubmissionFailed
+	}
+	if sub.block == nil || sub.block.Hash != block.Hash || sub.transaction == nil {
+		sub.block = block
+		sub.transaction = nil
+		// The transaction as served by /block/transaction, once the block can be read
+		resp, clientErr := t.blockService.BlockTransaction(ctx, &types.BlockTransactionRequest{
+			NetworkIdentifier:     sub.network,
+			BlockIdentifier:       block,
+			TransactionIdentifier: &types.TransactionIdentifier{Hash: sub.hash.Hex()},
+		})
+		if clientErr == nil {
+			sub.transaction = resp.Transaction
+		}
+	}
+}
+
+// Request for the status of a transaction submitted through this server.
+type SubmissionStatusRequest struct {
+	NetworkIdentifier     *types.NetworkIdentifier     `json:"network_identifier"`
+	TransactionIdentifier *types.TransactionIdentifier `json:"transaction_identifier"`
+}
+
+type SubmissionStatusResponse struct {
+	TransactionIdentifier *types.TransactionIdentifier `json:"transaction_identifier"`
+	// pending, confirmed or failed
+	Status string `json:"status"`
+	// Number of blocks from the block including the transaction to the tip, both included
+	Confirmations   int64                  `json:"confirmations"`
+	BlockIdentifier *types.BlockIdentifier `json:"block_identifier,omitempty"`
+	// As returned by /block/transaction
+	Transaction  *types.Transaction           `json:"transaction,omitempty"`
+	Rebroadcasts int                          `json:"rebroadcasts"`
+	ReplacedBy   *types.TransactionIdentifier `json:"replaced_by,omitempty"`
+}
+
+func (t *SubmissionTracker) Status(
+	ctx context.Context,
+	request *SubmissionStatusRequest,
+) (*SubmissionStatusResponse, *types.Error) {
+	if request.TransactionIdentifier == nil {
+		return nil, ErrValidation
+	}
+	ctx = withLogFields(ctx, "tx_hash", request.TransactionIdentifier.Hash)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sub, ok := t.submissions[common.HexToHash(request.TransactionIdentifier.Hash)]
+	if !ok {
+		loggerFrom(ctx).Debug("transaction not tracked")
+		return nil, ErrNotTracked
+	}
+	resp := &SubmissionStatusResponse{
+		TransactionIdentifier: &types.TransactionIdentifier{Hash: sub.hash.Hex()},
+		Status:                sub.status,
+		BlockIdentifier:       sub.block,
+		Transaction:           sub.transaction,
+		Rebroadcasts:          sub.rebroadcasts,
+	}
+	if sub.block != nil && int64(t.tip) >= sub.block.Index {
+		resp.Confirmations = int64(t.tip) - sub.block.Index + 1
+	}
+	if sub.replacedBy != nil {
+		resp.ReplacedBy = &types.TransactionIdentifier{Hash: sub.replacedBy.Hex()}
+	}
+	return resp, nil
+}
+
+// Serves the non-standard /construction/status endpoint.
+// Implements the server.Router interface.
+type SubmissionAPIController struct {
+	tracker  *SubmissionTracker
+	asserter *asserter.Asserter
+}
+
+func NewSubmissionAPIController(tracker *SubmissionTracker, asserter *asserter.Asserter) *SubmissionAPIController {
+	return &SubmissionAPIController{
+		tracker:  tracker,
+		asserter: asserter,
+	}
+}
+
+func (c *SubmissionAPIController) Routes() server.Routes {
+	return server.Routes{
+		{
+			Name:        "ConstructionStatus",
+			Method:      http.MethodPost,
+			Pattern:     "/construction/status",
+			HandlerFunc: c.Status,
+		},
+	}
+}
+
+// endpoint: /construction/status
+func (c *SubmissionAPIController) Status(w http.ResponseWriter, r *http.Request) {
+	var request SubmissionStatusRequest
+	if err := decodeJSONRequest(r, &request); err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+	if err := c.asserter.ValidSupportedNetwork(request.NetworkIdentifier); err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+	resp, clientErr := c.tracker.Status(r.Context(), &request)
+	if clientErr != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, clientErr, nil)
+		return
+	}
+	encodeJSONResponse(w, http.StatusOK, resp)
+}
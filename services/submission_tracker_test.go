@@ -0,0 +1,323 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+var (
+	submissionAccount = common.HexToAddress("0x5")
+	submissionBlock   = common.HexToHash("0xb")
+)
+
+func testReceipt(status string) map[string]interface{} {
+	return map[string]interface{}{
+		"blockHash":   submissionBlock,
+		"blockNumber": "0xa",
+		"status":      status,
+		"gasUsed":     "0x0",
+	}
+}
+
+// A tracker whose node answers with handle, and whose core rosetta fails
+// every request, so that the transactions of mined submissions are not read.
+func newTestSubmissionTracker(t *testing.T, handle func(method string, params []json.RawMessage) interface{}) *SubmissionTracker {
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrCoreUnavailable)
+	}))
+	t.Cleanup(core.Close)
+	apiClient := client.NewAPIClient(client.NewConfiguration(core.URL, "test", core.Client()))
+	node := newTestNode(t, handle)
+	stableToken := &StableToken{Address: common.HexToAddress("0x1")}
+	return NewSubmissionTracker(
+		apiClient,
+		node,
+		NewBlockAPIService(apiClient, node, stableToken),
+		time.Second,
+		DefaultSubmissionRetention,
+		3,
+	)
+}
+
+func TestSubmissionTrackerCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		// Answers to the successive receipt requests
+		receipts []interface{}
+		latest   string
+		known    bool
+		// The block the submission was mined in when last checked
+		block *types.BlockIdentifier
+
+		status       string
+		mined        bool
+		rebroadcasts int
+	}{
+		{
+			name:     "mined",
+			receipts: []interface{}{testReceipt("0x1")},
+			status:   SubmissionConfirmed,
+			mined:    true,
+		},
+		{
+			// Its transaction is read again, which fails with core unavailable
+			name:     "mined in another block after a reorg",
+			receipts: []interface{}{testReceipt("0x1")},
+			block:    &types.BlockIdentifier{Index: 10, Hash: common.HexToHash("0xc").Hex()},
+			status:   SubmissionConfirmed,
+			mined:    true,
+		},
+		{
+			name:     "removed by a reorg",
+			receipts: []interface{}{nil},
+			latest:   "0x5",
+			known:    true,
+			block:    &types.BlockIdentifier{Index: 10, Hash: submissionBlock.Hex()},
+			status:   SubmissionPending,
+		},
+		{
+			name:     "reverted",
+			receipts: []interface{}{testReceipt("0x0")},
+			status:   SubmissionFailed,
+			mined:    true,
+		},
+		{
+			name:     "mined while the nonce was read",
+			receipts: []interface{}{nil, testReceipt("0x1")},
+			latest:   "0x6",
+			status:   SubmissionConfirmed,
+			mined:    true,
+		},
+		{
+			name:     "nonce taken",
+			receipts: []interface{}{nil, nil},
+			latest:   "0x6",
+			status:   SubmissionFailed,
+		},
+		{
+			name:     "in the transaction pool",
+			receipts: []interface{}{nil},
+			latest:   "0x5",
+			known:    true,
+			status:   SubmissionPending,
+		},
+		{
+			name:         "dropped",
+			receipts:     []interface{}{nil},
+			latest:       "0x5",
+			status:       SubmissionPending,
+			rebroadcasts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipts := 0
+			tracker := newTestSubmissionTracker(t, func(method string, params []json.RawMessage) interface{} {
+				switch method {
+				case "eth_getTransactionReceipt":
+					receipts++
+					if receipts > len(tt.receipts) {
+						t.Errorf("unexpected receipt request %d", receipts)
+						return nil
+					}
+					return tt.receipts[receipts-1]
+				case "eth_getTransactionCount":
+					return tt.latest
+				case "eth_getTransactionByHash":
+					if !tt.known {
+						return nil
+					}
+					return map[string]interface{}{"from": submissionAccount, "nonce": "0x5"}
+				}
+				t.Errorf("unexpected node call %s", method)
+				return nil
+			})
+			sub := &submission{
+				network: &types.NetworkIdentifier{Blockchain: "celo", Network: "mainnet"},
+				hash:    common.HexToHash("0x1"),
+				from:    submissionAccount,
+				nonce:   5,
+				status:  SubmissionPending,
+			}
+			if tt.block != nil {
+				sub.status = SubmissionConfirmed
+				sub.block = tt.block
+				sub.transaction = &types.Transaction{}
+			}
+			if err := tracker.check(context.Background(), sub); err != nil {
+				t.Fatal(err)
+			}
+			if receipts != len(tt.receipts) {
+				t.Errorf("receipt requests = %d, want %d", receipts, len(tt.receipts))
+			}
+			if sub.status != tt.status {
+				t.Errorf("status = %s, want %s", sub.status, tt.status)
+			}
+			if tt.block != nil && sub.transaction != nil {
+				t.Error("transaction of the previous block kept")
+			}
+			if mined := sub.block != nil; mined != tt.mined {
+				t.Errorf("mined = %v, want %v", mined, tt.mined)
+			} else if mined && sub.block.Hash != submissionBlock.Hex() {
+				t.Errorf("block = %s, want %s", sub.block.Hash, submissionBlock.Hex())
+			}
+			if sub.rebroadcasts != tt.rebroadcasts {
+				t.Errorf("rebroadcasts = %d, want %d", sub.rebroadcasts, tt.rebroadcasts)
+			}
+		})
+	}
+}
+
+func TestSubmissionTrackerLiveReplacement(t *testing.T) {
+	hash := func(i int64) *common.Hash {
+		h := common.BigToHash(big.NewInt(i))
+		return &h
+	}
+	mined := &types.BlockIdentifier{Index: 10, Hash: submissionBlock.Hex()}
+	tests := []struct {
+		name string
+		// Submissions 1, 2, ... each replacing the previous one
+		chain []*submission
+		live  *common.Hash
+	}{
+		{
+			name:  "pending replacement",
+			chain: []*submission{{status: SubmissionPending}, {status: SubmissionPending}},
+			live:  hash(2),
+		},
+		{
+			name: "tip of the chain",
+			chain: []*submission{
+				{status: SubmissionPending},
+				{status: SubmissionPending},
+				{status: SubmissionPending},
+			},
+			live: hash(3),
+		},
+		{
+			name: "failed tip",
+			chain: []*submission{
+				{status: SubmissionPending},
+				{status: SubmissionPending},
+				{status: SubmissionFailed},
+			},
+			live: hash(2),
+		},
+		{
+			name:  "mined replacement",
+			chain: []*submission{{status: SubmissionPending}, {status: SubmissionFailed, block: mined}},
+			live:  hash(2),
+		},
+		{
+			name:  "all replacements failed",
+			chain: []*submission{{status: SubmissionPending}, {status: SubmissionFailed}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewSubmissionTracker(nil, nil, nil, time.Second, DefaultSubmissionRetention, 3)
+			for i, sub := range tt.chain {
+				sub.hash = *hash(int64(i + 1))
+				if i+1 < len(tt.chain) {
+					sub.replacedBy = hash(int64(i + 2))
+				}
+				tracker.submissions[sub.hash] = sub
+			}
+			live := tracker.liveReplacement(tt.chain[0])
+			if (live == nil) != (tt.live == nil) || live != nil && *live != *tt.live {
+				t.Errorf("live replacement = %v, want %v", live, tt.live)
+			}
+		})
+	}
+}
+
+// Final submissions are no longer polled, but still served and pruned.
+func TestSubmissionTrackerPoll(t *testing.T) {
+	var mu sync.Mutex
+	checked := make(map[common.Hash]bool)
+	tracker := newTestSubmissionTracker(t, func(method string, params []json.RawMessage) interface{} {
+		switch method {
+		case "eth_blockNumber":
+			return "0xc"
+		case "eth_getTransactionReceipt":
+			var hash common.Hash
+			if err := json.Unmarshal(params[0], &hash); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			checked[hash] = true
+			mu.Unlock()
+			return testReceipt("0x1")
+		}
+		t.Errorf("unexpected node call %s", method)
+		return nil
+	})
+	block := &types.BlockIdentifier{Index: 10, Hash: submissionBlock.Hex()}
+	subs := []struct {
+		sub    *submission
+		polled bool
+	}{
+		{&submission{status: SubmissionPending}, true},
+		{&submission{status: SubmissionFailed}, false},
+		{&submission{status: SubmissionFailed, block: block, transaction: &types.Transaction{}}, false},
+		{&submission{status: SubmissionConfirmed, block: block, transaction: &types.Transaction{}}, false},
+		// The block may not be readable yet
+		{&submission{status: SubmissionConfirmed, block: block}, true},
+		// Followed until confirmed 3 times, in case of a reorg
+		{&submission{status: SubmissionConfirmed, block: &types.BlockIdentifier{Index: 11, Hash: submissionBlock.Hex()}, transaction: &types.Transaction{}}, true},
+		{&submission{status: SubmissionConfirmed, submittedAt: time.Now().Add(-2 * DefaultSubmissionRetention)}, false},
+	}
+	for i, s := range subs {
+		s.sub.hash = common.BigToHash(big.NewInt(int64(i + 1)))
+		if s.sub.submittedAt.IsZero() {
+			s.sub.submittedAt = time.Now()
+		}
+		tracker.submissions[s.sub.hash] = s.sub
+	}
+	if err := tracker.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range subs {
+		if checked[s.sub.hash] != s.polled {
+			t.Errorf("submission %d: polled = %v, want %v", i, checked[s.sub.hash], s.polled)
+		}
+	}
+	if len(tracker.submissions) != len(subs)-1 {
+		t.Errorf("%d submissions kept, want %d", len(tracker.submissions), len(subs)-1)
+	}
+	resp, clientErr := tracker.Status(context.Background(), &SubmissionStatusRequest{
+		TransactionIdentifier: &types.TransactionIdentifier{Hash: subs[3].sub.hash.Hex()},
+	})
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	if resp.Status != SubmissionConfirmed || resp.Confirmations != 3 {
+		t.Errorf("status = %s with %d confirmations, want confirmed with 3", resp.Status, resp.Confirmations)
+	}
+}
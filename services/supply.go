@@ -0,0 +1,185 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/coinbase/rosetta-sdk-go/client"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Result of checking that the mints, burns and inflation adjustments of a
+// block explain its change in total supply.
+type SupplyCheck struct {
+	BlockIdentifier *types.BlockIdentifier `json:"block_identifier"`
+	PreviousSupply  string                 `json:"previous_supply"`
+	TotalSupply     string                 `json:"total_supply"`
+	Minted          string                 `json:"minted"`
+	Burned          string                 `json:"burned"`
+	Adjusted        string                 `json:"adjusted"`
+	Consistent      bool                   `json:"consistent"`
+}
+
+// Reads and audits the StableToken total supply.
+type SupplyService struct {
+	client       *client.APIClient
+	blockService *BlockAPIService
+	stableToken  *StableToken
+}
+
+func NewSupplyService(
+	client *client.APIClient,
+	blockService *BlockAPIService,
+	stableToken *StableToken,
+) *SupplyService {
+	return &SupplyService{
+		client:       client,
+		blockService: blockService,
+		stableToken:  stableToken,
+	}
+}
+
+// Returns totalSupply() at blockIndex, or at the tip if blockIndex is nil.
+func (s *SupplyService) TotalSupply(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	blockIndex *int64,
+) (*big.Int, *types.BlockIdentifier, *types.Error) {
+	var blockNumber *big.Int
+	if blockIndex != nil {
+		if !s.stableToken.DeployedAt(*blockIndex) {
+			return nil, nil, ErrStableTokenNotDeployed
+		}
+		blockNumber = new(big.Int).SetInt64(*blockIndex)
+	}
+	return callStableTokenUint(ctx, s.client, networkId, "totalSupply", nil, blockNumber)
+}
+
+// Fetches the block at blockIndex and verifies its supply change.
+func (s *SupplyService) VerifyBlockIndex(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	blockIndex int64,
+) (*SupplyCheck, *types.Error) {
+	blockResp, clientErr := s.blockService.Block(ctx, &types.BlockRequest{
+		NetworkIdentifier: networkId,
+		BlockIdentifier:   &types.PartialBlockIdentifier{Index: &blockIndex},
+	})
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	return s.VerifyBlock(ctx, networkId, blockResp.Block)
+}
+
+// Checks that totalSupply(block) - totalSupply(block - 1) == minted - burned + adjusted,
+// where minted, burned and adjusted are summed from the successful mint, burn
+// and inflation adjustment operations of block. Adjusted balances being
+// rounded separately, the check allows a difference below the number of
+// holders the adjustments were computed for.
+func (s *SupplyService) VerifyBlock(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	block *types.Block,
+) (*SupplyCheck, *types.Error) {
+	index := block.BlockIdentifier.Index
+	minted := new(big.Int)
+	burned := new(big.Int)
+	adjusted := new(big.Int)
+	holders := new(big.Int)
+	for _, tx := range block.Transactions {
+		// A number once the block went through JSON
+		switch n := tx.Metadata[MetadataInflationHolders].(type) {
+		case int:
+			holders.Add(holders, big.NewInt(int64(n)))
+		case float64:
+			holders.Add(holders, big.NewInt(int64(n)))
+		}
+		for _, op := range tx.Operations {
+			if op.Status != OpSuccess.Status || op.Amount == nil {
+				continue
+			}
+			value, ok := new(big.Int).SetString(op.Amount.Value, 10)
+			if !ok {
+				return nil, ErrInternal
+			}
+			switch op.Type {
+			case OpMint:
+				minted.Add(minted, value)
+			case OpBurn:
+				// Burns debit the holder, so their amounts are negative
+				burned.Sub(burned, value)
+			case OpInflation:
+				adjusted.Add(adjusted, value)
+			}
+		}
+	}
+
+	totalSupply := new(big.Int)
+	if s.stableToken.DeployedAt(index) {
+		supply, _, clientErr := s.TotalSupply(ctx, networkId, &index)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		totalSupply = supply
+	}
+	previousSupply := new(big.Int)
+	previousIndex := index - 1
+	if s.stableToken.DeployedAt(previousIndex) {
+		supply, _, clientErr := s.TotalSupply(ctx, networkId, &previousIndex)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		previousSupply = supply
+	}
+
+	delta := new(big.Int).Sub(totalSupply, previousSupply)
+	expected := new(big.Int).Sub(minted, burned)
+	expected.Add(expected, adjusted)
+	rounding := new(big.Int).Sub(delta, expected)
+	consistent := rounding.Sign() == 0 || rounding.CmpAbs(holders) < 0
+	return &SupplyCheck{
+		BlockIdentifier: block.BlockIdentifier,
+		PreviousSupply:  previousSupply.String(),
+		TotalSupply:     totalSupply.String(),
+		Minted:          minted.String(),
+		Burned:          burned.String(),
+		Adjusted:        adjusted.String(),
+		Consistent:      consistent,
+	}, nil
+}
+
+// Returns a BlockHandler that logs any block whose supply change is not explained by its operations.
+func (s *SupplyService) HandleBlock(networkId *types.NetworkIdentifier) BlockHandler {
+	return func(ctx context.Context, block *types.Block) {
+		check, clientErr := s.VerifyBlock(ctx, networkId, block)
+		if clientErr != nil {
+			rootLogger.Warn("could not verify supply", "block_index", block.BlockIdentifier.Index, "error", clientErr)
+			return
+		}
+		if !check.Consistent {
+			rootLogger.Error(
+				"supply mismatch",
+				"block_index", block.BlockIdentifier.Index,
+				"previous_supply", check.PreviousSupply,
+				"total_supply", check.TotalSupply,
+				"minted", check.Minted,
+				"burned", check.Burned,
+				"adjusted", check.Adjusted,
+			)
+		}
+	}
+}
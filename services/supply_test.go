@@ -0,0 +1,196 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func TestVerifyBlock(t *testing.T) {
+	account := &types.AccountIdentifier{Address: "0x000000000000000000000000000000000000dEaD"}
+	op := func(opType string, value string, status types.OperationStatus) *types.Operation {
+		return &types.Operation{
+			OperationIdentifier: &types.OperationIdentifier{Index: 0},
+			Type:                opType,
+			Status:              status.Status,
+			Account:             account,
+			Amount:              &types.Amount{Value: value, Currency: CeloDollar},
+		}
+	}
+
+	tests := []struct {
+		name string
+		// Index of the block, the StableToken is activated at 100
+		index      int64
+		operations []*types.Operation
+		// Holders the inflation adjustments were computed for, if any
+		holders interface{}
+		// totalSupply() at index - 1 and index
+		previousSupply int64
+		totalSupply    int64
+
+		minted, burned, adjusted string
+		consistent               bool
+	}{
+		{
+			name:           "transfers",
+			index:          101,
+			operations:     []*types.Operation{op(OpTransfer, "-5", OpSuccess), op(OpTransfer, "5", OpSuccess)},
+			previousSupply: 100,
+			totalSupply:    100,
+			minted:         "0", burned: "0", adjusted: "0",
+			consistent: true,
+		},
+		{
+			name:           "mint and burn",
+			index:          101,
+			operations:     []*types.Operation{op(OpMint, "10", OpSuccess), op(OpBurn, "-4", OpSuccess)},
+			previousSupply: 100,
+			totalSupply:    106,
+			minted:         "10", burned: "4", adjusted: "0",
+			consistent: true,
+		},
+		{
+			name:           "failed mint",
+			index:          101,
+			operations:     []*types.Operation{op(OpMint, "10", OpFailed)},
+			previousSupply: 100,
+			totalSupply:    100,
+			minted:         "0", burned: "0", adjusted: "0",
+			consistent: true,
+		},
+		{
+			name:           "inflation adjustments",
+			index:          101,
+			operations:     []*types.Operation{op(OpInflation, "-3", OpSuccess), op(OpInflation, "-2", OpSuccess)},
+			previousSupply: 100,
+			totalSupply:    95,
+			minted:         "0", burned: "0", adjusted: "-5",
+			consistent: true,
+		},
+		{
+			name:           "inflation adjustments rounding",
+			index:          101,
+			operations:     []*types.Operation{op(OpInflation, "-3", OpSuccess), op(OpInflation, "-2", OpSuccess)},
+			holders:        2,
+			previousSupply: 100,
+			totalSupply:    94,
+			minted:         "0", burned: "0", adjusted: "-5",
+			consistent: true,
+		},
+		{
+			name:           "inflation adjustments rounding from JSON",
+			index:          101,
+			operations:     []*types.Operation{op(OpInflation, "-3", OpSuccess), op(OpInflation, "-2", OpSuccess)},
+			holders:        float64(2),
+			previousSupply: 100,
+			totalSupply:    96,
+			minted:         "0", burned: "0", adjusted: "-5",
+			consistent: true,
+		},
+		{
+			name:           "inflation adjustments beyond rounding",
+			index:          101,
+			operations:     []*types.Operation{op(OpInflation, "-3", OpSuccess), op(OpInflation, "-2", OpSuccess)},
+			holders:        2,
+			previousSupply: 100,
+			totalSupply:    93,
+			minted:         "0", burned: "0", adjusted: "-5",
+			consistent: false,
+		},
+		{
+			name:           "mint and inflation adjustment",
+			index:          101,
+			operations:     []*types.Operation{op(OpMint, "10", OpSuccess), op(OpInflation, "1", OpSuccess)},
+			previousSupply: 100,
+			totalSupply:    111,
+			minted:         "10", burned: "0", adjusted: "1",
+			consistent: true,
+		},
+		{
+			name:           "unexplained change",
+			index:          101,
+			operations:     []*types.Operation{op(OpMint, "10", OpSuccess)},
+			previousSupply: 100,
+			totalSupply:    109,
+			minted:         "10", burned: "0", adjusted: "0",
+			consistent: false,
+		},
+		{
+			name:        "activation block",
+			index:       100,
+			operations:  []*types.Operation{op(OpMint, "70", OpSuccess), op(OpMint, "30", OpSuccess)},
+			totalSupply: 100,
+			minted:      "100", burned: "0", adjusted: "0",
+			consistent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coreClient := newTestCore(t, func(path string, body []byte) interface{} {
+				var request types.CallRequest
+				if err := json.Unmarshal(body, &request); err != nil || path != "/call" {
+					t.Errorf("unexpected core request %s: %s", path, body)
+					return ErrInternal
+				}
+				var params airgap.CallParams
+				if err := airgap.UnmarshallFromMap(request.Parameters, &params); err != nil {
+					t.Fatal(err)
+				}
+				block := &types.BlockIdentifier{Index: params.BlockNumber.Int64()}
+				switch params.BlockNumber.Int64() {
+				case tt.index:
+					return testCallResponse(t, tt.totalSupply, block)
+				case tt.index - 1:
+					if tt.index == 100 {
+						t.Error("total supply read before the activation")
+					}
+					return testCallResponse(t, tt.previousSupply, block)
+				}
+				t.Errorf("total supply read at block %s", params.BlockNumber)
+				return ErrInternal
+			})
+			stableToken := &StableToken{BlockThreshold: 100}
+			s := NewSupplyService(coreClient, NewBlockAPIService(coreClient, nil, stableToken), stableToken)
+			check, clientErr := s.VerifyBlock(
+				context.Background(),
+				&types.NetworkIdentifier{Blockchain: "celo", Network: "test"},
+				&types.Block{
+					BlockIdentifier: &types.BlockIdentifier{Index: tt.index, Hash: "0x01"},
+					Transactions: []*types.Transaction{{
+						TransactionIdentifier: &types.TransactionIdentifier{Hash: "0x02"},
+						Operations:            tt.operations,
+						Metadata:              map[string]interface{}{MetadataInflationHolders: tt.holders},
+					}},
+				},
+			)
+			if clientErr != nil {
+				t.Fatal(clientErr.Message)
+			}
+			if check.Minted != tt.minted || check.Burned != tt.burned || check.Adjusted != tt.adjusted {
+				t.Errorf("minted %s, burned %s, adjusted %s, expected %s, %s, %s",
+					check.Minted, check.Burned, check.Adjusted, tt.minted, tt.burned, tt.adjusted)
+			}
+			if check.Consistent != tt.consistent {
+				t.Errorf("consistent %v, expected %v", check.Consistent, tt.consistent)
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/parser"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Swaps of CELO for cUSD or back through the Exchange contract are built
+// from a pair of swap operations on the same account: a debit of the
+// currency sold and a credit of the other currency. By default the debit is
+// the exact amount sold and the credit the least amount to receive
+// (Exchange.sell); with "swap_mode": "buy" in the preprocess metadata, the
+// credit is the exact amount bought and the debit the most to sell for it
+// (Exchange.buy). The Exchange pulls the amount sold with transferFrom, so
+// it must first be approved for it by a transaction built from a single
+// approve operation, going through the whole construction flow as well.
+
+const (
+	// Preprocess metadata key selecting how the amounts of a swap are read,
+	// also returned by /construction/metadata and /construction/parse
+	MetadataSwapMode = "swap_mode"
+	SwapModeSell     = "sell"
+	SwapModeBuy      = "buy"
+	// Metadata keys returned by /construction/metadata for swaps
+	MetadataSwapQuote            = "swap_quote"
+	MetadataSwapApprovalRequired = "swap_approval_required"
+	// Metadata keys of approve operations
+	MetadataSpender = "spender"
+	MetadataAmount  = "amount"
+
+	// Preprocess options only used by this module, not forwarded to core
+	optionSwapMode       = "swap_mode"
+	optionSwapSellAmount = "swap_sell_amount"
+	optionSwapBuyAmount  = "swap_buy_amount"
+	optionSwapSellGold   = "swap_sell_gold"
+)
+
+type swapTx struct {
+	Account  *common.Address
+	SellGold bool
+	// Whether BuyAmount is exact, rather than SellAmount
+	Buy bool
+	// Amount sold, or most to sell when buying
+	SellAmount *big.Int
+	// Amount bought, or least to receive when selling
+	BuyAmount *big.Int
+}
+
+// Approval of the Exchange to pull Amount of CELO, or of cUSD, from Owner.
+type approvalTx struct {
+	Owner  *common.Address
+	Gold   bool
+	Amount *big.Int
+}
+
+func currencyEqual(a, b *types.Currency) bool {
+	return a != nil && b != nil && types.Hash(a) == types.Hash(b)
+}
+
+// Whether ops describe a swap rather than a transfer.
+func isSwap(ops []*types.Operation) bool {
+	return len(ops) > 0 && ops[0].Type == OpSwap
+}
+
+// Whether ops describe an approval rather than a transfer.
+func isApprove(ops []*types.Operation) bool {
+	return len(ops) > 0 && ops[0].Type == OpApprove
+}
+
+// The contract method of the CELO or cUSD token, e.g. "GoldToken.approve".
+func tokenMethod(gold bool, name string) string {
+	if gold {
+		return "GoldToken." + name
+	}
+	return "StableToken." + name
+}
+
+func parseSwap(ops []*types.Operation) (*swapTx, error) {
+	descriptions := &parser.Descriptions{
+		OperationDescriptions: []*parser.OperationDescription{
+			{
+				Type:    OpSwap,
+				Account: &parser.AccountDescription{Exists: true},
+				Amount: &parser.AmountDescription{
+					Exists: true,
+					Sign:   parser.NegativeAmountSign,
+				},
+			},
+			{
+				Type:    OpSwap,
+				Account: &parser.AccountDescription{Exists: true},
+				Amount: &parser.AmountDescription{
+					Exists: true,
+					Sign:   parser.PositiveAmountSign,
+				},
+			},
+		},
+		EqualAddresses: [][]int{{0, 1}},
+		ErrUnmatched:   true,
+	}
+	matches, err := parser.MatchOperations(descriptions, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	sellOp, _ := matches[0].First()
+	buyOp, _ := matches[1].First()
+	account, ok := rpc.ChecksumAddress(sellOp.Account.Address)
+	if !ok {
+		return nil, errors.New("invalid swap account")
+	}
+	var sellGold bool
+	switch {
+	case currencyEqual(sellOp.Amount.Currency, CeloGold) && currencyEqual(buyOp.Amount.Currency, CeloDollar):
+		sellGold = true
+	case currencyEqual(sellOp.Amount.Currency, CeloDollar) && currencyEqual(buyOp.Amount.Currency, CeloGold):
+		sellGold = false
+	default:
+		return nil, errors.New("a swap must sell CELO for cUSD or cUSD for CELO")
+	}
+	sellAmount, ok := new(big.Int).SetString(sellOp.Amount.Value, 10)
+	if !ok {
+		return nil, errors.New("invalid swap sell amount")
+	}
+	buyAmount, ok := new(big.Int).SetString(buyOp.Amount.Value, 10)
+	if !ok {
+		return nil, errors.New("invalid swap buy amount")
+	}
+	return &swapTx{
+		Account:    account,
+		SellGold:   sellGold,
+		SellAmount: new(big.Int).Neg(sellAmount),
+		BuyAmount:  buyAmount,
+	}, nil
+}
+
+// Parses the single approve operation of an approval of exchange.
+func parseApproval(ops []*types.Operation, exchange common.Address) (*approvalTx, error) {
+	if len(ops) != 1 {
+		return nil, fmt.Errorf("an approval takes a single %s operation, got %d operations", OpApprove, len(ops))
+	}
+	op := ops[0]
+	if op.Type != OpApprove || op.Account == nil || op.Amount != nil {
+		return nil, fmt.Errorf("an approval takes a %s operation with an account and no amount", OpApprove)
+	}
+	owner, ok := rpc.ChecksumAddress(op.Account.Address)
+	if !ok {
+		return nil, errors.New("invalid approval account")
+	}
+	spender, _ := op.Metadata[MetadataSpender].(string)
+	if !common.IsHexAddress(spender) || common.HexToAddress(spender) != exchange {
+		return nil, fmt.Errorf("only approvals of the Exchange %s are supported", exchange.Hex())
+	}
+	amount, err := metadataAmount(op.Metadata[MetadataAmount])
+	if err != nil {
+		return nil, err
+	}
+	var gold bool
+	switch {
+	case currencyEqual(amount.Currency, CeloGold):
+		gold = true
+	case currencyEqual(amount.Currency, CeloDollar):
+		gold = false
+	default:
+		return nil, errors.New("an approval must be of CELO or cUSD")
+	}
+	value, ok := new(big.Int).SetString(amount.Value, 10)
+	if !ok || value.Sign() < 0 {
+		return nil, errors.New("invalid approval amount")
+	}
+	return &approvalTx{Owner: owner, Gold: gold, Amount: value}, nil
+}
+
+// Decodes the amount of an approve operation, as given in JSON or built by
+// this module.
+func metadataAmount(raw interface{}) (*types.Amount, error) {
+	if raw == nil {
+		return nil, errors.New("missing approval amount")
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var amount types.Amount
+	if err := json.Unmarshal(encoded, &amount); err != nil {
+		return nil, fmt.Errorf("invalid approval amount: %w", err)
+	}
+	return &amount, nil
+}
+
+// The swap mode requested in preprocess metadata, selling by default.
+func swapMode(metadata map[string]interface{}) (string, error) {
+	raw, ok := metadata[MetadataSwapMode]
+	if !ok {
+		return SwapModeSell, nil
+	}
+	mode, _ := raw.(string)
+	if mode != SwapModeSell && mode != SwapModeBuy {
+		return "", fmt.Errorf("invalid %s %v, expected %s or %s", MetadataSwapMode, raw, SwapModeSell, SwapModeBuy)
+	}
+	return mode, nil
+}
+
+func (swap *swapTx) mode() string {
+	if swap.Buy {
+		return SwapModeBuy
+	}
+	return SwapModeSell
+}
+
+// Preprocess options for swap. Core estimates gas from From, Method and
+// Args; the other options are for /construction/metadata.
+func swapOptions(swap *swapTx) map[string]interface{} {
+	options := map[string]interface{}{
+		"From":               swap.Account.String(),
+		optionSwapMode:       swap.mode(),
+		optionSwapSellAmount: swap.SellAmount.String(),
+		optionSwapBuyAmount:  swap.BuyAmount.String(),
+		optionSwapSellGold:   swap.SellGold,
+	}
+	if swap.Buy {
+		options["Method"] = "Exchange.buy"
+		options["Args"] = []interface{}{
+			swap.BuyAmount.String(),
+			swap.SellAmount.String(),
+			!swap.SellGold,
+		}
+	} else {
+		options["Method"] = "Exchange.sell"
+		options["Args"] = []interface{}{
+			swap.SellAmount.String(),
+			swap.BuyAmount.String(),
+			swap.SellGold,
+		}
+	}
+	return options
+}
+
+// Preprocess options for approval, for core to estimate gas from.
+func (s *ConstructionAPIService) approvalOptions(approval *approvalTx) map[string]interface{} {
+	return map[string]interface{}{
+		"From":   approval.Owner.String(),
+		"Method": tokenMethod(approval.Gold, "approve"),
+		"Args": []interface{}{
+			s.stableToken.ExchangeAddress.String(),
+			approval.Amount.String(),
+		},
+	}
+}
+
+// Removes the swap options from options, returning the swap they describe
+// without its account, or nil for non-swaps.
+func takeSwapOptions(options map[string]interface{}) (*swapTx, error) {
+	mode, _ := options[optionSwapMode].(string)
+	if mode == "" {
+		return nil, nil
+	}
+	rawSellAmount, _ := options[optionSwapSellAmount].(string)
+	sellAmount, ok := new(big.Int).SetString(rawSellAmount, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid %s %q", optionSwapSellAmount, rawSellAmount)
+	}
+	rawBuyAmount, _ := options[optionSwapBuyAmount].(string)
+	buyAmount, ok := new(big.Int).SetString(rawBuyAmount, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid %s %q", optionSwapBuyAmount, rawBuyAmount)
+	}
+	sellGold, _ := options[optionSwapSellGold].(bool)
+	delete(options, optionSwapMode)
+	delete(options, optionSwapSellAmount)
+	delete(options, optionSwapBuyAmount)
+	delete(options, optionSwapSellGold)
+	return &swapTx{
+		SellGold:   sellGold,
+		Buy:        mode == SwapModeBuy,
+		SellAmount: sellAmount,
+		BuyAmount:  buyAmount,
+	}, nil
+}
+
+// Metadata describing swap at the tip: the amount the Exchange would pay
+// for the amount sold, or charge for the amount bought, and whether the
+// Exchange still needs to be approved for the amount sold.
+func (s *ConstructionAPIService) swapMetadata(
+	ctx context.Context,
+	networkId *types.NetworkIdentifier,
+	from string,
+	swap *swapTx,
+) (map[string]interface{}, *types.Error) {
+	quoteMethod, quoteArgs := "Exchange.getBuyTokenAmount", []interface{}{swap.SellAmount.String(), swap.SellGold}
+	if swap.Buy {
+		quoteMethod, quoteArgs = "Exchange.getSellTokenAmount", []interface{}{swap.BuyAmount.String(), swap.SellGold}
+	}
+	quote, clientErr := celoCall(ctx, s.client, networkId, quoteMethod, quoteArgs, nil)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	allowance, clientErr := celoCall(
+		ctx, s.client, networkId, tokenMethod(swap.SellGold, "allowance"),
+		[]interface{}{from, s.stableToken.ExchangeAddress.Hex()}, nil,
+	)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	return map[string]interface{}{
+		MetadataSwapMode:             swap.mode(),
+		MetadataSwapQuote:            new(big.Int).SetBytes(quote.Raw).String(),
+		MetadataSwapApprovalRequired: new(big.Int).SetBytes(allowance.Raw).Cmp(swap.SellAmount) < 0,
+	}, nil
+}
+
+// Packs the call data of swap.
+func (s *ConstructionAPIService) swapData(swap *swapTx) ([]byte, error) {
+	if swap.Buy {
+		return s.stableToken.ExchangeABI.Pack("buy", swap.BuyAmount, swap.SellAmount, !swap.SellGold)
+	}
+	return s.stableToken.ExchangeABI.Pack("sell", swap.SellAmount, swap.BuyAmount, swap.SellGold)
+}
+
+// Packs the call data of approval.
+func (s *ConstructionAPIService) approvalData(approval *approvalTx) ([]byte, error) {
+	// GoldToken and StableToken share the ERC20 approve method
+	return s.stableToken.ABI.Pack("approve", s.stableToken.ExchangeAddress, approval.Amount)
+}
+
+// Decodes an Exchange.sell or Exchange.buy transaction into its swap
+// operations, and metadata giving the swap mode.
+func (s *ConstructionAPIService) parseSwapTx(tx *airgap.Transaction) ([]*types.Operation, map[string]interface{}, error) {
+	if len(tx.Data) < 4 {
+		return nil, nil, errors.New("missing method ID")
+	}
+	method, err := s.stableToken.ExchangeABI.MethodById(tx.Data[:4])
+	if err != nil || (method.Name != "sell" && method.Name != "buy") {
+		return nil, nil, errors.New("not an Exchange.sell or Exchange.buy call")
+	}
+	values, err := method.Inputs.UnpackValues(tx.Data[4:])
+	if err != nil || len(values) != 3 {
+		return nil, nil, fmt.Errorf("could not unpack Exchange.%s arguments", method.Name)
+	}
+	amount, ok1 := values[0].(*big.Int)
+	limit, ok2 := values[1].(*big.Int)
+	goldSide, ok3 := values[2].(bool)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, nil, fmt.Errorf("unexpected Exchange.%s argument types", method.Name)
+	}
+	// sell(sellAmount, minBuyAmount, sellGold), buy(buyAmount, maxSellAmount, buyGold)
+	swap := &swapTx{SellGold: goldSide, SellAmount: amount, BuyAmount: limit}
+	if method.Name == "buy" {
+		swap = &swapTx{SellGold: !goldSide, Buy: true, SellAmount: limit, BuyAmount: amount}
+	}
+
+	sellCurrency, buyCurrency := CeloDollar, CeloGold
+	if swap.SellGold {
+		sellCurrency, buyCurrency = CeloGold, CeloDollar
+	}
+	sellOp := newAtomicOp(tx.From, 0, new(big.Int).Neg(swap.SellAmount), nil, OpSwap, nil)
+	sellOp.Amount.Currency = sellCurrency
+	buyOp := newAtomicOp(tx.From, 1, swap.BuyAmount, nil, OpSwap, []*types.OperationIdentifier{{Index: 0}})
+	buyOp.Amount.Currency = buyCurrency
+	return []*types.Operation{sellOp, buyOp}, map[string]interface{}{MetadataSwapMode: swap.mode()}, nil
+}
+
+// Decodes the approval of the Exchange by a GoldToken or StableToken
+// transaction into its approve operation. Approvals move no funds, so the
+// operation has no amount: the amount approved is in its metadata.
+func (s *ConstructionAPIService) parseApprovalTx(tx *airgap.Transaction) ([]*types.Operation, error) {
+	if len(tx.Data) < 4 {
+		return nil, errors.New("missing method ID")
+	}
+	method, err := s.stableToken.ABI.MethodById(tx.Data[:4])
+	if err != nil || method.Name != "approve" {
+		return nil, errors.New("not an approve call")
+	}
+	values, err := method.Inputs.UnpackValues(tx.Data[4:])
+	if err != nil || len(values) != 2 {
+		return nil, errors.New("could not unpack approve arguments")
+	}
+	spender, ok1 := values[0].(common.Address)
+	amount, ok2 := values[1].(*big.Int)
+	if !ok1 || !ok2 || spender != s.stableToken.ExchangeAddress {
+		return nil, errors.New("only approvals of the Exchange are supported")
+	}
+	currency := CeloDollar
+	if tx.To == s.stableToken.GoldTokenAddress {
+		currency = CeloGold
+	}
+	accountId := rpc.NewAccountIdentifier(tx.From, nil)
+	return []*types.Operation{{
+		OperationIdentifier: rpc.NewOperationIdentifier(0),
+		Type:                OpApprove,
+		Account:             &accountId,
+		Metadata: map[string]interface{}{
+			MetadataSpender: spender.Hex(),
+			MetadataAmount:  rpc.NewAmount(amount, currency),
+		},
+	}}, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/airgap"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+func TestParseSwap(t *testing.T) {
+	other := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	tests := []struct {
+		name     string
+		ops      []*types.Operation
+		expected *swapTx
+		err      string
+	}{
+		{
+			name: "sell CELO",
+			ops:  []*types.Operation{swapOp(0, testAccount, "-10", CeloGold), swapOp(1, testAccount, "49", CeloDollar)},
+			expected: &swapTx{
+				Account:    &testAccount,
+				SellGold:   true,
+				SellAmount: big.NewInt(10),
+				BuyAmount:  big.NewInt(49),
+			},
+		},
+		{
+			name: "sell cUSD, operations in any order",
+			ops:  []*types.Operation{swapOp(0, testAccount, "2", CeloGold), swapOp(1, testAccount, "-10", CeloDollar)},
+			expected: &swapTx{
+				Account:    &testAccount,
+				SellAmount: big.NewInt(10),
+				BuyAmount:  big.NewInt(2),
+			},
+		},
+		{
+			name: "different accounts",
+			ops:  []*types.Operation{swapOp(0, testAccount, "-10", CeloGold), swapOp(1, other, "49", CeloDollar)},
+		},
+		{
+			name: "same currency",
+			ops:  []*types.Operation{swapOp(0, testAccount, "-10", CeloDollar), swapOp(1, testAccount, "9", CeloDollar)},
+			err:  "must sell CELO for cUSD or cUSD for CELO",
+		},
+		{
+			name: "two debits",
+			ops:  []*types.Operation{swapOp(0, testAccount, "-10", CeloGold), swapOp(1, testAccount, "-49", CeloDollar)},
+		},
+		{name: "single operation", ops: []*types.Operation{swapOp(0, testAccount, "-10", CeloGold)}},
+		{
+			name: "extra operation",
+			ops: []*types.Operation{
+				swapOp(0, testAccount, "-10", CeloGold),
+				swapOp(1, testAccount, "49", CeloDollar),
+				swapOp(2, testAccount, "1", CeloDollar),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			swap, err := parseSwap(test.ops)
+			if test.expected == nil {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(swap, test.expected) {
+				t.Errorf("swap %+v, expected %+v", swap, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseApproval(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := stableToken.ExchangeAddress
+	withAmount := approveOp(exchange, "10", CeloGold)
+	withAmount.Amount = &types.Amount{Value: "10", Currency: CeloGold}
+	noAmount := approveOp(exchange, "10", CeloGold)
+	delete(noAmount.Metadata, MetadataAmount)
+	// As decoded from a JSON request
+	decoded := approveOp(exchange, "10", CeloDollar)
+	decoded.Metadata[MetadataAmount] = map[string]interface{}{
+		"value":    "10",
+		"currency": map[string]interface{}{"symbol": CeloDollar.Symbol, "decimals": float64(CeloDollar.Decimals)},
+	}
+
+	tests := []struct {
+		name     string
+		ops      []*types.Operation
+		expected *approvalTx
+		err      string
+	}{
+		{
+			name:     "CELO",
+			ops:      []*types.Operation{approveOp(exchange, "10", CeloGold)},
+			expected: &approvalTx{Owner: &testAccount, Gold: true, Amount: big.NewInt(10)},
+		},
+		{
+			name:     "cUSD from JSON",
+			ops:      []*types.Operation{decoded},
+			expected: &approvalTx{Owner: &testAccount, Amount: big.NewInt(10)},
+		},
+		{
+			name: "two operations",
+			ops:  []*types.Operation{approveOp(exchange, "10", CeloGold), approveOp(exchange, "10", CeloGold)},
+			err:  "single approve operation",
+		},
+		{name: "other spender", ops: []*types.Operation{approveOp(testAccount, "10", CeloGold)}, err: "only approvals of the Exchange"},
+		{name: "operation amount", ops: []*types.Operation{withAmount}, err: "no amount"},
+		{name: "missing amount", ops: []*types.Operation{noAmount}, err: "missing approval amount"},
+		{name: "negative amount", ops: []*types.Operation{approveOp(exchange, "-10", CeloGold)}, err: "invalid approval amount"},
+		{
+			name: "other currency",
+			ops:  []*types.Operation{approveOp(exchange, "10", &types.Currency{Symbol: "cEUR", Decimals: 18})},
+			err:  "must be of CELO or cUSD",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			approval, err := parseApproval(test.ops, exchange)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(approval, test.expected) {
+				t.Errorf("approval %+v, expected %+v", approval, test.expected)
+			}
+		})
+	}
+}
+
+// The transactions built from swap and approve operations parse back into
+// the same operations.
+func TestSwapConstructionRoundTrip(t *testing.T) {
+	stableToken, err := NewStableToken("42220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ConstructionAPIService{stableToken: stableToken}
+
+	swaps := []struct {
+		name string
+		mode string
+		ops  []*types.Operation
+	}{
+		{name: "sell CELO", mode: SwapModeSell, ops: []*types.Operation{swapOp(0, testAccount, "-10", CeloGold), swapOp(1, testAccount, "49", CeloDollar)}},
+		{name: "sell cUSD", mode: SwapModeSell, ops: []*types.Operation{swapOp(0, testAccount, "-49", CeloDollar), swapOp(1, testAccount, "9", CeloGold)}},
+		{name: "buy cUSD", mode: SwapModeBuy, ops: []*types.Operation{swapOp(0, testAccount, "-11", CeloGold), swapOp(1, testAccount, "50", CeloDollar)}},
+		{name: "buy CELO", mode: SwapModeBuy, ops: []*types.Operation{swapOp(0, testAccount, "-52", CeloDollar), swapOp(1, testAccount, "10", CeloGold)}},
+	}
+	for _, test := range swaps {
+		t.Run(test.name, func(t *testing.T) {
+			swap, err := parseSwap(test.ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			swap.Buy = test.mode == SwapModeBuy
+			data, err := s.swapData(swap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops, metadata, err := s.parseSwapTx(&airgap.Transaction{TxMetadata: &airgap.TxMetadata{
+				From: testAccount,
+				To:   stableToken.ExchangeAddress,
+				Data: data,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, expected := operationsJSON(t, ops), operationsJSON(t, test.ops); got != expected {
+				t.Errorf("operations %s, expected %s", got, expected)
+			}
+			if metadata[MetadataSwapMode] != test.mode {
+				t.Errorf("swap mode %v, expected %s", metadata[MetadataSwapMode], test.mode)
+			}
+		})
+	}
+
+	approvals := []struct {
+		name  string
+		token common.Address
+		op    *types.Operation
+	}{
+		{name: "approve CELO", token: stableToken.GoldTokenAddress, op: approveOp(stableToken.ExchangeAddress, "10", CeloGold)},
+		{name: "approve cUSD", token: stableToken.Address, op: approveOp(stableToken.ExchangeAddress, "49", CeloDollar)},
+	}
+	for _, test := range approvals {
+		t.Run(test.name, func(t *testing.T) {
+			approval, err := parseApproval([]*types.Operation{test.op}, stableToken.ExchangeAddress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := s.approvalData(approval)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx := &airgap.Transaction{TxMetadata: &airgap.TxMetadata{From: testAccount, To: test.token, Data: data}}
+			ops, err := s.parseApprovalTx(tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, expected := operationsJSON(t, ops), operationsJSON(t, []*types.Operation{test.op}); got != expected {
+				t.Errorf("operations %s, expected %s", got, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal OpenTelemetry-compatible tracing: spans are created for every
+// request served, every service method and every call to core rosetta,
+// with W3C Trace Context (traceparent) propagated in both directions so
+// that traces join with those of core rosetta. Finished spans are batched
+// and handed to a SpanExporter (see tracing_export.go).
+
+const (
+	traceparentHeader = "traceparent"
+	traceFlagSampled  = 0x01
+
+	// OTLP SpanKind values
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+
+	// OTLP StatusCode values
+	SpanStatusUnset = 0
+	SpanStatusOK    = 1
+	SpanStatusError = 2
+
+	traceBatchSize     = 512
+	traceQueueSize     = 4096
+	traceFlushInterval = 5 * time.Second
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// Identifies a span and the trace it belongs to, as carried by traceparent.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// Parses a W3C traceparent header value.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Flags = byte(flags)
+	return sc, sc.IsValid()
+}
+
+// A single timed operation within a trace.
+type Span struct {
+	SpanContext
+	Parent     SpanID
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	StatusCode int
+	StatusMsg  string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// Sets an attribute on the span; a no-op on a nil span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Marks the span as failed with msg; a no-op on a nil span.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.StatusCode = SpanStatusError
+	s.StatusMsg = msg
+}
+
+// Ends the span and queues it for export; a no-op on a nil span.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	tracer.enqueue(s)
+}
+
+type spanKey struct{}
+
+// The span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Starts an internal span as a child of the span in ctx. While tracing is
+// disabled it returns ctx unchanged and a nil span, whose methods are no-ops.
+func startSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return startSpanWithParent(ctx, name, SpanKindInternal, SpanContext{})
+}
+
+// Starts a span as a child of the span in ctx or, if there is none, of remote.
+func startSpanWithParent(
+	ctx context.Context,
+	name string,
+	kind int,
+	remote SpanContext,
+) (context.Context, *Span) {
+	if !tracer.enabled() {
+		return ctx, nil
+	}
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.Parent = parent.SpanID
+		span.Flags = parent.Flags
+	} else if remote.IsValid() {
+		span.TraceID = remote.TraceID
+		span.Parent = remote.SpanID
+		span.Flags = remote.Flags
+	} else {
+		randomBytes(span.TraceID[:])
+		span.Flags = traceFlagSampled
+	}
+	randomBytes(span.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// Identifiers only need to be unique, fall back on the clock
+		now := time.Now().UnixNano()
+		for i := range b {
+			b[i] = byte(now >> (8 * (i % 8)))
+		}
+	}
+}
+
+// Receives batches of finished spans.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+type tracerState struct {
+	mu       sync.RWMutex
+	exporter SpanExporter
+	queue    chan *Span
+}
+
+var tracer = &tracerState{}
+
+func (t *tracerState) enabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.exporter != nil
+}
+
+func (t *tracerState) enqueue(span *Span) {
+	// Only export spans the caller (or we) decided to sample
+	if span.Flags&traceFlagSampled == 0 {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		// Drop spans rather than block requests when the exporter falls behind
+	}
+}
+
+// Enables tracing, exporting spans in batches to exporter until ctx is
+// cancelled. Tracing is disabled unless this is called.
+func StartTracing(ctx context.Context, exporter SpanExporter) {
+	tracer.mu.Lock()
+	tracer.exporter = exporter
+	tracer.queue = make(chan *Span, traceQueueSize)
+	queue := tracer.queue
+	tracer.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(traceFlushInterval)
+		defer ticker.Stop()
+		batch := make([]*Span, 0, traceBatchSize)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			exportCtx, cancel := context.WithTimeout(context.Background(), traceFlushInterval)
+			if err := exporter.ExportSpans(exportCtx, batch); err != nil {
+				rootLogger.Warn("could not export spans", "spans", len(batch), "error", err)
+			}
+			cancel()
+			batch = make([]*Span, 0, traceBatchSize)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				flush()
+				return
+			case span := <-queue:
+				batch = append(batch, span)
+				if len(batch) >= traceBatchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// Starts a server span for every request served by next, joining the trace
+// of the caller when it sends a traceparent header.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _ := ParseTraceparent(r.Header.Get(traceparentHeader))
+		ctx, span := startSpanWithParent(
+			r.Context(),
+			fmt.Sprintf("%s %s", r.Method, endpointLabel(r.URL.Path)),
+			SpanKindServer,
+			remote,
+		)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.Finish()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", recorder.status)
+		if recorder.status >= http.StatusBadRequest {
+			code := recorder.errorCode()
+			span.SetAttribute("rosetta.error_code", code)
+			span.SetError(fmt.Sprintf("HTTP %d, Rosetta error code %s", recorder.status, code))
+		}
+	})
+}
+
+// Wraps the transport of the core rosetta client to trace each upstream
+// call and propagate the trace context to core rosetta.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func NewTracingTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &tracingTransport{next: next}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpanWithParent(
+		req.Context(),
+		"core "+upstreamCallLabel(req),
+		SpanKindClient,
+		SpanContext{},
+	)
+	if span == nil {
+		return t.next.RoundTrip(req)
+	}
+	defer span.Finish()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+
+	// A RoundTripper must not modify the request it was given
+	outbound := req.Clone(ctx)
+	outbound.Header.Set(traceparentHeader, span.Traceparent())
+	resp, err := t.next.RoundTrip(outbound)
+	if err != nil {
+		span.SetError(err.Error())
+		return resp, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetError(fmt.Sprintf("HTTP %d", resp.StatusCode))
+	}
+	return resp, err
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Enables tracing for the duration of the test, without an export loop:
+// finished spans are read from the returned queue.
+func enableTestTracing(t *testing.T) chan *Span {
+	queue := make(chan *Span, 16)
+	tracer.mu.Lock()
+	exporter, previous := tracer.exporter, tracer.queue
+	tracer.exporter = NewStdoutExporter(ioutil.Discard)
+	tracer.queue = queue
+	tracer.mu.Unlock()
+	t.Cleanup(func() {
+		tracer.mu.Lock()
+		tracer.exporter, tracer.queue = exporter, previous
+		tracer.mu.Unlock()
+	})
+	return queue
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+		flags byte
+	}{
+		{name: "sampled", value: "00-" + traceID + "-" + spanID + "-01", valid: true, flags: 1},
+		{name: "not sampled", value: "00-" + traceID + "-" + spanID + "-00", valid: true},
+		{name: "surrounding spaces", value: " 00-" + traceID + "-" + spanID + "-01 ", valid: true, flags: 1},
+		{name: "later version with more fields", value: "01-" + traceID + "-" + spanID + "-01-extra", valid: true, flags: 1},
+		{name: "version 00 with more fields", value: "00-" + traceID + "-" + spanID + "-01-extra"},
+		{name: "invalid version", value: "ff-" + traceID + "-" + spanID + "-01"},
+		{name: "short trace id", value: "00-" + traceID[2:] + "-" + spanID + "-01"},
+		{name: "short span id", value: "00-" + traceID + "-" + spanID[2:] + "-01"},
+		{name: "non hex trace id", value: "00-" + "zz" + traceID[2:] + "-" + spanID + "-01"},
+		{name: "non hex flags", value: "00-" + traceID + "-" + spanID + "-0g"},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-" + spanID + "-01"},
+		{name: "zero span id", value: "00-" + traceID + "-0000000000000000-01"},
+		{name: "empty", value: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, valid := ParseTraceparent(test.value)
+			if valid != test.valid {
+				t.Fatalf("valid %v, expected %v", valid, test.valid)
+			}
+			if !valid {
+				return
+			}
+			if sc.TraceID.String() != traceID || sc.SpanID.String() != spanID || sc.Flags != test.flags {
+				t.Errorf("parsed %s %s %02x", sc.TraceID, sc.SpanID, sc.Flags)
+			}
+			// Formatting gives back an equivalent version 00 value
+			if parsed, _ := ParseTraceparent(sc.Traceparent()); parsed != sc {
+				t.Errorf("%s parsed back as %+v", sc.Traceparent(), parsed)
+			}
+		})
+	}
+}
+
+// A request joining the trace of its caller is traced through to core
+// rosetta: the server span is a child of the caller's span, the client span
+// of the server span, and core receives the client span as parent.
+func TestTracePropagation(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		exported    int
+	}{
+		{name: "sampled caller", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", exported: 2},
+		// Spans are propagated but not exported
+		{name: "unsampled caller", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "no caller trace", exported: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := enableTestTracing(t)
+			var upstream string
+			core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r.Header.Get(traceparentHeader)
+			}))
+			defer core.Close()
+			client := &http.Client{Transport: NewTracingTransport(nil)}
+
+			var serverSpan SpanContext
+			handler := TracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serverSpan = SpanFromContext(r.Context()).SpanContext
+				req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, core.URL+"/block", nil)
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/block", nil)
+			if test.traceparent != "" {
+				req.Header.Set(traceparentHeader, test.traceparent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			caller, fromCaller := ParseTraceparent(test.traceparent)
+			upstreamSpan, ok := ParseTraceparent(upstream)
+			if !ok {
+				t.Fatalf("core received traceparent %q", upstream)
+			}
+			if fromCaller && (serverSpan.TraceID != caller.TraceID || upstreamSpan.TraceID != caller.TraceID) {
+				t.Errorf("trace %s then %s, expected the caller's %s", serverSpan.TraceID, upstreamSpan.TraceID, caller.TraceID)
+			}
+			if upstreamSpan.TraceID != serverSpan.TraceID || upstreamSpan.Flags != serverSpan.Flags {
+				t.Errorf("core received trace %s flags %02x, expected %s flags %02x",
+					upstreamSpan.TraceID, upstreamSpan.Flags, serverSpan.TraceID, serverSpan.Flags)
+			}
+
+			var spans []*Span
+			for len(queue) > 0 {
+				spans = append(spans, <-queue)
+			}
+			if len(spans) != test.exported {
+				t.Fatalf("%d spans exported, expected %d", len(spans), test.exported)
+			}
+			if len(spans) == 0 {
+				return
+			}
+			// The client span ends first
+			clientSpan, server := spans[0], spans[1]
+			if clientSpan.Kind != SpanKindClient || server.Kind != SpanKindServer {
+				t.Fatalf("span kinds %d and %d", clientSpan.Kind, server.Kind)
+			}
+			if clientSpan.SpanID != upstreamSpan.SpanID || clientSpan.Parent != server.SpanID {
+				t.Errorf("client span %s with parent %s, expected %s with parent %s",
+					clientSpan.SpanID, clientSpan.Parent, upstreamSpan.SpanID, server.SpanID)
+			}
+			if fromCaller && server.Parent != caller.SpanID {
+				t.Errorf("server span parent %s, expected %s", server.Parent, caller.SpanID)
+			}
+			if !fromCaller && server.Parent != (SpanID{}) {
+				t.Errorf("server span parent %s, expected a root span", server.Parent)
+			}
+		})
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var received otlpTracesRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("content type %q", r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := &Span{
+		SpanContext: sc,
+		Name:        "BlockAPIService.Block",
+		Kind:        SpanKindInternal,
+		Attributes:  map[string]interface{}{"block.index": int64(10)},
+	}
+	span.SetError("core unavailable")
+	if err := NewOTLPExporter(collector.URL).ExportSpans(context.Background(), []*Span{span}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received.ResourceSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("received %+v", received)
+	}
+	if name := received.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name == nil || *name != TraceServiceName {
+		t.Errorf("service name %v", name)
+	}
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("received %d spans", len(spans))
+	}
+	got := spans[0]
+	if got.TraceID != sc.TraceID.String() || got.SpanID != sc.SpanID.String() || got.ParentSpanID != "" {
+		t.Errorf("span %s/%s with parent %q", got.TraceID, got.SpanID, got.ParentSpanID)
+	}
+	if got.Status.Code != SpanStatusError || got.Status.Message != "core unavailable" {
+		t.Errorf("status %+v", got.Status)
+	}
+	// OTLP JSON encodes 64 bit integers as strings
+	if len(got.Attributes) != 1 || got.Attributes[0].Value.IntValue == nil || *got.Attributes[0].Value.IntValue != "10" {
+		t.Errorf("attributes %+v", got.Attributes)
+	}
+}
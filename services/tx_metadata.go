@@ -0,0 +1,137 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"math/big"
+	"strings"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/celo-blockchain/common/hexutil"
+	gethTypes "github.com/celo-org/celo-blockchain/core/types"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Transaction metadata keys set in /block responses when a Celo node is configured
+const (
+	MetadataFrom                = "from"
+	MetadataTo                  = "to"
+	MetadataMethod              = "method"
+	MetadataGasUsed             = "gas_used"
+	MetadataGasPrice            = "gas_price"
+	MetadataFeeCurrency         = "fee_currency"
+	MetadataGatewayFee          = "gateway_fee"
+	MetadataGatewayFeeRecipient = "gateway_fee_recipient"
+	MetadataStatus              = "status"
+)
+
+// Whether tx is an on-chain transaction, rather than a synthetic one such
+// as the genesis or inflation adjustment transactions.
+func isOnChainTransaction(tx *types.Transaction) bool {
+	hash := tx.TransactionIdentifier.Hash
+	return len(hash) == 2+2*common.HashLength && strings.HasPrefix(hash, "0x")
+}
+
+// Sets the sender, target, decoded method, fees and status of the on-chain
+// transactions of block, from the transactions and receipts of the Celo
+// node, retypes gateway fees paid in cUSD as fee operations and tags the
+// operations of contract calls with their intent. A no-op unless a node is
+// configured.
+func (s *BlockAPIService) addTransactionMetadata(
+	ctx context.Context,
+	block *types.BlockIdentifier,
+	transactions []*types.Transaction,
+) *types.Error {
+	if s.node == nil {
+		return nil
+	}
+	var onChain []*types.Transaction
+	var hashes []common.Hash
+	for _, tx := range transactions {
+		if isOnChainTransaction(tx) {
+			onChain = append(onChain, tx)
+			hashes = append(hashes, common.HexToHash(tx.TransactionIdentifier.Hash))
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	nodeTxs, receipts, err := s.node.minedTransactions(ctx, hashes)
+	if err != nil {
+		return nodeError(ctx, "transactions", err)
+	}
+	for i, tx := range onChain {
+		nodeTx, receipt := nodeTxs[i], receipts[i]
+		// The receipt must be from the same chain view as the block
+		if !strings.EqualFold(receipt.BlockHash.Hex(), block.Hash) {
+			blockMismatches.inc()
+			changed := *ErrBlockChanged
+			changed.Details = map[string]interface{}{
+				"block_index":        block.Index,
+				"block_hash":         block.Hash,
+				"receipt_block_hash": receipt.BlockHash.Hex(),
+			}
+			return &changed
+		}
+		if tx.Metadata == nil {
+			tx.Metadata = make(map[string]interface{})
+		}
+		s.setTransactionMetadata(tx.Metadata, nodeTx, receipt)
+		s.tagGatewayFee(tx, nodeTx)
+		s.tagOperations(tx, nodeTx)
+	}
+	return nil
+}
+
+func (s *BlockAPIService) setTransactionMetadata(
+	metadata map[string]interface{},
+	tx *nodeTransaction,
+	receipt *nodeReceipt,
+) {
+	metadata[MetadataFrom] = tx.From.Hex()
+	if tx.To != nil {
+		metadata[MetadataTo] = tx.To.Hex()
+		if *tx.To == s.stableToken.Address && len(tx.Input) >= 4 {
+			if method, err := s.stableToken.ABI.MethodById(tx.Input[:4]); err == nil {
+				metadata[MetadataMethod] = method.Name
+			}
+		}
+	}
+	metadata[MetadataGasUsed] = uint64(receipt.GasUsed)
+	metadata[MetadataGasPrice] = bigString(tx.GasPrice)
+	// Fees are paid in CELO unless a fee currency is set
+	if tx.FeeCurrency != nil {
+		metadata[MetadataFeeCurrency] = tx.FeeCurrency.Hex()
+	}
+	if tx.GatewayFeeRecipient != nil {
+		metadata[MetadataGatewayFeeRecipient] = tx.GatewayFeeRecipient.Hex()
+		metadata[MetadataGatewayFee] = bigString(tx.GatewayFee)
+	}
+	if uint64(receipt.Status) == gethTypes.ReceiptStatusSuccessful {
+		metadata[MetadataStatus] = OpSuccess.Status
+	} else {
+		metadata[MetadataStatus] = OpFailed.Status
+	}
+}
+
+// Decimal string of a quantity returned by the node, "0" if absent.
+func bigString(value *hexutil.Big) string {
+	if value == nil {
+		return "0"
+	}
+	return (*big.Int)(value).String()
+}
@@ -16,7 +16,6 @@ package services
 
 import (
 	"errors"
-	"log"
 	"math/big"
 
 	"github.com/celo-org/kliento/contracts"
@@ -27,16 +26,29 @@ import (
 )
 
 const (
+	// Block metadata key, false for blocks prior to StableToken.BlockThreshold
+	MetadataStableTokenDeployed = "stable_token_deployed"
+	// Version metadata keys returned by /network/options
+	MetadataStableTokenAddress         = "stable_token_address"
+	MetadataStableTokenActivationIndex = "stable_token_activation_index"
+
 	// Operations
 	OpTransfer = "transfer"
 	OpFee      = "fee"
 	OpMint     = "mint"
 	OpBurn     = "burn"
+	// Balance change caused by the StableToken inflation factor, see InflationTracker
+	OpInflation = "inflation_adjustment"
+	// CELO/cUSD exchange through the Exchange contract, construction only
+	OpSwap = "swap"
+	// Approval of the Exchange to pull the amount sold by a swap, construction only
+	OpApprove = "approve"
 )
 
 var (
 	// TODO potentially remove from Rosetta core, as it shouldn't really be used there (perhaps for Construction)
 	CeloDollar = rpc.CeloDollar
+	CeloGold   = rpc.CeloGold
 
 	// StableToken contract param
 	ZeroAddress common.Address = common.HexToAddress("0x0")
@@ -47,11 +59,49 @@ var (
 	ErrUnimplemented = rpc.ErrUnimplemented
 	ErrInternal      = rpc.ErrInternal
 
+	// Errors specific to this module start at 1000 to avoid collisions with core rosetta
+	ErrStableTokenNotDeployed = &types.Error{
+		Code:      1000,
+		Message:   "StableToken not deployed at requested block",
+		Retriable: false,
+	}
+	ErrCoreUnavailable = &types.Error{
+		Code:      1001,
+		Message:   "Core rosetta unavailable",
+		Retriable: true,
+	}
+	ErrBlockChanged = &types.Error{
+		Code:      1002,
+		Message:   "Block changed while being read, likely due to a chain reorganization",
+		Retriable: true,
+	}
+	ErrNodeUnavailable = &types.Error{
+		Code:      1003,
+		Message:   "Celo node unavailable",
+		Retriable: true,
+	}
+	ErrNotPending = &types.Error{
+		Code:      1004,
+		Message:   "Transaction to replace is not pending",
+		Retriable: false,
+	}
+	ErrNotTracked = &types.Error{
+		Code:      1005,
+		Message:   "Transaction not submitted through this server",
+		Retriable: false,
+	}
+
 	AllErrors = []*types.Error{
 		ErrValidation,
 		ErrCeloClient,
 		ErrUnimplemented,
 		ErrInternal,
+		ErrStableTokenNotDeployed,
+		ErrCoreUnavailable,
+		ErrBlockChanged,
+		ErrNodeUnavailable,
+		ErrNotPending,
+		ErrNotTracked,
 	}
 
 	// Operations and statuses
@@ -72,22 +122,46 @@ var (
 		OpFee,
 		OpMint,
 		OpBurn,
+		OpInflation,
+		OpSwap,
+		OpApprove,
 	}
 )
 
 // Types and wrappers for types that are not specific to one service
 type StableToken struct {
+	// First block at which the StableToken contract is registered on chain
 	BlockThreshold int64
 	Address        common.Address
 	ABI            *abi.ABI
+	// Accounts that may have been credited by initialize() without a Transfer log
+	InitialHolders []common.Address
+	// Protocol contracts that move cUSD on behalf of users
+	ExchangeAddress  common.Address
+	ExchangeABI      *abi.ABI
+	ReserveAddress   common.Address
+	GoldTokenAddress common.Address
 }
 
-func NewStableToken(networkId string) (*StableToken, error) {
-	var params StableToken
+// Parses the ABIs of the StableToken and of the contracts moving cUSD.
+func parseStableTokenABIs(params *StableToken) error {
 	var err error
 	params.ABI, err = contracts.ParseStableTokenABI()
 	if err != nil {
-		logError("could not parse StableToken ABI")
+		rootLogger.Error("could not parse StableToken ABI", "error", err)
+		return err
+	}
+	params.ExchangeABI, err = contracts.ParseExchangeABI()
+	if err != nil {
+		rootLogger.Error("could not parse Exchange ABI", "error", err)
+		return err
+	}
+	return nil
+}
+
+func NewStableToken(networkId string) (*StableToken, error) {
+	var params StableToken
+	if err := parseStableTokenABIs(&params); err != nil {
 		return nil, err
 	}
 
@@ -96,16 +170,54 @@ func NewStableToken(networkId string) (*StableToken, error) {
 	case "42220":
 		params.BlockThreshold = 2962
 		params.Address = common.HexToAddress("0x765de816845861e75a25fca122bb6898b8b1282a")
+		params.ExchangeAddress = common.HexToAddress("0x67316300f17f063085Ca8bCa4bd3f7a5a3C66275")
+		params.ReserveAddress = common.HexToAddress("0x9380fA34Fd9e4Fd14c06305fd7B6199089eD4eb9")
+		params.GoldTokenAddress = common.HexToAddress("0x471EcE3750Da237f93B8E339c536989b8978a438")
 	// Testnet
 	case "44787":
 		params.BlockThreshold = 544
 		params.Address = common.HexToAddress("0x874069Fa1Eb16D44d622F2e0Ca25eeA172369bC1")
+		params.ExchangeAddress = common.HexToAddress("0x17bc3304F94c85618c46d0888aA937148007bD3C")
+		params.ReserveAddress = common.HexToAddress("0xa7ed835288Aa4524bB6C73DD23c0bF4315D9Fe3e")
+		params.GoldTokenAddress = common.HexToAddress("0xF194afDf50B03e69Bd7D057c1Aa9e10c9954E4C9")
 	default:
 		return nil, errors.New("unable to initialize StableToken")
 	}
 	return &params, nil
 }
 
+// Like NewStableToken, with the address and activation index replaced by
+// those given (if not nil). Networks unknown to NewStableToken are
+// supported when both are given.
+func NewStableTokenWithOverrides(
+	networkId string,
+	address *common.Address,
+	activationIndex *int64,
+) (*StableToken, error) {
+	params, err := NewStableToken(networkId)
+	if err != nil {
+		if address == nil || activationIndex == nil {
+			return nil, err
+		}
+		params = &StableToken{}
+		if err := parseStableTokenABIs(params); err != nil {
+			return nil, err
+		}
+	}
+	if address != nil {
+		params.Address = *address
+	}
+	if activationIndex != nil {
+		params.BlockThreshold = *activationIndex
+	}
+	return params, nil
+}
+
+// Whether the StableToken contract is registered on chain at block index
+func (st *StableToken) DeployedAt(index int64) bool {
+	return index >= st.BlockThreshold
+}
+
 func newAtomicOp(
 	account common.Address,
 	opIndex int64,
@@ -129,7 +241,3 @@ func newAtomicOp(
 	}
 	return op
 }
-
-func logError(errMsg string) {
-	log.Printf("ERROR: %s\n", errMsg)
-}
@@ -0,0 +1,259 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+// Core rosetta endpoints whose requests must reach it at most once
+var nonRetriablePaths = map[string]struct{}{
+	"/construction/submit": {},
+}
+
+var errCircuitOpen = errors.New("core rosetta circuit breaker is open after repeated failures")
+
+// How CorePool times out, retries and cuts off requests to core rosetta.
+type UpstreamPolicy struct {
+	// Timeout of each attempt, unless overridden for its path in Timeouts
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+	// Retries of idempotent requests that fail transiently: connection
+	// errors, timeouts, gateway errors and errors core marks as retriable
+	Retries int
+	// Bounds of the jittered exponential backoff between attempts
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Consecutive failures of a backend after which its requests fail fast
+	// for BreakerCooldown, before a single probe is let through (0 disables)
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+func DefaultUpstreamPolicy() UpstreamPolicy {
+	return UpstreamPolicy{
+		Timeout:          10 * time.Second,
+		Retries:          2,
+		Backoff:          200 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+func (p *UpstreamPolicy) timeoutFor(path string) time.Duration {
+	if timeout, ok := p.Timeouts[path]; ok {
+		return timeout
+	}
+	return p.Timeout
+}
+
+// Full jitter: a random delay up to the exponential backoff of attempt
+func (p *UpstreamPolicy) backoffFor(attempt int) time.Duration {
+	backoff := p.Backoff << uint(attempt)
+	if backoff <= 0 || backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff))) // #nosec G404 -- jitter needs no cryptographic randomness
+}
+
+// Number of attempts req may be sent in: requests that must reach core at
+// most once, or whose body cannot be sent again, get a single one.
+func (p *UpstreamPolicy) attemptsFor(req *http.Request) int {
+	if _, nonRetriable := nonRetriablePaths[req.URL.Path]; nonRetriable {
+		return 1
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return 1
+	}
+	return 1 + p.Retries
+}
+
+// Returns a copy of req with a fresh body and the deadline of its path.
+func (p *UpstreamPolicy) prepare(req *http.Request, attempt int) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	if timeout := p.timeoutFor(req.URL.Path); timeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	}
+	attemptReq := req.Clone(ctx)
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		attemptReq.Body = body
+	}
+	return attemptReq, cancel, nil
+}
+
+// Whether an attempt failed in a way that counts against core rosetta's
+// availability, and whether it is worth retrying. Errors core answers with
+// are only retried when core marks them retriable, and do not count as
+// failures since core is up.
+func classifyUpstream(resp *http.Response, err error) (failed bool, retriable bool) {
+	if err != nil {
+		return true, true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return true, true
+	case http.StatusInternalServerError:
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if readErr != nil {
+			return true, true
+		}
+		var rosettaErr types.Error
+		if json.Unmarshal(body, &rosettaErr) != nil {
+			return false, false
+		}
+		return false, rosettaErr.Retriable
+	}
+	return false, false
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Opens after threshold consecutive failures of the backend it guards.
+// While open, requests fail with errCircuitOpen until cooldown has passed;
+// then a single probe is let through, closing the breaker if it succeeds and
+// reopening it otherwise.
+type circuitBreaker struct {
+	backend   string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return errCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// Whether allow would let a request through, without reserving the probe.
+func (b *circuitBreaker) available() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures < b.threshold || !time.Now().Before(b.openUntil) && !b.probing
+}
+
+// Whether the breaker is open, a probe being let through or not.
+func (b *circuitBreaker) open() bool {
+	if b.threshold <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		if b.failures >= b.threshold {
+			rootLogger.Info("core rosetta circuit breaker closed", "backend", b.backend)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			rootLogger.Warn("core rosetta circuit breaker opened", "backend", b.backend, "failures", b.failures, "cooldown", b.cooldown)
+			upstreamCircuitOpens.inc(b.backend)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// Ends an attempt whose outcome is unknown, letting another probe through
+// without changing the state of the breaker.
+func (b *circuitBreaker) abandon() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// The error to return for a failed call to core rosetta: core's own error,
+// retriability included, when it answered with one, or ErrCoreUnavailable
+// with the cause when it could not be reached. Nil if the call succeeded.
+func upstreamError(ctx context.Context, call string, clientErr *types.Error, err error) *types.Error {
+	if clientErr != nil {
+		loggerFrom(ctx).Info("core rosetta returned an error", "call", call, "upstream_error", clientErr)
+		return clientErr
+	}
+	if err == nil {
+		return nil
+	}
+	loggerFrom(ctx).Warn("core rosetta call failed", "call", call, "error", err)
+	unavailable := *ErrCoreUnavailable
+	unavailable.Details = map[string]interface{}{
+		"call":  call,
+		"error": err.Error(),
+	}
+	return &unavailable
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	type step struct {
+		// "allow" expects allow to return err, "fail", "succeed" and
+		// "abandon" record the outcome of an attempt, "wait" sleeps past the cooldown
+		action string
+		err    error
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+	}{
+		{
+			name:      "disabled",
+			threshold: 0,
+			steps: []step{
+				{action: "fail"}, {action: "fail"}, {action: "fail"},
+				{action: "allow"},
+			},
+		},
+		{
+			name:      "stays closed below threshold",
+			threshold: 3,
+			steps: []step{
+				{action: "fail"}, {action: "fail"},
+				{action: "allow"},
+			},
+		},
+		{
+			name:      "successes reset failures",
+			threshold: 2,
+			steps: []step{
+				{action: "fail"}, {action: "succeed"}, {action: "fail"},
+				{action: "allow"},
+			},
+		},
+		{
+			name:      "opens at threshold",
+			threshold: 2,
+			steps: []step{
+				{action: "fail"}, {action: "fail"},
+				{action: "allow", err: errCircuitOpen},
+			},
+		},
+		{
+			name:      "single probe after cooldown",
+			threshold: 1,
+			steps: []step{
+				{action: "fail"},
+				{action: "wait"},
+				{action: "allow"},
+				{action: "allow", err: errCircuitOpen},
+			},
+		},
+		{
+			name:      "successful probe closes",
+			threshold: 1,
+			steps: []step{
+				{action: "fail"},
+				{action: "wait"},
+				{action: "allow"},
+				{action: "succeed"},
+				{action: "allow"},
+				{action: "allow"},
+			},
+		},
+		{
+			name:      "failed probe reopens",
+			threshold: 1,
+			steps: []step{
+				{action: "fail"},
+				{action: "wait"},
+				{action: "allow"},
+				{action: "fail"},
+				{action: "allow", err: errCircuitOpen},
+			},
+		},
+		{
+			name:      "abandoned probe lets another through",
+			threshold: 1,
+			steps: []step{
+				{action: "fail"},
+				{action: "wait"},
+				{action: "allow"},
+				{action: "abandon"},
+				{action: "allow"},
+				{action: "allow", err: errCircuitOpen},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &circuitBreaker{threshold: test.threshold, cooldown: cooldown}
+			for i, step := range test.steps {
+				switch step.action {
+				case "allow":
+					if err := b.allow(); err != step.err {
+						t.Fatalf("step %d: allow returned %v, expected %v", i, err, step.err)
+					}
+				case "fail":
+					b.record(true)
+				case "succeed":
+					b.record(false)
+				case "abandon":
+					b.abandon()
+				case "wait":
+					time.Sleep(2 * cooldown)
+				}
+			}
+		})
+	}
+}
+
+func TestClassifyUpstream(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		status    int
+		body      string
+		failed    bool
+		retriable bool
+	}{
+		{name: "transport error", err: errors.New("connection refused"), failed: true, retriable: true},
+		{name: "ok", status: http.StatusOK, body: "{}"},
+		{name: "bad request", status: http.StatusBadRequest, body: "{}"},
+		{name: "bad gateway", status: http.StatusBadGateway, failed: true, retriable: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, failed: true, retriable: true},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, failed: true, retriable: true},
+		{name: "request timeout", status: http.StatusRequestTimeout, failed: true, retriable: true},
+		{name: "retriable rosetta error", status: http.StatusInternalServerError, body: `{"code": 1, "message": "m", "retriable": true}`, retriable: true},
+		{name: "rosetta error", status: http.StatusInternalServerError, body: `{"code": 1, "message": "m", "retriable": false}`},
+		{name: "non rosetta error", status: http.StatusInternalServerError, body: "panic"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var resp *http.Response
+			if test.err == nil {
+				resp = &http.Response{
+					StatusCode: test.status,
+					Body:       ioutil.NopCloser(strings.NewReader(test.body)),
+				}
+			}
+			failed, retriable := classifyUpstream(resp, test.err)
+			if failed != test.failed || retriable != test.retriable {
+				t.Errorf("failed %v retriable %v, expected %v %v", failed, retriable, test.failed, test.retriable)
+			}
+			if resp != nil {
+				// The body is still readable by the caller
+				body, _ := ioutil.ReadAll(resp.Body)
+				if string(body) != test.body {
+					t.Errorf("body %q, expected %q", body, test.body)
+				}
+			}
+		})
+	}
+}
+
+func TestCorePoolCancelledProbe(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	pool, err := NewCorePool(
+		[]string{server.URL},
+		nil,
+		BalanceRoundRobin,
+		DefaultCoreMaxBlockLag,
+		UpstreamPolicy{Timeout: time.Minute, BreakerThreshold: 1, BreakerCooldown: time.Millisecond},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker := pool.backends[0].breaker
+	// Open the breaker, then let its cooldown pass
+	breaker.record(true)
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, CorePoolURL+"/block", nil)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := pool.RoundTrip(req); err == nil {
+		t.Fatal("expected the cancelled probe to fail")
+	}
+
+	// The cancelled probe neither closed nor reopened the breaker
+	breaker.mu.Lock()
+	failures, probing := breaker.failures, breaker.probing
+	breaker.mu.Unlock()
+	if failures != 1 || probing {
+		t.Errorf("failures %d probing %v, expected 1 false", failures, probing)
+	}
+	if err := breaker.allow(); err != nil {
+		t.Errorf("next probe not allowed: %v", err)
+	}
+}
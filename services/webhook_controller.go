@@ -0,0 +1,121 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/coinbase/rosetta-sdk-go/server"
+)
+
+type WebhookListResponse struct {
+	Subscriptions []*WebhookSubscription `json:"subscriptions"`
+}
+
+type WebhookRemoveRequest struct {
+	ID string `json:"id"`
+}
+
+// Serves the admin API used to manage webhook subscriptions.
+// Implements the server.Router interface.
+type WebhookAPIController struct {
+	service    *WebhookService
+	adminToken string
+}
+
+func NewWebhookAPIController(service *WebhookService, adminToken string) *WebhookAPIController {
+	return &WebhookAPIController{
+		service:    service,
+		adminToken: adminToken,
+	}
+}
+
+func (c *WebhookAPIController) Routes() server.Routes {
+	return server.Routes{
+		{
+			Name:        "WebhookRegister",
+			Method:      http.MethodPost,
+			Pattern:     "/admin/webhooks/register",
+			HandlerFunc: c.authorized(c.WebhookRegister),
+		},
+		{
+			Name:        "WebhookList",
+			Method:      http.MethodPost,
+			Pattern:     "/admin/webhooks/list",
+			HandlerFunc: c.authorized(c.WebhookList),
+		},
+		{
+			Name:        "WebhookRemove",
+			Method:      http.MethodPost,
+			Pattern:     "/admin/webhooks/remove",
+			HandlerFunc: c.authorized(c.WebhookRemove),
+		},
+	}
+}
+
+// Requires "Authorization: Bearer <adminToken>". Every request is rejected
+// if no admin token is configured.
+func (c *WebhookAPIController) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + c.adminToken)
+		if c.adminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			encodeErrorResponse(w, http.StatusUnauthorized, ErrValidation, errors.New("invalid admin token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// endpoint: /admin/webhooks/register
+func (c *WebhookAPIController) WebhookRegister(w http.ResponseWriter, r *http.Request) {
+	var sub WebhookSubscription
+	if err := decodeJSONRequest(r, &sub); err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+	registered, err := c.service.Register(&sub)
+	if err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+	encodeJSONResponse(w, http.StatusOK, registered.redacted())
+}
+
+// endpoint: /admin/webhooks/list
+func (c *WebhookAPIController) WebhookList(w http.ResponseWriter, r *http.Request) {
+	subs := c.service.Subscriptions()
+	for i, sub := range subs {
+		subs[i] = sub.redacted()
+	}
+	encodeJSONResponse(w, http.StatusOK, &WebhookListResponse{
+		Subscriptions: subs,
+	})
+}
+
+// endpoint: /admin/webhooks/remove
+func (c *WebhookAPIController) WebhookRemove(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRemoveRequest
+	if err := decodeJSONRequest(r, &req); err != nil {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, err)
+		return
+	}
+	if !c.service.Unregister(req.ID) {
+		encodeErrorResponse(w, http.StatusInternalServerError, ErrValidation, errors.New("unknown subscription"))
+		return
+	}
+	encodeJSONResponse(w, http.StatusOK, &req)
+}
@@ -0,0 +1,456 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/rosetta/service/rpc"
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const (
+	// Header carrying the hex encoded HMAC-SHA256 of the request body
+	WebhookSignatureHeader = "X-Rosetta-Cusd-Signature"
+
+	webhookMaxAttempts    = 8
+	webhookInitialBackoff = 1 * time.Second
+	webhookMaxBackoff     = 5 * time.Minute
+	webhookTimeout        = 10 * time.Second
+	// Blocks queued per subscription while earlier ones are delivered
+	webhookQueueSize = 256
+	// Bytes of a response body read before the connection is reused
+	webhookMaxResponseSize = 64 << 10
+)
+
+// Returned by Register for an ID that is already registered.
+var errWebhookExists = errors.New("a subscription with this id already exists")
+
+// A callback URL that is notified about cUSD operations touching any of Addresses.
+type WebhookSubscription struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Addresses []string `json:"addresses"`
+	// Overrides the service wide signing secret if set
+	Secret string `json:"secret,omitempty"`
+
+	watched map[common.Address]struct{}
+}
+
+// Body posted to a subscription's URL, one per block.
+type WebhookPayload struct {
+	SubscriptionID    string                   `json:"subscription_id"`
+	NetworkIdentifier *types.NetworkIdentifier `json:"network_identifier"`
+	BlockIdentifier   *types.BlockIdentifier   `json:"block_identifier"`
+	Timestamp         int64                    `json:"timestamp"`
+	Transactions      []*types.Transaction     `json:"transactions"`
+}
+
+type webhookDelivery struct {
+	subscription *WebhookSubscription
+	body         []byte
+	blockIndex   int64
+}
+
+// The deliveries of a single subscription, sent in order by their own
+// goroutine so that a failing endpoint only delays its own blocks.
+type webhookQueue struct {
+	deliveries chan *webhookDelivery
+	done       <-chan struct{}
+	cancel     context.CancelFunc
+	// Parents of the blocks queued or being delivered, oldest first
+	pending []*types.BlockIdentifier
+}
+
+// Notifies registered subscriptions about cUSD operations seen on
+// blocks delivered by a BlockWatcher.
+type WebhookService struct {
+	network    *types.NetworkIdentifier
+	secret     []byte
+	httpClient *http.Client
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	queueSize      int
+
+	mu            sync.RWMutex
+	subscriptions map[string]*WebhookSubscription
+	queues        map[string]*webhookQueue
+	// Set by Start, queues are only started once the service is
+	ctx context.Context
+
+	// Where the cursor is persisted, if anywhere
+	cursorFile string
+	// Last block given to HandleBlock
+	handled *types.BlockIdentifier
+	// Last cursor written to cursorFile
+	saved *types.BlockIdentifier
+}
+
+func NewWebhookService(
+	network *types.NetworkIdentifier,
+	secret string,
+) *WebhookService {
+	return &WebhookService{
+		network:        network,
+		secret:         []byte(secret),
+		httpClient:     &http.Client{Timeout: webhookTimeout},
+		maxAttempts:    webhookMaxAttempts,
+		initialBackoff: webhookInitialBackoff,
+		maxBackoff:     webhookMaxBackoff,
+		queueSize:      webhookQueueSize,
+		subscriptions:  make(map[string]*WebhookSubscription),
+		queues:         make(map[string]*webhookQueue),
+	}
+}
+
+// Loads subscriptions from a JSON file containing a list of WebhookSubscription.
+func (s *WebhookService) LoadConfig(path string) error {
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if err != nil {
+		return err
+	}
+	var subs []*WebhookSubscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if _, err := s.Register(sub); err != nil {
+			return fmt.Errorf("invalid webhook subscription %q: %w", sub.ID, err)
+		}
+	}
+	return nil
+}
+
+// Persists to path the last block whose deliveries are all done, and
+// returns the one saved there by a previous run, nil if there is none.
+// The BlockWatcher feeding the service resumes after it.
+func (s *WebhookService) SetCursorFile(path string) (*types.BlockIdentifier, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursorFile = path
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cursor types.BlockIdentifier
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid webhook cursor in %s: %w", path, err)
+	}
+	s.saved = &cursor
+	return &cursor, nil
+}
+
+// Writes the cursor if it moved: the last block handled, or the block
+// before the oldest one not yet delivered. Must be called with s.mu held.
+func (s *WebhookService) saveCursor() {
+	if s.cursorFile == "" || s.handled == nil {
+		return
+	}
+	cursor := s.handled
+	for _, queue := range s.queues {
+		if len(queue.pending) > 0 && queue.pending[0].Index < cursor.Index {
+			cursor = queue.pending[0]
+		}
+	}
+	if s.saved != nil && *s.saved == *cursor {
+		return
+	}
+	data, err := json.Marshal(cursor)
+	if err == nil {
+		// Written aside and renamed, so that a crash never leaves a partial cursor
+		tmp := s.cursorFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, s.cursorFile)
+		}
+	}
+	if err != nil {
+		rootLogger.Error("could not save webhook cursor", "path", s.cursorFile, "error", err)
+		return
+	}
+	s.saved = cursor
+}
+
+// Validates and stores a copy of sub, assigning it an ID if it has none.
+// Fails with errWebhookExists if its ID is already registered.
+func (s *WebhookService) Register(sub *WebhookSubscription) (*WebhookSubscription, error) {
+	if u, err := url.Parse(sub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("url must be an absolute http(s) URL")
+	}
+	if len(sub.Addresses) == 0 {
+		return nil, errors.New("at least one address is required")
+	}
+	registered := &WebhookSubscription{
+		ID:        sub.ID,
+		URL:       sub.URL,
+		Addresses: make([]string, len(sub.Addresses)),
+		Secret:    sub.Secret,
+		watched:   make(map[common.Address]struct{}, len(sub.Addresses)),
+	}
+	for i, addr := range sub.Addresses {
+		checksummed, ok := rpc.ChecksumAddress(addr)
+		if !ok {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+		registered.Addresses[i] = checksummed.Hex()
+		registered.watched[*checksummed] = struct{}{}
+	}
+	if registered.ID == "" {
+		id, err := newWebhookID()
+		if err != nil {
+			return nil, err
+		}
+		registered.ID = id
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscriptions[registered.ID]; ok {
+		return nil, errWebhookExists
+	}
+	s.subscriptions[registered.ID] = registered
+	if s.ctx != nil {
+		s.startQueue(registered.ID)
+	}
+	return registered, nil
+}
+
+func (s *WebhookService) Unregister(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.subscriptions[id]
+	delete(s.subscriptions, id)
+	if queue, ok := s.queues[id]; ok {
+		queue.cancel()
+		delete(s.queues, id)
+	}
+	return ok
+}
+
+func (s *WebhookService) Subscriptions() []*WebhookSubscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs := make([]*WebhookSubscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// Starts delivering to every subscription, registered now or later, until
+// ctx is cancelled.
+func (s *WebhookService) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	for id := range s.subscriptions {
+		s.startQueue(id)
+	}
+}
+
+// Starts the delivery goroutine of subscription id. Must be called with
+// s.mu held.
+func (s *WebhookService) startQueue(id string) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	queue := &webhookQueue{
+		deliveries: make(chan *webhookDelivery, s.queueSize),
+		done:       ctx.Done(),
+		cancel:     cancel,
+	}
+	s.queues[id] = queue
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case d := <-queue.deliveries:
+				s.deliver(ctx, d)
+				if ctx.Err() != nil {
+					// Interrupted, the block is delivered again after a restart
+					return
+				}
+				s.mu.Lock()
+				queue.pending = queue.pending[1:]
+				s.saveCursor()
+				s.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Implements BlockHandler: queues one delivery per subscription that
+// has at least one transaction touching its watched addresses. Blocks
+// while a queue is full, which holds back the BlockWatcher (and the
+// cursor) until that subscription catches up, rather than dropping blocks.
+func (s *WebhookService) HandleBlock(ctx context.Context, block *types.Block) {
+	parent := block.ParentBlockIdentifier
+	if parent == nil {
+		parent = &types.BlockIdentifier{Index: block.BlockIdentifier.Index - 1}
+	}
+	for _, sub := range s.Subscriptions() {
+		var matched []*types.Transaction
+		for _, tx := range block.Transactions {
+			if sub.touches(tx) {
+				matched = append(matched, tx)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		body, err := json.Marshal(&WebhookPayload{
+			SubscriptionID:    sub.ID,
+			NetworkIdentifier: s.network,
+			BlockIdentifier:   block.BlockIdentifier,
+			Timestamp:         block.Timestamp,
+			Transactions:      matched,
+		})
+		if err != nil {
+			rootLogger.Error("could not encode webhook payload", "subscription", sub.ID, "block_index", block.BlockIdentifier.Index, "error", err)
+			continue
+		}
+		s.mu.Lock()
+		queue, ok := s.queues[sub.ID]
+		if ok {
+			queue.pending = append(queue.pending, parent)
+		}
+		s.mu.Unlock()
+		if !ok {
+			// Not started, or removed since
+			continue
+		}
+		d := &webhookDelivery{subscription: sub, body: body, blockIndex: block.BlockIdentifier.Index}
+		select {
+		case queue.deliveries <- d:
+		default:
+			rootLogger.Warn("webhook delivery queue full, waiting for it", "subscription", sub.ID, "block_index", block.BlockIdentifier.Index)
+			select {
+			case queue.deliveries <- d:
+			case <-queue.done:
+				// Removed since
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.handled = block.BlockIdentifier
+	s.saveCursor()
+	s.mu.Unlock()
+}
+
+// Returns a copy of sub that is safe to hand back to API callers.
+func (sub *WebhookSubscription) redacted() *WebhookSubscription {
+	c := *sub
+	c.Secret = ""
+	return &c
+}
+
+func (sub *WebhookSubscription) touches(tx *types.Transaction) bool {
+	for _, op := range tx.Operations {
+		if op.Account == nil {
+			continue
+		}
+		if _, ok := sub.watched[common.HexToAddress(op.Account.Address)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Posts d until it is acknowledged with a 2xx, retrying with exponential backoff.
+func (s *WebhookService) deliver(ctx context.Context, d *webhookDelivery) {
+	logger := rootLogger.With("subscription", d.subscription.ID, "block_index", d.blockIndex)
+	backoff := s.initialBackoff
+	for attempt := 1; attempt <= s.maxAttempts; attempt++ {
+		err := s.post(ctx, d)
+		if err == nil {
+			return
+		}
+		logger.Warn("webhook delivery failed", "attempt", attempt, "max_attempts", s.maxAttempts, "error", err)
+		if attempt == s.maxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+	logger.Error("giving up on webhook delivery")
+}
+
+func (s *WebhookService) post(ctx context.Context, d *webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.subscription.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, s.sign(d.subscription, d.body))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, webhookMaxResponseSize))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Returns "sha256=<hex HMAC of body>" keyed with the subscription or service secret.
+func (s *WebhookService) sign(sub *WebhookSubscription, body []byte) string {
+	secret := s.secret
+	if sub.Secret != "" {
+		secret = []byte(sub.Secret)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
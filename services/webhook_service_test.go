@@ -0,0 +1,347 @@
+// Copyright 2020 Celo Org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/rosetta-sdk-go/types"
+)
+
+const testWatchedAddress = "0x000000000000000000000000000000000000dEaD"
+
+func newTestWebhookService() *WebhookService {
+	s := NewWebhookService(&types.NetworkIdentifier{Blockchain: "celo", Network: "test"}, "secret")
+	s.initialBackoff = time.Millisecond
+	s.maxBackoff = 10 * time.Millisecond
+	s.maxAttempts = 3
+	return s
+}
+
+func testWebhookBlock(index int64) *types.Block {
+	return &types.Block{
+		BlockIdentifier: &types.BlockIdentifier{Index: index, Hash: "0x01"},
+		Transactions: []*types.Transaction{{
+			TransactionIdentifier: &types.TransactionIdentifier{Hash: "0x02"},
+			Operations: []*types.Operation{{
+				OperationIdentifier: &types.OperationIdentifier{Index: 0},
+				Type:                OpTransfer,
+				Account:             &types.AccountIdentifier{Address: testWatchedAddress},
+			}},
+		}},
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	s := newTestWebhookService()
+	if _, err := s.Register(&WebhookSubscription{ID: "sub", URL: server.URL, Addresses: []string{testWatchedAddress}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	s.HandleBlock(ctx, testWebhookBlock(7))
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get(WebhookSignatureHeader) != expected {
+			t.Errorf("signature %q, expected %q", r.Header.Get(WebhookSignatureHeader), expected)
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.SubscriptionID != "sub" || payload.BlockIdentifier.Index != 7 || len(payload.Transactions) != 1 {
+			t.Errorf("unexpected payload %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var calls int32
+	delivered := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		close(delivered)
+	}))
+	defer server.Close()
+
+	s := newTestWebhookService()
+	if _, err := s.Register(&WebhookSubscription{URL: server.URL, Addresses: []string{testWatchedAddress}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	s.HandleBlock(ctx, testWebhookBlock(1))
+
+	select {
+	case <-delivered:
+		if n := atomic.LoadInt32(&calls); n != 2 {
+			t.Errorf("%d attempts, expected 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not retried")
+	}
+}
+
+func TestWebhookFailingSubscriberDoesNotBlockOthers(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	delivered := make(chan int64, 2)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		delivered <- payload.BlockIdentifier.Index
+	}))
+	defer healthy.Close()
+
+	s := newTestWebhookService()
+	// Long enough for the healthy subscription to time out if it waited
+	s.initialBackoff = time.Minute
+	s.maxBackoff = time.Minute
+	for _, sub := range []*WebhookSubscription{
+		{ID: "failing", URL: failing.URL, Addresses: []string{testWatchedAddress}},
+		{ID: "healthy", URL: healthy.URL, Addresses: []string{testWatchedAddress}},
+	} {
+		if _, err := s.Register(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	s.HandleBlock(ctx, testWebhookBlock(1))
+	s.HandleBlock(ctx, testWebhookBlock(2))
+
+	for _, expected := range []int64{1, 2} {
+		select {
+		case index := <-delivered:
+			if index != expected {
+				t.Errorf("delivered block %d, expected %d", index, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("block %d not delivered", expected)
+		}
+	}
+}
+
+func TestWebhookBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	delivered := make(chan int64, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var payload WebhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		delivered <- payload.BlockIdentifier.Index
+	}))
+	defer server.Close()
+
+	s := newTestWebhookService()
+	s.queueSize = 1
+	if _, err := s.Register(&WebhookSubscription{URL: server.URL, Addresses: []string{testWatchedAddress}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	// Block 1 is being delivered, block 2 fills the queue
+	s.HandleBlock(ctx, testWebhookBlock(1))
+	s.HandleBlock(ctx, testWebhookBlock(2))
+	handled := make(chan struct{})
+	go func() {
+		s.HandleBlock(ctx, testWebhookBlock(3))
+		close(handled)
+	}()
+	select {
+	case <-handled:
+		t.Fatal("block handled while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	for _, expected := range []int64{1, 2, 3} {
+		select {
+		case index := <-delivered:
+			if index != expected {
+				t.Errorf("delivered block %d, expected %d", index, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("block %d not delivered", expected)
+		}
+	}
+	<-handled
+}
+
+func TestWebhookCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rosetta-cusd-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursor.json")
+
+	release := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	block := func(index int64) *types.Block {
+		block := testWebhookBlock(index)
+		block.BlockIdentifier.Hash = fmt.Sprintf("0x%02x", index)
+		block.ParentBlockIdentifier = &types.BlockIdentifier{Index: index - 1, Hash: fmt.Sprintf("0x%02x", index-1)}
+		return block
+	}
+	// Waits for the cursor file to hold the given block
+	expectCursor := func(index int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var cursor types.BlockIdentifier
+			data, err := ioutil.ReadFile(path)
+			if err == nil && json.Unmarshal(data, &cursor) == nil && cursor.Index == index {
+				if cursor.Hash != fmt.Sprintf("0x%02x", index) {
+					t.Errorf("cursor hash %s for block %d", cursor.Hash, index)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("cursor %s, expected block %d", data, index)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	s := newTestWebhookService()
+	if cursor, err := s.SetCursorFile(path); err != nil || cursor != nil {
+		t.Fatalf("cursor %v, error %v before any delivery", cursor, err)
+	}
+	if _, err := s.Register(&WebhookSubscription{URL: server.URL, Addresses: []string{testWatchedAddress}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	release <- struct{}{}
+	s.HandleBlock(ctx, block(1))
+	expectCursor(1)
+	// Not moved past block 2 until it is delivered, but past blocks without deliveries
+	s.HandleBlock(ctx, block(2))
+	empty := block(3)
+	empty.Transactions = nil
+	s.HandleBlock(ctx, empty)
+	expectCursor(1)
+	release <- struct{}{}
+	expectCursor(3)
+
+	cursor, err := newTestWebhookService().SetCursorFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor == nil || cursor.Index != 3 || cursor.Hash != "0x03" {
+		t.Errorf("read cursor %+v, expected block 3", cursor)
+	}
+}
+
+func TestWebhookRegister(t *testing.T) {
+	s := newTestWebhookService()
+	sub := &WebhookSubscription{ID: "sub", URL: "https://example.com", Addresses: []string{strings.ToLower(testWatchedAddress)}}
+	if _, err := s.Register(sub); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Addresses[0] != strings.ToLower(testWatchedAddress) || sub.watched != nil {
+		t.Error("Register modified the subscription passed in")
+	}
+	if _, err := s.Register(sub); err != errWebhookExists {
+		t.Errorf("registering a duplicate id: %v, expected errWebhookExists", err)
+	}
+
+	invalid := []*WebhookSubscription{
+		{ID: "no-url", Addresses: []string{testWatchedAddress}},
+		{ID: "relative-url", URL: "/hook", Addresses: []string{testWatchedAddress}},
+		{ID: "no-address", URL: "https://example.com"},
+		{ID: "bad-address", URL: "https://example.com", Addresses: []string{"0x1234"}},
+	}
+	for _, sub := range invalid {
+		if _, err := s.Register(sub); err == nil {
+			t.Errorf("%s: expected an error", sub.ID)
+		}
+	}
+	if n := len(s.Subscriptions()); n != 1 {
+		t.Errorf("%d subscriptions, expected 1", n)
+	}
+}
+
+func TestWebhookAdminRequiresToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		status        int
+	}{
+		{"no token configured", "", "Bearer ", http.StatusUnauthorized},
+		{"missing header", "token", "", http.StatusUnauthorized},
+		{"wrong token", "token", "Bearer other", http.StatusUnauthorized},
+		{"valid token", "token", "Bearer token", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controller := NewWebhookAPIController(newTestWebhookService(), test.adminToken)
+			req := httptest.NewRequest(http.MethodPost, "/admin/webhooks/list", strings.NewReader("{}"))
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			controller.authorized(controller.WebhookList)(w, req)
+			if w.Code != test.status {
+				t.Errorf("status %d, expected %d", w.Code, test.status)
+			}
+		})
+	}
+}